@@ -0,0 +1,28 @@
+// Command auditverify walks the audit log hash chain and exits with status 1 if it is broken.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+func main() {
+	db, err := server.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	result, err := db.VerifyAudit(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !result.OK {
+		log.Printf("audit log is broken at entry %d after %d valid entries: %s", result.BrokenID, result.Checked, result.Reason)
+		db.Close()
+		os.Exit(1)
+	}
+	log.Printf("audit log is intact, %d entries checked", result.Checked)
+}
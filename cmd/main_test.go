@@ -3,11 +3,29 @@ package main
 import (
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"testing"
 	"time"
 )
 
+// apiKeyTransport signs every request of the tests with the bootstrap admin key of docker-compose.yml.
+type apiKeyTransport struct{ key string }
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-API-Key", t.key)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func init() {
+	key, ok := os.LookupEnv("ADMIN_API_KEY")
+	if !ok {
+		key = "change-me"
+	}
+	http.DefaultClient.Transport = apiKeyTransport{key}
+}
+
 func respError(t *testing.T, count int, err error) {
 	if err != nil {
 		t.Errorf("%d: %s", count, err.Error())
@@ -142,7 +160,7 @@ func TestCancellation(t *testing.T) {
 	respError(t, 0, err)
 
 	count := 1
-	bodyReq = strings.NewReader(`{"user_id": 4, "order_id": 123}`)
+	bodyReq = strings.NewReader(`{"user_id": 4, "order_id": 123, "service_id": 30}`)
 	resp, err := http.Post("http://localhost:8080/cancel_reserve", "application/json", bodyReq)
 	respError(t, count, err)
 	assertQuery(t, readStatus(resp) == http.StatusOK, "expected status OK", count)
@@ -166,5 +184,6 @@ func TestAccount(t *testing.T) {
 	bs := make([]byte, 1024)
 	n, err := readBody(&bs, resp)
 	respError(t, count, err)
-	assertQuery(t, string(bs[:n]) == `{"balance":20000}`, `expected body {"balance":20000}`, count)
+	assertQuery(t, string(bs[:n]) == `{"currency":"RUB","balance":20000,"total":20000,"held":0,"available":20000,"holds":[]}`,
+		`expected body {"currency":"RUB","balance":20000,"total":20000,"held":0,"available":20000,"holds":[]}`, count)
 }
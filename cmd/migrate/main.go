@@ -0,0 +1,23 @@
+// Command migrate brings the billing database up to the schema of this version, it is safe to run again.
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/Placebo900/billing_service_test/pkg/database"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+func main() {
+	db, err := server.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err = database.Migrate(context.Background(), db.DB); err != nil {
+		db.Close()
+		log.Fatal(err)
+	}
+	log.Print("database is up to date")
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAdjustments caps one page of the adjustment list.
+const maxAdjustments = 500
+
+type adjustmentRequest struct {
+	UserID   int     `json:"user_id"`
+	Currency string  `json:"currency"`
+	Type     string  `json:"type"`
+	Amount   float64 `json:"amount"`
+	Reason   string  `json:"reason"`
+	Ticket   string  `json:"ticket"`
+}
+
+// postAdjustment godoc
+// @Accept json
+// @Produce json
+// @Success 201
+// @Router /admin/adjustments [post]
+func postAdjustment(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req adjustmentRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Amount < 0 ||
+			(req.Type != server.AdjustmentCredit && req.Type != server.AdjustmentDebit) {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  "type must be credit or debit and amount positive",
+			})
+			return
+		}
+		adj := server.Adjustment{UserID: req.UserID, Currency: req.Currency, Amount: req.Amount, Reason: req.Reason, Ticket: req.Ticket}
+		if req.Type == server.AdjustmentDebit {
+			adj.Amount = -adj.Amount
+		}
+		if err := adj.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		log.Printf("ADJUSTING WITH VALUES %+v", req)
+		adj, err := db.CreateAdjustment(c.Request.Context(), adj)
+		if !checkDecision(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, adj)
+	}
+}
+
+// getAdjustments godoc
+// @Produce json
+// @Param status query string false "pending, posted or rejected"
+// @Param user_id query int false "only adjustments of this user"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/adjustments [get]
+func getAdjustments(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.DefaultQuery("user_id", "0"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxAdjustments {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		adjustments, err := db.Adjustments(c.Request.Context(), c.Query("status"), userID, limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"adjustments": adjustments,
+		})
+	}
+}
+
+// getAdjustment godoc
+// @Produce json
+// @Param id path int true "adjustment id"
+// @Success 200
+// @Router /admin/adjustments/{id} [get]
+func getAdjustment(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		adj, err := db.Adjustment(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, adj)
+	}
+}
+
+// postApproveAdjustment godoc
+// @Produce json
+// @Param id path int true "adjustment id"
+// @Success 200
+// @Router /admin/adjustments/{id}/approve [post]
+func postApproveAdjustment(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("APPROVING ADJUSTMENT %d", id)
+		adj, err := db.ApproveAdjustment(c.Request.Context(), id)
+		if !checkDecision(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, adj)
+	}
+}
+
+// postRejectAdjustment godoc
+// @Produce json
+// @Param id path int true "adjustment id"
+// @Success 200
+// @Router /admin/adjustments/{id}/reject [post]
+func postRejectAdjustment(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("REJECTING ADJUSTMENT %d", id)
+		adj, err := db.RejectAdjustment(c.Request.Context(), id)
+		if !checkDecision(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, adj)
+	}
+}
+
+// checkDecision answers 404 for an unknown adjustment or review, 403 when the account status or a limit
+// refuses it, 409 for one that can't be posted or decided, and reports whether the handler may go on.
+func checkDecision(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "Not found",
+		})
+	case errors.Is(err, server.ErrAccountStatus), errors.Is(err, server.ErrLimitExceeded):
+		refused(c, err)
+	case errors.Is(err, server.ErrInvalidAmount), errors.Is(err, server.ErrUnsupportedCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Bad request",
+			"error":  err.Error(),
+		})
+	case errors.Is(err, server.ErrWrongOperation), errors.Is(err, server.ErrNotEnoughMoney):
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "Conflict",
+			"error":  err.Error(),
+		})
+	default:
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "Internal server error",
+		})
+	}
+	return false
+}
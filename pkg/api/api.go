@@ -1,14 +1,36 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/blob"
+	"github.com/Placebo900/billing_service_test/pkg/commands"
+	"github.com/Placebo900/billing_service_test/pkg/config"
+	"github.com/Placebo900/billing_service_test/pkg/events"
+	"github.com/Placebo900/billing_service_test/pkg/grpcapi"
+	"github.com/Placebo900/billing_service_test/pkg/jobs"
+	"github.com/Placebo900/billing_service_test/pkg/ratelimit"
+	"github.com/Placebo900/billing_service_test/pkg/rates"
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/risk"
 	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/Placebo900/billing_service_test/pkg/webhooks"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -24,10 +46,17 @@ type BillingID struct {
 	Price     float64 `json:"price"`
 	ServiceID int     `json:"service_id"`
 	OrderID   int     `json:"order_id"`
+	Currency  string  `json:"currency"`
 	Account   string  `json:"account"`
 	Date      string  `json:"date"`
 	Limit     int     `json:"limit"`
 	Offset    int     `json:"offset"`
+	// Pending credits reach the balance only after /credit/settle, /credit/reject drops them.
+	Pending        bool  `json:"pending"`
+	CreditID       int64 `json:"credit_id"`
+	IncludePending bool  `json:"include_pending"`
+	// Voucher is a code redeemed for money on /credit or applied as a discount on /reserve.
+	Voucher string `json:"voucher"`
 }
 
 func Start() error {
@@ -37,19 +66,181 @@ func Start() error {
 		db.Close()
 		return err
 	}
+	cfg := config.Load()
+	store, err := newBlobStore(cfg)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+	db.ReserveTTL = cfg.ReserveTTL
+	db.Currencies = cfg.Currencies
+	db.DefaultTimeout = cfg.DBTimeout
+	db.Timeouts = cfg.DBTimeouts
+	db.AdjustmentThreshold = cfg.AdjustmentThreshold
+	db.DebtTerm = cfg.DebtTerm
+	db.BonusPriority = cfg.BonusPriority
+	db.BonusMaxShare = cfg.BonusMaxShare
+	if err = server.CheckBonusPriority(db.BonusPriority); err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+	if cfg.RiskRules != "" {
+		if db.Risk, err = risk.Load(cfg.RiskRules); err != nil {
+			log.Print("ERROR: ", err)
+			db.Close()
+			return err
+		}
+	}
+	pool := jobs.NewPool(&db, store, cfg.ReportWorkers, cfg.ReportJobLease)
+	go pool.Run(context.Background())
+	sink, err := newEventSink(cfg)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+	// subscriptions get their deliveries from the outbox too, whatever EVENT_SINK is
+	var fanout events.Sink = webhooks.NewFanout(&db)
+	if sink != nil {
+		fanout = events.Multi(sink, fanout)
+	}
+	defer fanout.Close()
+	go events.NewRelay(&db, fanout, cfg.EventPollInterval).Run(context.Background())
+	dispatcher := webhooks.NewDispatcher(&db, cfg.WebhookTimeout, cfg.WebhookMaxAttempts, cfg.WebhookBackoff, cfg.WebhookMaxBackoff)
+	go dispatcher.Run(context.Background())
+	go expireReserves(context.Background(), &db, cfg.ReserveSweepInterval)
+	broker, err := newCommandBroker(cfg)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+	if broker != nil {
+		defer broker.Close()
+		go func() {
+			if err := commands.NewConsumer(&db, broker).Run(context.Background()); err != nil {
+				log.Print("ERROR: command consumer stopped: ", err)
+			}
+		}()
+	}
+
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+
+	lis, err := net.Listen("tcp", cfg.GRPCAddr)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		db.Close()
+		return err
+	}
+	authn := auth.NewAuthenticator(&db, cfg.AdminAPIKey)
+	if cfg.JWKSSource != "" {
+		authn.Tokens = &auth.TokenVerifier{
+			JWKS:     auth.NewJWKS(cfg.JWKSSource, cfg.JWKSRefresh),
+			Issuer:   cfg.JWTIssuer,
+			Audience: cfg.JWTAudience,
+		}
+	}
+	grpcServer := grpcapi.NewServer(&db, authn, limiter)
+	defer grpcServer.GracefulStop()
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Print("ERROR: gRPC server stopped: ", err)
+		}
+	}()
+
 	router := gin.New()
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	router.POST("/credit", postCredit(&db))
-	router.POST("/reserve", postReserve(&db))
-	router.POST("/debit_reserve", postDebitReserve(&db))
-	router.POST("/cancel_reserve", postCancelReserve(&db))
-	router.GET("/account", getAccount(&db))
-	router.GET("/report", getMonthlyReport(&db))
-	router.GET("/client_report", getClientReport(&db))
+	api := router.Group("/", authenticate(authn, &db), rateLimit(limiter), auditRequest())
+	credit := requireScope(auth.ScopeCredit)
+	reserve := requireScope(auth.ScopeReserve)
+	capture := requireScope(auth.ScopeCapture)
+	transfer := requireScope(auth.ScopeTransfer)
+	readBalance := requireScope(auth.ScopeReadBalance)
+	ownUser := requireOwnUser()
+	reports := requireScope(auth.ScopeReports)
+	admin := requireScope(auth.ScopeAdmin)
+
+	api.POST("/credit", credit, postCredit(&db))
+	api.POST("/credit/settle", credit, postSettleCredit(&db))
+	api.POST("/credit/reject", credit, postRejectCredit(&db))
+	api.POST("/reserve", reserve, postReserve(&db))
+	api.POST("/debit_reserve", capture, postDebitReserve(&db))
+	api.POST("/cancel_reserve", reserve, postCancelReserve(&db))
+	api.POST("/refund", capture, postRefund(&db))
+	api.POST("/transfer", transfer, postTransfer(&db))
+	api.GET("/account", readBalance, getAccount(&db))
+	api.GET("/report", reports, getMonthlyReport(&db))
+	api.GET("/client_report", readBalance, getClientReport(&db))
+	api.GET("/reports/revenue", reports, getRevenueReport(&db))
+	api.GET("/reports/debtors", reports, getDebtorsReport(&db))
+	api.GET("/reports/vouchers", reports, getVoucherReport(&db))
+	api.GET("/users/:id/statement", readBalance, ownUser, getStatement(&db))
+	api.GET("/users/:id/balance", readBalance, ownUser, getBalanceAt(&db))
+	api.GET("/users/:id/balance/history", readBalance, ownUser, getBalanceHistory(&db))
+	api.GET("/users/:id/wallets", readBalance, ownUser, getWallets(&db))
+	api.GET("/users/:id/limits", readBalance, ownUser, getSpendingLimits(&db))
+	api.GET("/users/:id/limits/usage", readBalance, ownUser, getLimitUsage(&db))
+	api.GET("/users/:id/bonuses", readBalance, ownUser, getBonuses(&db))
+	if cfg.RatesFile != "" {
+		provider, err := rates.LoadStatic(cfg.RatesFile)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			db.Close()
+			return err
+		}
+		api.POST("/convert", admin, postConvert(&db, provider))
+	}
+	api.POST("/webhooks", admin, postSubscription(&db))
+	api.GET("/webhooks", admin, getSubscriptions(&db))
+	api.GET("/webhooks/:id", admin, getSubscription(&db))
+	api.PUT("/webhooks/:id", admin, putSubscription(&db))
+	api.DELETE("/webhooks/:id", admin, deleteSubscription(&db))
+	api.GET("/webhooks/:id/deliveries", admin, getDeliveries(&db))
+	api.GET("/webhooks/deliveries/:id", admin, getDelivery(&db))
+	api.POST("/webhooks/deliveries/:id/replay", admin, postReplayDelivery(&db))
+	api.POST("/reports", reports, postReportJob(pool))
+	api.GET("/reports/:id", reports, getReportJob(&db, pool, cfg.ReportURLTTL))
+	api.POST("/admin/keys", admin, postAPIKey(&db))
+	api.GET("/admin/keys", admin, getAPIKeys(&db))
+	api.DELETE("/admin/keys/:id", admin, deleteAPIKey(&db))
+	api.GET("/admin/keys/:id/usage", admin, getKeyUsage(&db))
+	api.GET("/admin/audit", admin, getAudit(&db))
+	api.POST("/admin/adjustments", admin, postAdjustment(&db))
+	api.GET("/admin/adjustments", admin, getAdjustments(&db))
+	api.GET("/admin/adjustments/:id", admin, getAdjustment(&db))
+	api.POST("/admin/adjustments/:id/approve", admin, postApproveAdjustment(&db))
+	api.POST("/admin/adjustments/:id/reject", admin, postRejectAdjustment(&db))
+	api.GET("/admin/users/:id/status", admin, getAccountStatus(&db))
+	api.POST("/admin/users/:id/status", admin, postAccountStatus(&db))
+	api.GET("/admin/users/:id/status/history", admin, getStatusHistory(&db))
+	api.PUT("/admin/users/:id/credit_limit", admin, putCreditLimit(&db))
+	api.PUT("/admin/users/:id/limits", admin, putSpendingLimit(&db))
+	api.DELETE("/admin/users/:id/limits", admin, deleteSpendingLimit(&db))
+	api.PUT("/admin/users/:id/timezone", admin, putTimezone(&db))
+	api.GET("/admin/reviews", admin, getReviews(&db))
+	api.GET("/admin/reviews/:id", admin, getReview(&db))
+	api.POST("/admin/reviews/:id/approve", admin, postApproveReview(&db))
+	api.POST("/admin/reviews/:id/reject", admin, postRejectReview(&db))
+	api.POST("/admin/users/:id/bonuses", admin, postBonus(&db))
+	api.POST("/admin/vouchers", admin, postVoucherBatch(&db))
+	api.GET("/admin/vouchers", admin, getVoucherBatches(&db))
+	api.GET("/admin/vouchers/:id", admin, getVoucherBatch(&db))
+	// download links are signed, they are handed out to whoever may not hold a key
+	if local, ok := store.(*blob.Local); ok {
+		router.GET("/files/:key", getFile(local))
+	}
 	if err = router.Run(":8080"); err != nil {
 		db.Close()
 		return err
@@ -72,10 +263,44 @@ func postCredit(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if billID.Pending {
+			log.Printf("ADDING PENDING CREDIT WITH VALUES %+v", billID)
+			creditID, err := db.AddPendingCredit(c.Request.Context(), billID.UserID, billID.Currency, billID.Price)
+			if err != nil {
+				log.Print("ERROR: ", err)
+				if refused(c, err) {
+					return
+				}
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "Bad request",
+				})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"status":    "OK",
+				"credit_id": creditID,
+			})
+			return
+		}
+		if billID.Voucher != "" {
+			log.Printf("REDEEMING VOUCHER WITH VALUES %+v", billID)
+			redemption, err := db.RedeemVoucher(c.Request.Context(), billID.UserID, billID.Voucher)
+			if !checkRedemption(c, err) {
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"status":     "OK",
+				"redemption": redemption,
+			})
+			return
+		}
 		log.Printf("CREDITING WITH VALUES %+v", billID)
-		err := db.CreditUser(billID.UserID, billID.Price)
+		err := db.CreditUser(c.Request.Context(), billID.UserID, billID.Currency, billID.Price)
 		if err != nil {
 			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "Bad request",
 			})
@@ -88,6 +313,73 @@ func postCredit(db *server.BillingDB) gin.HandlerFunc {
 	}
 }
 
+// postSettleCredit godoc
+// @Produce json
+// @Success 200
+// @Router /credit/settle [post]
+func postSettleCredit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var billID BillingID
+		if err := fillBillingID(c, &billID); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("SETTLING CREDIT WITH VALUES %+v", billID)
+		err := db.SettleCredit(c.Request.Context(), billID.CreditID)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+		})
+	}
+}
+
+// postRejectCredit godoc
+// @Produce json
+// @Success 200
+// @Router /credit/reject [post]
+func postRejectCredit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var billID BillingID
+		if err := fillBillingID(c, &billID); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("REJECTING CREDIT WITH VALUES %+v", billID)
+		err := db.RejectCredit(c.Request.Context(), billID.CreditID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+		})
+	}
+}
+
 // postCredit godoc
 // @Produce json
 // @Success 200
@@ -102,10 +394,29 @@ func postReserve(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if !authorizeService(c, billID.ServiceID) {
+			return
+		}
+		if billID.Voucher != "" {
+			log.Printf("RESERVING WITH VOUCHER WITH VALUES %+v", billID)
+			redemption, err := db.ReserveWithVoucher(c.Request.Context(), billID.UserID, billID.ServiceID, billID.OrderID,
+				billID.Currency, billID.Price, billID.Voucher)
+			if !checkRedemption(c, err) {
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"status":     "OK",
+				"redemption": redemption,
+			})
+			return
+		}
 		log.Printf("RESERVING WITH VALUES %+v", billID)
-		err := db.ReserveMoney(billID.UserID, billID.ServiceID, billID.OrderID, billID.Price)
+		err := db.ReserveMoney(c.Request.Context(), billID.UserID, billID.ServiceID, billID.OrderID, billID.Currency, billID.Price)
 		if err != nil {
 			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "Bad request",
 			})
@@ -131,10 +442,16 @@ func postDebitReserve(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if !authorizeService(c, billID.ServiceID) {
+			return
+		}
 		log.Printf("DEBITING RESERVE WITH VALUES %+v", billID)
-		err := db.Confirmation(billID.UserID, billID.ServiceID, billID.OrderID, billID.Price)
+		err := db.Confirmation(c.Request.Context(), billID.UserID, billID.ServiceID, billID.OrderID, billID.Currency, billID.Price)
 		if err != nil {
 			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "Bad request",
 			})
@@ -160,10 +477,51 @@ func postCancelReserve(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if !authorizeService(c, billID.ServiceID) {
+			return
+		}
 		log.Printf("CANCELLING WITH VALUES %+v", billID)
-		err := db.Cancellation(billID.UserID, billID.OrderID)
+		err := db.Cancellation(c.Request.Context(), billID.UserID, billID.ServiceID, billID.OrderID)
 		if err != nil {
 			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "OK",
+		})
+	}
+}
+
+// postRefund godoc
+// @Produce json
+// @Success 200
+// @Router /refund [post]
+func postRefund(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var billID BillingID
+		if err := fillBillingID(c, &billID); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		if !authorizeService(c, billID.ServiceID) {
+			return
+		}
+		log.Printf("REFUNDING WITH VALUES %+v", billID)
+		err := db.Refund(c.Request.Context(), billID.UserID, billID.ServiceID, billID.OrderID)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{
 				"status": "Bad request",
 			})
@@ -189,8 +547,11 @@ func getAccount(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if !authorizeUser(c, billID.UserID) {
+			return
+		}
 		log.Printf("CHECKING BALANCE WITH VALUES %+v", billID)
-		balance, err := db.CheckBalance(billID.UserID)
+		account, err := db.CheckAccount(c.Request.Context(), billID.UserID, billID.Currency, billID.IncludePending)
 		if err != nil {
 			log.Print("ERROR: ", err)
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -198,14 +559,14 @@ func getAccount(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"balance": balance,
-		})
+		c.JSON(http.StatusOK, account)
 	}
 }
 
 // postCredit godoc
-// @Produce json
+// @Produce text/csv,json,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/vnd.apache.parquet
+// @Param format query string false "csv (default), json, xlsx or parquet"
+// @Param delimiter query string false "csv delimiter, comma by default"
 // @Success 200
 // @Router /report [get]
 func getMonthlyReport(db *server.BillingDB) gin.HandlerFunc {
@@ -219,7 +580,7 @@ func getMonthlyReport(db *server.BillingDB) gin.HandlerFunc {
 			return
 		}
 		log.Printf("CHECKING MONTHLY REPORT WITH VALUES %+v", billID)
-		err := db.CheckMonthlyReport(billID.Date)
+		table, err := db.CheckMonthlyReport(c.Request.Context(), billID.Date)
 		if err != nil {
 			log.Print("ERROR: ", err)
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -227,8 +588,7 @@ func getMonthlyReport(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
-		log.Print("sending file")
-		c.FileAttachment(fmt.Sprintf("/cmd/bill_%s.csv", billID.Date), fmt.Sprintf("bill_%s.csv", billID.Date))
+		writeReport(c, table, report.CSV{})
 	}
 }
 
@@ -246,8 +606,11 @@ func getClientReport(db *server.BillingDB) gin.HandlerFunc {
 			})
 			return
 		}
+		if !authorizeUser(c, billID.UserID) {
+			return
+		}
 		log.Printf("CHECKING CLIENT REPORT WITH VALUES %+v", billID)
-		reports, err := db.CheckClientTransactions(billID.UserID, billID.Limit, billID.Offset)
+		reports, err := db.CheckClientTransactions(c.Request.Context(), billID.UserID, billID.Limit, billID.Offset)
 		if err != nil {
 			log.Print("ERROR: ", err)
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -260,6 +623,433 @@ func getClientReport(db *server.BillingDB) gin.HandlerFunc {
 	}
 }
 
+// getRevenueReport godoc
+// @Produce json,text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/vnd.apache.parquet
+// @Param format query string false "json (default), csv, xlsx or parquet"
+// @Param delimiter query string false "csv delimiter, comma by default"
+// @Param period query string false "day, week, month or quarter around date"
+// @Param date query string false "anchor date YYYY-MM-DD for period"
+// @Param from query string false "first day YYYY-MM-DD of a custom period"
+// @Param to query string false "last day YYYY-MM-DD of a custom period"
+// @Param tz query string false "IANA timezone, UTC by default"
+// @Param group_by query string false "service (default), day or segment"
+// @Success 200
+// @Router /reports/revenue [get]
+func getRevenueReport(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params server.ReportParams
+		if err := c.ShouldBindQuery(&params); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		params.Type = server.ReportRevenue
+		log.Printf("CHECKING REVENUE REPORT WITH VALUES %+v", params)
+		query, err := server.NewRevenueQuery(params)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		revenue, err := db.RevenueReport(c.Request.Context(), query)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		writeReport(c, revenue.Table(), report.JSON{})
+	}
+}
+
+// writeReport encodes the table in the format asked by ?format= or the Accept header.
+// The CSV delimiter can be changed with ?delimiter=, e.g. ";" for Excel in European locales.
+func writeReport(c *gin.Context, table *report.Table, fallback report.Format) {
+	defer table.Close()
+	format, err := report.Negotiate(c.Query("format"), c.GetHeader("Accept"), c.Query("delimiter"), fallback)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"status": "Not acceptable",
+		})
+		return
+	}
+	c.Header("Content-Type", format.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, table.Name, format.Extension()))
+	c.Status(http.StatusOK)
+	if err = format.Encode(c.Writer, table); err != nil {
+		log.Print("ERROR: ", err)
+		c.Abort()
+	}
+}
+
+// getStatement godoc
+// @Produce application/pdf,text/csv
+// @Param id path int true "user id"
+// @Param from query string true "first day YYYY-MM-DD"
+// @Param to query string true "last day YYYY-MM-DD"
+// @Param tz query string false "IANA timezone, UTC by default"
+// @Param currency query string false "wallet currency, RUB by default"
+// @Param format query string false "pdf (default) or csv"
+// @Success 200
+// @Router /users/{id}/statement [get]
+func getStatement(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		from, to, err := server.ReportPeriod("", "", c.Query("from"), c.Query("to"), loc)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("CHECKING STATEMENT OF USER %d FROM %s TO %s", userID, from, to)
+		statement, err := db.UserStatement(c.Request.Context(), userID, c.Query("currency"), from, to)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		writeReport(c, statement.Table(loc), report.PDF{})
+	}
+}
+
+// getBalanceAt godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Param at query string false "RFC 3339 or YYYY-MM-DD HH:MM in tz, now by default"
+// @Param tz query string false "IANA timezone, UTC by default"
+// @Param currency query string false "wallet currency, RUB by default"
+// @Success 200
+// @Router /users/{id}/balance [get]
+func getBalanceAt(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		at := time.Now().In(loc)
+		if value := c.Query("at"); value != "" {
+			if at, err = server.ParseMoment(value, loc); err != nil {
+				log.Print("ERROR: ", err)
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "Bad request",
+				})
+				return
+			}
+		}
+		log.Printf("CHECKING BALANCE OF USER %d AT %s", userID, at)
+		point, err := db.BalanceAt(c.Request.Context(), userID, c.Query("currency"), at)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if !checkLimitRequest(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, point)
+	}
+}
+
+// getBalanceHistory godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Param from query string true "first day YYYY-MM-DD"
+// @Param to query string true "last day YYYY-MM-DD"
+// @Param interval query string false "hour, day (default), week or month"
+// @Param tz query string false "IANA timezone, UTC by default"
+// @Param currency query string false "wallet currency, RUB by default"
+// @Success 200
+// @Router /users/{id}/balance/history [get]
+func getBalanceHistory(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		from, to, err := server.ReportPeriod("", "", c.Query("from"), c.Query("to"), loc)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		interval := c.DefaultQuery("interval", server.IntervalDay)
+		log.Printf("CHECKING BALANCE HISTORY OF USER %d FROM %s TO %s BY %s", userID, from, to, interval)
+		history, err := db.BalanceHistory(c.Request.Context(), userID, c.Query("currency"), from, to, interval)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if !checkLimitRequest(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":  userID,
+			"interval": interval,
+			"history":  history,
+		})
+	}
+}
+
+// postReportJob godoc
+// @Accept json
+// @Produce json
+// @Success 202
+// @Router /reports [post]
+func postReportJob(pool *jobs.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params server.ReportParams
+		if err := c.ShouldBindJSON(&params); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("ENQUEUEING REPORT WITH VALUES %+v", params)
+		job, err := pool.Enqueue(c.Request.Context(), params)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.Header("Location", "/reports/"+job.ID)
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// getReportJob godoc
+// @Produce json
+// @Param id path string true "report id"
+// @Success 200
+// @Router /reports/{id} [get]
+func getReportJob(db *server.BillingDB, pool *jobs.Pool, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := db.GetReportJob(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		if job.Status != server.JobDone {
+			c.JSON(http.StatusOK, job)
+			return
+		}
+		url, err := pool.URL(c.Request.Context(), job, ttl)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":          job.ID,
+			"params":      job.Params,
+			"status":      job.Status,
+			"created_at":  job.CreatedAt,
+			"finished_at": job.FinishedAt,
+			"url":         url,
+			"expires_at":  time.Now().Add(ttl).UTC(),
+		})
+	}
+}
+
+// getFile serves files of the local blob store behind signed links.
+func getFile(store *blob.Local) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		f, err := store.Open(key, c.Query("expires"), c.Query("signature"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "Forbidden",
+			})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, key))
+		http.ServeContent(c.Writer, c.Request, key, info.ModTime(), f)
+	}
+}
+
+func newBlobStore(cfg config.Config) (blob.Store, error) {
+	switch cfg.BlobStore {
+	case "local":
+		secret := []byte(cfg.BlobSecret)
+		if len(secret) == 0 {
+			// links stay valid only until restart
+			log.Print("WARNING: BLOB_SECRET is not set, using a random one")
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+		}
+		return blob.NewLocal(cfg.BlobDir, cfg.BaseURL, secret)
+	case "s3":
+		return blob.NewS3(context.Background(), cfg.S3Endpoint, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3UseSSL)
+	}
+	return nil, fmt.Errorf("unknown blob store %q", cfg.BlobStore)
+}
+
+// expireReserves releases overdue reserves every interval until ctx is cancelled.
+func expireReserves(ctx context.Context, db *server.BillingDB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := db.ExpireReserves(ctx, time.Now())
+		if err != nil {
+			log.Print("ERROR: ", err)
+		}
+		if expired > 0 {
+			log.Printf("EXPIRED %d RESERVES", expired)
+		}
+	}
+}
+
+// newCommandBroker returns nil when COMMAND_BROKER is empty.
+func newCommandBroker(cfg config.Config) (commands.Broker, error) {
+	switch cfg.CommandBroker {
+	case "":
+		return nil, nil
+	case "kafka":
+		return commands.NewKafka(cfg.KafkaBrokers, cfg.CommandTopic, cfg.CommandGroup, cfg.CommandReplyTopic), nil
+	case "nats":
+		return commands.NewNATS(cfg.NATSURL, cfg.CommandTopic, cfg.CommandGroup, cfg.CommandReplyTopic)
+	}
+	return nil, fmt.Errorf("unknown command broker %q", cfg.CommandBroker)
+}
+
+// newRateLimiter builds the limiter of RATE_LIMIT_* with its backend.
+func newRateLimiter(cfg config.Config) (*ratelimit.Limiter, error) {
+	key, err := ratelimit.ParseLimit(cfg.RateLimitKey)
+	if err != nil {
+		return nil, err
+	}
+	user, err := ratelimit.ParseLimit(cfg.RateLimitUser)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := ratelimit.ParseRoutes(cfg.RateLimitRoutes)
+	if err != nil {
+		return nil, err
+	}
+	var backend ratelimit.Backend
+	switch cfg.RateLimitBackend {
+	case "memory":
+		backend = ratelimit.NewMemory()
+	case "redis":
+		backend = ratelimit.NewRedis(redis.NewClient(&redis.Options{Addr: cfg.RedisAddr}), "billing:ratelimit:")
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q", cfg.RateLimitBackend)
+	}
+	return ratelimit.New(backend, key, user, routes), nil
+}
+
+// newEventSink returns nil when EVENT_SINK is empty.
+func newEventSink(cfg config.Config) (events.Sink, error) {
+	switch cfg.EventSink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return events.NewWriter(os.Stdout), nil
+	case "file":
+		return events.OpenFile(cfg.EventFile)
+	case "webhook":
+		if cfg.EventWebhookURL == "" {
+			return nil, fmt.Errorf("EVENT_WEBHOOK_URL is not set")
+		}
+		return events.NewWebhook(cfg.EventWebhookURL), nil
+	case "kafka":
+		return events.NewKafka(cfg.KafkaBrokers, cfg.KafkaTopic), nil
+	case "nats":
+		return events.NewNATS(cfg.NATSURL, cfg.NATSSubject)
+	}
+	return nil, fmt.Errorf("unknown event sink %q", cfg.EventSink)
+}
+
 func fillBillingID(c *gin.Context, billID *BillingID) error {
 	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
@@ -271,7 +1061,7 @@ func fillBillingID(c *gin.Context, billID *BillingID) error {
 		return err
 	}
 	if billID.Price < 0 {
-		return fmt.Errorf("price cant't be lower than 0")
+		return server.ErrInvalidAmount
 	}
 	return nil
 }
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAuditEntries caps one page of the audit log.
+const maxAuditEntries = 500
+
+// getAudit godoc
+// @Produce json
+// @Param user_id query int false "only changes of this user"
+// @Param actor query string false "admin, key:<id>, user-token:<id>, command or system"
+// @Param operation query string false "ledger operation, e.g. reserve"
+// @Param request_id query string false "X-Request-ID of the request"
+// @Param from query string false "first moment, RFC 3339"
+// @Param to query string false "end of the period, RFC 3339"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/audit [get]
+func getAudit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := server.AuditQuery{
+			Actor:     c.Query("actor"),
+			Operation: c.Query("operation"),
+			RequestID: c.Query("request_id"),
+		}
+		var err error
+		if value := c.Query("user_id"); value != "" {
+			query.UserID, err = strconv.Atoi(value)
+		}
+		if err == nil && c.Query("from") != "" {
+			query.From, err = time.Parse(time.RFC3339, c.Query("from"))
+		}
+		if err == nil && c.Query("to") != "" {
+			query.To, err = time.Parse(time.RFC3339, c.Query("to"))
+		}
+		if err == nil {
+			query.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50"))
+		}
+		if err == nil {
+			query.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+		}
+		if err != nil || query.Limit < 1 || query.Limit > maxAuditEntries || query.Offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		entries, err := db.AuditLog(c.Request.Context(), query)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"audit": entries,
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxKeyUsages caps one page of the key usage audit.
+const maxKeyUsages = 500
+
+// apiKeyContext is where authenticate leaves the caller's key for the handlers.
+const apiKeyContext = "api_key"
+
+// authenticate rejects requests without a valid key and records every authenticated request in the usage audit.
+func authenticate(authn *auth.Authenticator, db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := authn.Authenticate(c.Request.Context(), auth.FromHeader(c.GetHeader("Authorization"), c.GetHeader("X-API-Key")))
+		if err != nil {
+			if !errors.Is(err, auth.ErrUnauthorized) {
+				log.Print("ERROR: ", err)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"status": "Unauthorized",
+			})
+			return
+		}
+		c.Set(apiKeyContext, key)
+		c.Next()
+
+		if key.UserID != 0 {
+			// end-user tokens aren't keys, there is nothing to audit
+			return
+		}
+		// the audit must not depend on the client still waiting for the answer
+		err = db.RecordKeyUsage(context.Background(), server.KeyUsage{
+			KeyID:  key.ID,
+			Method: c.Request.Method,
+			Route:  c.FullPath(),
+			Status: c.Writer.Status(),
+			IP:     c.ClientIP(),
+		})
+		if err != nil {
+			log.Print("ERROR: ", err)
+		}
+	}
+}
+
+// auditRequest names the request, and puts the caller and the raw request into its context
+// for the audit records of the changes it makes.
+func auditRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			requestID = server.NewRequestID()
+		}
+		c.Header("X-Request-ID", requestID)
+		raw := c.Request.Method + " " + c.Request.URL.RequestURI()
+		if body := peekBody(c); len(body) > 0 {
+			raw += "\n\n" + string(body)
+		}
+		ctx := server.WithAudit(c.Request.Context(), server.AuditInfo{
+			Actor:     auth.Caller(apiKey(c)),
+			RequestID: requestID,
+			IP:        c.ClientIP(),
+			Request:   raw,
+		})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requireScope lets the request through only if the key has the scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.Allows(apiKey(c), scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"status": "Forbidden",
+				"error":  "API key needs the " + scope + " scope",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireOwnUser keeps end-user tokens on the /users/:id routes of their own user.
+func requireOwnUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			// the handler answers 400
+			c.Next()
+			return
+		}
+		if !authorizeUser(c, userID) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func apiKey(c *gin.Context) server.APIKey {
+	key, _ := c.Get(apiKeyContext)
+	apiKey, _ := key.(server.APIKey)
+	return apiKey
+}
+
+// authorizeService answers 403 if the key is restricted to other services and reports whether the handler may go on.
+func authorizeService(c *gin.Context, serviceID int) bool {
+	return checkAuthorized(c, auth.AuthorizeService(apiKey(c), serviceID))
+}
+
+// authorizeUser answers 403 if an end-user token asks for the data of another user.
+func authorizeUser(c *gin.Context, userID int) bool {
+	return checkAuthorized(c, auth.AuthorizeUser(apiKey(c), userID))
+}
+
+func checkAuthorized(c *gin.Context, err error) bool {
+	if errors.Is(err, auth.ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "Forbidden",
+			"error":  err.Error(),
+		})
+		return false
+	}
+	if err != nil {
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "Internal server error",
+		})
+		return false
+	}
+	return true
+}
+
+type apiKeyRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ServiceIDs []int64  `json:"service_ids"`
+}
+
+// postAPIKey godoc
+// @Accept json
+// @Produce json
+// @Success 201
+// @Router /admin/keys [post]
+func postAPIKey(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req apiKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		key := server.APIKey{Name: req.Name, Scopes: req.Scopes, ServiceIDs: req.ServiceIDs}
+		if err := auth.Validate(key); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		secret, prefix, err := auth.Generate()
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		key.Prefix = prefix
+		log.Printf("CREATING API KEY WITH VALUES %+v", req)
+		key, err = db.CreateAPIKey(c.Request.Context(), key, auth.Hash(secret))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		key.Secret = secret
+		c.JSON(http.StatusCreated, key)
+	}
+}
+
+// getAPIKeys godoc
+// @Produce json
+// @Success 200
+// @Router /admin/keys [get]
+func getAPIKeys(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := db.APIKeys(c.Request.Context())
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"keys": keys,
+		})
+	}
+}
+
+// deleteAPIKey godoc
+// @Produce json
+// @Param id path int true "key id"
+// @Success 200
+// @Router /admin/keys/{id} [delete]
+func deleteAPIKey(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("REVOKING API KEY %d", id)
+		key, err := db.RevokeAPIKey(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, key)
+	}
+}
+
+// getKeyUsage godoc
+// @Produce json
+// @Param id path int true "key id, 0 for the bootstrap key"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/keys/{id}/usage [get]
+func getKeyUsage(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxKeyUsages {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		usages, err := db.KeyUsages(c.Request.Context(), id, limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"usage": usages,
+		})
+	}
+}
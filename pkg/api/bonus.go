@@ -0,0 +1,89 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+type bonusRequest struct {
+	Currency   string    `json:"currency"`
+	Amount     float64   `json:"amount"`
+	ServiceIDs []int64   `json:"service_ids"`
+	Reason     string    `json:"reason"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// postBonus godoc
+// @Accept json
+// @Produce json
+// @Param id path int true "user id"
+// @Success 201
+// @Router /admin/users/{id}/bonuses [post]
+func postBonus(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		var req bonusRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("GRANTING BONUS TO USER %d WITH VALUES %+v", userID, req)
+		bonus, err := db.GrantBonus(c.Request.Context(), server.Bonus{
+			UserID:     userID,
+			Currency:   req.Currency,
+			Amount:     req.Amount,
+			ServiceIDs: req.ServiceIDs,
+			Reason:     req.Reason,
+			ExpiresAt:  req.ExpiresAt,
+		})
+		if refused(c, err) || !checkLimitRequest(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, bonus)
+	}
+}
+
+// getBonuses godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Param all query bool false "list spent and expired grants too"
+// @Success 200
+// @Router /users/{id}/bonuses [get]
+func getBonuses(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		all, err := strconv.ParseBool(c.DefaultQuery("all", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		bonuses, err := db.Bonuses(c.Request.Context(), userID, all, time.Now())
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"bonuses": bonuses,
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/rates"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+type conversionRequest struct {
+	UserID       int     `json:"user_id"`
+	FromCurrency string  `json:"from_currency"`
+	ToCurrency   string  `json:"to_currency"`
+	Price        float64 `json:"price"`
+}
+
+// getWallets godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /users/{id}/wallets [get]
+func getWallets(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("CHECKING WALLETS OF USER %d", userID)
+		wallets, err := db.Wallets(c.Request.Context(), userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "Not found",
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"wallets": wallets,
+		})
+	}
+}
+
+// postConvert godoc
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /convert [post]
+func postConvert(db *server.BillingDB, provider rates.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req conversionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("CONVERTING WITH VALUES %+v", req)
+		from, err := db.Currency(req.FromCurrency)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		to, err := db.Currency(req.ToCurrency)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		rate, err := provider.Rate(c.Request.Context(), from, to)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		conversion, err := db.Convert(c.Request.Context(), server.Conversion{
+			UserID:       req.UserID,
+			FromCurrency: from,
+			ToCurrency:   to,
+			Amount:       req.Price,
+			Rate:         rate.Value,
+			RateSource:   rate.Source,
+			RateDate:     rate.Date,
+		})
+		if err != nil {
+			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, conversion)
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+type spendingLimitRequest struct {
+	Currency       string  `json:"currency"`
+	ServiceID      int     `json:"service_id"`
+	PerTransaction float64 `json:"per_transaction"`
+	PerDay         float64 `json:"per_day"`
+	PerMonth       float64 `json:"per_month"`
+}
+
+type timezoneRequest struct {
+	Timezone string `json:"timezone"`
+}
+
+// getSpendingLimits godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /users/{id}/limits [get]
+func getSpendingLimits(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		limits, err := db.SpendingLimits(c.Request.Context(), userID)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"limits":  limits,
+		})
+	}
+}
+
+// getLimitUsage godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /users/{id}/limits/usage [get]
+func getLimitUsage(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		usage, err := db.LimitUsage(c.Request.Context(), userID, time.Now())
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"usage":   usage,
+		})
+	}
+}
+
+// putSpendingLimit godoc
+// @Accept json
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /admin/users/{id}/limits [put]
+func putSpendingLimit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		var req spendingLimitRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("SETTING SPENDING LIMIT OF USER %d WITH VALUES %+v", userID, req)
+		limit, err := db.SetSpendingLimit(c.Request.Context(), server.SpendingLimit{
+			UserID:         userID,
+			Currency:       req.Currency,
+			ServiceID:      req.ServiceID,
+			PerTransaction: req.PerTransaction,
+			PerDay:         req.PerDay,
+			PerMonth:       req.PerMonth,
+		})
+		if !checkLimitRequest(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, limit)
+	}
+}
+
+// deleteSpendingLimit godoc
+// @Param id path int true "user id"
+// @Param currency query string false "wallet currency, RUB by default"
+// @Param service_id query int false "service of the limit, 0 (all services) by default"
+// @Success 204
+// @Router /admin/users/{id}/limits [delete]
+func deleteSpendingLimit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		serviceID, err := strconv.Atoi(c.DefaultQuery("service_id", "0"))
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("DELETING SPENDING LIMIT OF USER %d FOR %s AND SERVICE %d", userID, c.Query("currency"), serviceID)
+		err = db.DeleteSpendingLimit(c.Request.Context(), userID, c.Query("currency"), serviceID)
+		if errors.Is(err, server.ErrUnsupportedCurrency) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		if !checkFound(c, err) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// putTimezone godoc
+// @Accept json
+// @Param id path int true "user id"
+// @Success 204
+// @Router /admin/users/{id}/timezone [put]
+func putTimezone(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		var req timezoneRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("SETTING TIMEZONE OF USER %d TO %q", userID, req.Timezone)
+		if !checkLimitRequest(c, db.SetTimezone(c.Request.Context(), userID, req.Timezone)) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// checkLimitRequest answers 400 for invalid amounts, currencies or parameters such as limits, timezones
+// and intervals, and 500 for anything else, and reports whether the handler may go on.
+func checkLimitRequest(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, server.ErrInvalidAmount), errors.Is(err, server.ErrUnsupportedCurrency),
+		errors.Is(err, server.ErrWrongOperation):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Bad request",
+			"error":  err.Error(),
+		})
+	default:
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "Internal server error",
+		})
+	}
+	return false
+}
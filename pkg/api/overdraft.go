@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+type creditLimitRequest struct {
+	Currency    string  `json:"currency"`
+	CreditLimit float64 `json:"credit_limit"`
+}
+
+// putCreditLimit godoc
+// @Accept json
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /admin/users/{id}/credit_limit [put]
+func putCreditLimit(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		var req creditLimitRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("SETTING CREDIT LIMIT OF USER %d WITH VALUES %+v", userID, req)
+		wallet, err := db.SetCreditLimit(c.Request.Context(), userID, req.Currency, req.CreditLimit)
+		if errors.Is(err, server.ErrInvalidAmount) || errors.Is(err, server.ErrUnsupportedCurrency) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"wallet":  wallet,
+		})
+	}
+}
+
+// getDebtorsReport godoc
+// @Produce json,text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/vnd.apache.parquet
+// @Param format query string false "json (default), csv, xlsx or parquet"
+// @Success 200
+// @Router /reports/debtors [get]
+func getDebtorsReport(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Print("CHECKING DEBTORS REPORT")
+		debtors, err := db.DebtorsReport(c.Request.Context(), time.Now())
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		writeReport(c, debtors.Table(), report.JSON{})
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimit answers 429 once the key, the user or the route runs out of tokens.
+// Every answer carries the RateLimit headers of the most restrictive bucket.
+func rateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := limiter.Allow(c.Request.Context(), ratelimit.Request{
+			Key:    auth.Caller(apiKey(c)),
+			UserID: requestUser(c),
+			Route:  c.FullPath(),
+		})
+		if res.Limit > 0 {
+			c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+			c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			c.Header("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+		}
+		if !res.Allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"status": "Too many requests",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestUser finds the user a request is about in the path or the JSON body, leaving the body for the handler.
+func requestUser(c *gin.Context) int {
+	if strings.HasPrefix(c.FullPath(), "/users/:id/") {
+		userID, _ := strconv.Atoi(c.Param("id"))
+		return userID
+	}
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if json.Unmarshal(peekBody(c), &req) != nil {
+		return 0
+	}
+	return req.UserID
+}
+
+// peekBody reads the request body and puts it back for the handler.
+func peekBody(c *gin.Context) []byte {
+	if c.Request.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	return body
+}
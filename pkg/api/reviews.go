@@ -0,0 +1,117 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxReviews caps one page of the review queue.
+const maxReviews = 500
+
+// getReviews godoc
+// @Produce json
+// @Param status query string false "pending, approved or rejected"
+// @Param user_id query int false "only reviews of this user"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/reviews [get]
+func getReviews(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.DefaultQuery("user_id", "0"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxReviews {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		reviews, err := db.Reviews(c.Request.Context(), c.Query("status"), userID, limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"reviews": reviews,
+		})
+	}
+}
+
+// getReview godoc
+// @Produce json
+// @Param id path int true "review id"
+// @Success 200
+// @Router /admin/reviews/{id} [get]
+func getReview(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		review, err := db.Review(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, review)
+	}
+}
+
+// postApproveReview godoc
+// @Produce json
+// @Param id path int true "review id"
+// @Success 200
+// @Router /admin/reviews/{id}/approve [post]
+func postApproveReview(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("APPROVING REVIEW %d", id)
+		review, err := db.ApproveReview(c.Request.Context(), id)
+		if !checkDecision(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, review)
+	}
+}
+
+// postRejectReview godoc
+// @Produce json
+// @Param id path int true "review id"
+// @Success 200
+// @Router /admin/reviews/{id}/reject [post]
+func postRejectReview(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("REJECTING REVIEW %d", id)
+		review, err := db.RejectReview(c.Request.Context(), id)
+		if !checkDecision(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, review)
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxStatusChanges caps one page of the status history.
+const maxStatusChanges = 500
+
+type statusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// getAccountStatus godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /admin/users/{id}/status [get]
+func getAccountStatus(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		status, err := db.AccountStatus(c.Request.Context(), userID)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// postAccountStatus godoc
+// @Accept json
+// @Produce json
+// @Param id path int true "user id"
+// @Success 200
+// @Router /admin/users/{id}/status [post]
+func postAccountStatus(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		var req statusRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("CHANGING STATUS OF USER %d WITH VALUES %+v", userID, req)
+		change, err := db.SetAccountStatus(c.Request.Context(), userID, req.Status, req.Reason)
+		if errors.Is(err, server.ErrWrongOperation) {
+			c.JSON(http.StatusConflict, gin.H{
+				"status": "Conflict",
+				"error":  err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, change)
+	}
+}
+
+// getStatusHistory godoc
+// @Produce json
+// @Param id path int true "user id"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/users/{id}/status/history [get]
+func getStatusHistory(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := userParam(c)
+		if !ok {
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxStatusChanges {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		changes, err := db.StatusHistory(c.Request.Context(), userID, limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": userID,
+			"changes": changes,
+		})
+	}
+}
+
+// userParam parses the :id path parameter as a user id and answers 400 when it isn't a number.
+func userParam(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Bad request",
+		})
+		return 0, false
+	}
+	return userID, true
+}
+
+// refused answers for an operation that didn't run and reports whether it did: 403 with the reason when
+// the account status, a spending limit or a risk rule forbids it, 202 with the review when it waits for one.
+// A broken limit comes with the allowance that is left.
+func refused(c *gin.Context, err error) bool {
+	var limitErr *server.LimitError
+	var reviewErr *server.ReviewError
+	switch {
+	case errors.As(err, &reviewErr):
+		c.JSON(http.StatusAccepted, gin.H{
+			"status": "Held for review",
+			"error":  err.Error(),
+			"review": reviewErr.Review,
+		})
+	case errors.As(err, &limitErr):
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "Forbidden",
+			"error":  err.Error(),
+			"limit":  limitErr,
+		})
+	case errors.Is(err, server.ErrAccountStatus), errors.Is(err, server.ErrRiskDenied):
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "Forbidden",
+			"error":  err.Error(),
+		})
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+type transferRequest struct {
+	FromUserID int     `json:"from_user_id"`
+	ToUserID   int     `json:"to_user_id"`
+	Currency   string  `json:"currency"`
+	Price      float64 `json:"price"`
+}
+
+// postTransfer godoc
+// @Accept json
+// @Produce json
+// @Success 200
+// @Router /transfer [post]
+func postTransfer(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req transferRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		if !authorizeUser(c, req.FromUserID) {
+			return
+		}
+		log.Printf("TRANSFERRING WITH VALUES %+v", req)
+		transfer, err := db.Transfer(c.Request.Context(), server.Transfer{
+			FromUserID: req.FromUserID,
+			ToUserID:   req.ToUserID,
+			Currency:   req.Currency,
+			Amount:     req.Price,
+		})
+		if err != nil {
+			log.Print("ERROR: ", err)
+			if refused(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, transfer)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/gin-gonic/gin"
+)
+
+// maxVoucherBatches caps one page of the batch list.
+const maxVoucherBatches = 500
+
+// postVoucherBatch godoc
+// @Accept json
+// @Produce json
+// @Success 201
+// @Router /admin/vouchers [post]
+func postVoucherBatch(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var batch server.VoucherBatch
+		if err := c.ShouldBindJSON(&batch); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		log.Printf("CREATING VOUCHER BATCH %q OF %d CODES", batch.Name, batch.Count)
+		batch, err := db.CreateVoucherBatch(c.Request.Context(), batch)
+		if !checkLimitRequest(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, batch)
+	}
+}
+
+// getVoucherBatches godoc
+// @Produce json
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /admin/vouchers [get]
+func getVoucherBatches(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxVoucherBatches {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		batches, err := db.VoucherBatches(c.Request.Context(), limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"batches": batches,
+		})
+	}
+}
+
+// getVoucherBatch godoc
+// @Produce json
+// @Param id path int true "batch id"
+// @Success 200
+// @Router /admin/vouchers/{id} [get]
+func getVoucherBatch(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		batch, err := db.VoucherBatch(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, batch)
+	}
+}
+
+// getVoucherReport godoc
+// @Produce json,text/csv,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,application/vnd.apache.parquet
+// @Param format query string false "json (default), csv, xlsx or parquet"
+// @Success 200
+// @Router /reports/vouchers [get]
+func getVoucherReport(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Print("CHECKING VOUCHER REPORT")
+		vouchers, err := db.VoucherReport(c.Request.Context(), time.Now())
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		writeReport(c, vouchers.Table(), report.JSON{})
+	}
+}
+
+// checkRedemption answers for a voucher credit or reserve that failed and reports whether the handler may go on.
+// A code that can't be used comes back with the reason.
+func checkRedemption(c *gin.Context, err error) bool {
+	if err == nil {
+		return true
+	}
+	log.Print("ERROR: ", err)
+	if refused(c, err) {
+		return false
+	}
+	if errors.Is(err, server.ErrInvalidVoucher) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Bad request",
+			"error":  err.Error(),
+		})
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"status": "Bad request",
+	})
+	return false
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/Placebo900/billing_service_test/pkg/webhooks"
+	"github.com/gin-gonic/gin"
+)
+
+// maxDeliveries caps one page of the delivery log.
+const maxDeliveries = 500
+
+type subscriptionRequest struct {
+	ServiceID int      `json:"service_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    *bool    `json:"active"`
+}
+
+// postSubscription godoc
+// @Accept json
+// @Produce json
+// @Success 201
+// @Router /webhooks [post]
+func postSubscription(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req subscriptionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		sub := server.Subscription{ServiceID: req.ServiceID, URL: req.URL, Events: req.Events}
+		if err := webhooks.Validate(sub); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		log.Printf("CREATING WEBHOOK SUBSCRIPTION WITH VALUES %+v", req)
+		sub, err := db.CreateSubscription(c.Request.Context(), sub)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusCreated, sub)
+	}
+}
+
+// getSubscriptions godoc
+// @Produce json
+// @Param service_id query int false "only subscriptions of this service"
+// @Success 200
+// @Router /webhooks [get]
+func getSubscriptions(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serviceID := 0
+		if value := c.Query("service_id"); value != "" {
+			var err error
+			if serviceID, err = strconv.Atoi(value); err != nil {
+				log.Print("ERROR: ", err)
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "Bad request",
+				})
+				return
+			}
+		}
+		subs, err := db.Subscriptions(c.Request.Context(), serviceID)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"subscriptions": subs,
+		})
+	}
+}
+
+// getSubscription godoc
+// @Produce json
+// @Param id path int true "subscription id"
+// @Success 200
+// @Router /webhooks/{id} [get]
+func getSubscription(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		sub, err := db.Subscription(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// putSubscription godoc
+// @Accept json
+// @Produce json
+// @Param id path int true "subscription id"
+// @Success 200
+// @Router /webhooks/{id} [put]
+func putSubscription(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		var req subscriptionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		sub, err := db.Subscription(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		if req.URL != "" {
+			sub.URL = req.URL
+		}
+		if req.Events != nil {
+			sub.Events = req.Events
+		}
+		if req.Active != nil {
+			sub.Active = *req.Active
+		}
+		if err = webhooks.Validate(sub); err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+				"error":  err.Error(),
+			})
+			return
+		}
+		log.Printf("UPDATING WEBHOOK SUBSCRIPTION %d WITH VALUES %+v", id, req)
+		sub, err = db.UpdateSubscription(c.Request.Context(), sub)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// deleteSubscription godoc
+// @Param id path int true "subscription id"
+// @Success 204
+// @Router /webhooks/{id} [delete]
+func deleteSubscription(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("DELETING WEBHOOK SUBSCRIPTION %d", id)
+		if !checkFound(c, db.DeleteSubscription(c.Request.Context(), id)) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// getDeliveries godoc
+// @Produce json
+// @Param id path int true "subscription id"
+// @Param status query string false "pending, delivered or dead"
+// @Param limit query int false "page size, 50 by default"
+// @Param offset query int false "rows to skip"
+// @Success 200
+// @Router /webhooks/{id}/deliveries [get]
+func getDeliveries(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > maxDeliveries {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "Bad request",
+			})
+			return
+		}
+		deliveries, err := db.Deliveries(c.Request.Context(), id, c.Query("status"), limit, offset)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"deliveries": deliveries,
+		})
+	}
+}
+
+// getDelivery godoc
+// @Produce json
+// @Param id path int true "delivery id"
+// @Success 200
+// @Router /webhooks/deliveries/{id} [get]
+func getDelivery(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		delivery, err := db.Delivery(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		attempts, err := db.DeliveryAttempts(c.Request.Context(), id)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "Internal server error",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"delivery": delivery,
+			"attempts": attempts,
+		})
+	}
+}
+
+// postReplayDelivery godoc
+// @Produce json
+// @Param id path int true "delivery id"
+// @Success 202
+// @Router /webhooks/deliveries/{id}/replay [post]
+func postReplayDelivery(db *server.BillingDB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c)
+		if !ok {
+			return
+		}
+		log.Printf("REPLAYING WEBHOOK DELIVERY %d", id)
+		delivery, err := db.ReplayDelivery(c.Request.Context(), id)
+		if !checkFound(c, err) {
+			return
+		}
+		c.JSON(http.StatusAccepted, delivery)
+	}
+}
+
+// idParam parses the :id path parameter and answers 400 when it isn't a number.
+func idParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Bad request",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// checkFound answers 404 or 500 for a failed lookup and reports whether the handler may go on.
+func checkFound(c *gin.Context, err error) bool {
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "Not found",
+		})
+		return false
+	}
+	if err != nil {
+		log.Print("ERROR: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "Internal server error",
+		})
+		return false
+	}
+	return true
+}
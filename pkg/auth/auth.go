@@ -0,0 +1,167 @@
+// Package auth checks API keys and their scopes for the HTTP and gRPC APIs.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// Scopes a key can be granted, admin allows everything.
+const (
+	ScopeCredit      = "credit"
+	ScopeReserve     = "reserve"
+	ScopeCapture     = "capture"
+	ScopeTransfer    = "transfer"
+	ScopeReadBalance = "read-balance"
+	ScopeReports     = "reports"
+	ScopeAdmin       = "admin"
+)
+
+var Scopes = []string{ScopeCredit, ScopeReserve, ScopeCapture, ScopeTransfer, ScopeReadBalance, ScopeReports, ScopeAdmin}
+
+// keyPrefix starts every generated key, so leaked keys are easy to spot.
+const keyPrefix = "bk_"
+
+var (
+	ErrUnauthorized = errors.New("missing or invalid API key")
+	ErrForbidden    = errors.New("API key isn't allowed to do this")
+)
+
+// Keys is the part of BillingDB that stores keys.
+type Keys interface {
+	APIKeyByHash(ctx context.Context, hash string) (server.APIKey, error)
+}
+
+// Authenticator resolves API keys. The bootstrap key, if set, is an admin key that lives
+// only in the config and is used to create the first stored keys.
+// With Tokens set, end-user JWTs are accepted as well.
+type Authenticator struct {
+	Tokens *TokenVerifier
+
+	keys      Keys
+	bootstrap string
+}
+
+func NewAuthenticator(keys Keys, bootstrap string) *Authenticator {
+	return &Authenticator{keys: keys, bootstrap: bootstrap}
+}
+
+// Authenticate returns the key for secret, ErrUnauthorized if it is unknown or revoked.
+func (a *Authenticator) Authenticate(ctx context.Context, secret string) (server.APIKey, error) {
+	if secret == "" {
+		return server.APIKey{}, ErrUnauthorized
+	}
+	if a.Tokens != nil && isJWT(secret) {
+		return a.Tokens.Verify(ctx, secret)
+	}
+	if a.bootstrap != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(a.bootstrap)) == 1 {
+		return server.APIKey{Name: "bootstrap", Scopes: []string{ScopeAdmin}}, nil
+	}
+	key, err := a.keys.APIKeyByHash(ctx, Hash(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return server.APIKey{}, ErrUnauthorized
+	}
+	return key, err
+}
+
+// Allows reports whether the key has the scope.
+func Allows(key server.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeService returns ErrForbidden if the key is restricted to other services.
+func AuthorizeService(key server.APIKey, serviceID int) error {
+	if len(key.ServiceIDs) == 0 {
+		return nil
+	}
+	for _, id := range key.ServiceIDs {
+		if id == int64(serviceID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: service %d", ErrForbidden, serviceID)
+}
+
+// AuthorizeUser returns ErrForbidden if the key belongs to another end user.
+func AuthorizeUser(key server.APIKey, userID int) error {
+	if key.UserID != 0 && key.UserID != userID {
+		return fmt.Errorf("%w: user %d", ErrForbidden, userID)
+	}
+	return nil
+}
+
+// Caller names whoever uses the key in rate limits and the audit log,
+// every end-user token of a user is the same caller.
+func Caller(key server.APIKey) string {
+	switch {
+	case key.UserID != 0:
+		return "user-token:" + strconv.Itoa(key.UserID)
+	case key.ID == 0:
+		return "admin"
+	}
+	return "key:" + strconv.FormatInt(key.ID, 10)
+}
+
+// Generate returns a new random key and the prefix shown in key listings.
+func Generate() (secret, prefix string, err error) {
+	b := make([]byte, 24)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = keyPrefix + hex.EncodeToString(b)
+	return secret, secret[:len(keyPrefix)+6], nil
+}
+
+// Hash is how keys are stored, they are random enough that a plain SHA-256 can't be brute forced.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate checks a key before it is stored.
+func Validate(key server.APIKey) error {
+	if strings.TrimSpace(key.Name) == "" {
+		return fmt.Errorf("key needs a name")
+	}
+	if len(key.Scopes) == 0 {
+		return fmt.Errorf("key needs at least one scope of %s", strings.Join(Scopes, ", "))
+	}
+	for _, scope := range key.Scopes {
+		if !known(scope) {
+			return fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+func known(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// FromHeader takes the key from "Authorization: Bearer <key>" or, failing that, X-API-Key.
+func FromHeader(authorization, apiKey string) string {
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return strings.TrimSpace(apiKey)
+}
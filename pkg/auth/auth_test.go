@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+type fakeKeys map[string]server.APIKey
+
+func (f fakeKeys) APIKeyByHash(_ context.Context, hash string) (server.APIKey, error) {
+	key, ok := f[hash]
+	if !ok {
+		return server.APIKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret, prefix, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, prefix) || len(prefix) != len(keyPrefix)+6 {
+		t.Errorf("unexpected prefix %q of %q", prefix, secret)
+	}
+	keys := fakeKeys{Hash(secret): {ID: 1, Scopes: []string{ScopeReserve}}}
+	authn := NewAuthenticator(keys, "bootstrap")
+
+	key, err := authn.Authenticate(context.Background(), secret)
+	if err != nil || key.ID != 1 {
+		t.Errorf("expected key 1, got %+v, %v", key, err)
+	}
+	if key, err = authn.Authenticate(context.Background(), "bootstrap"); err != nil || !Allows(key, ScopeReports) {
+		t.Errorf("expected the bootstrap admin key, got %+v, %v", key, err)
+	}
+	for _, secret := range []string{"", "bk_unknown"} {
+		if _, err = authn.Authenticate(context.Background(), secret); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%q: expected ErrUnauthorized, got %v", secret, err)
+		}
+	}
+	if _, err = NewAuthenticator(keys, "").Authenticate(context.Background(), ""); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("empty bootstrap key must not match a missing key, got %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	video := server.APIKey{Scopes: []string{ScopeReserve, ScopeCapture}, ServiceIDs: []int64{1}}
+	if !Allows(video, ScopeCapture) || Allows(video, ScopeCredit) {
+		t.Error("scopes of the key aren't respected")
+	}
+	if err := AuthorizeService(video, 1); err != nil {
+		t.Errorf("service 1: %v", err)
+	}
+	if err := AuthorizeService(video, 2); !errors.Is(err, ErrForbidden) {
+		t.Errorf("service 2: expected ErrForbidden, got %v", err)
+	}
+	if err := AuthorizeService(server.APIKey{Scopes: []string{ScopeReserve}}, 2); err != nil {
+		t.Errorf("unrestricted key: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		key server.APIKey
+		ok  bool
+	}{
+		{server.APIKey{Name: "video", Scopes: []string{ScopeReserve, ScopeCapture}}, true},
+		{server.APIKey{Name: "video"}, false},
+		{server.APIKey{Name: "video", Scopes: []string{"write"}}, false},
+		{server.APIKey{Scopes: []string{ScopeAdmin}}, false},
+	}
+	for _, tc := range cases {
+		if err := Validate(tc.key); (err == nil) != tc.ok {
+			t.Errorf("%+v: unexpected result %v", tc.key, err)
+		}
+	}
+}
+
+func TestFromHeader(t *testing.T) {
+	cases := []struct {
+		authorization, apiKey, want string
+	}{
+		{"Bearer bk_1", "", "bk_1"},
+		{"Bearer bk_1", "bk_2", "bk_1"},
+		{"", "bk_2", "bk_2"},
+		{"Basic dXNlcg==", "", ""},
+	}
+	for _, tc := range cases {
+		if got := FromHeader(tc.authorization, tc.apiKey); got != tc.want {
+			t.Errorf("%q, %q: expected %q, got %q", tc.authorization, tc.apiKey, tc.want, got)
+		}
+	}
+}
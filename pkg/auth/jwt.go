@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// minRefresh keeps tokens with unknown key ids from making us fetch the JWKS on every request.
+const minRefresh = 30 * time.Second
+
+// JWKS is a key set loaded from a file or an http(s) URL. It is reloaded every refresh interval
+// and when a token names a key it doesn't know yet, so the issuer can rotate keys.
+type JWKS struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{source: source, refresh: refresh, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the public key with the key id.
+func (s *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	age := time.Since(s.loadedAt)
+	key, ok := s.keys[kid]
+	if s.keys == nil || age > s.refresh || (!ok && age > minRefresh) {
+		keys, err := s.load(ctx)
+		if err != nil {
+			if s.keys == nil {
+				return nil, err
+			}
+			// keep serving the cached keys while the issuer is unreachable
+			log.Print("ERROR: reloading JWKS: ", err)
+		} else {
+			s.keys = keys
+		}
+		s.loadedAt = time.Now()
+		key, ok = s.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (s *JWKS) load(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		data, err := os.ReadFile(s.source)
+		if err != nil {
+			return nil, err
+		}
+		return ParseJWKS(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS %s answered %s", s.source, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS reads the RSA and P-256 signing keys of a JSON Web Key Set, other keys are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var (
+			key crypto.PublicKey
+			err error
+		)
+		switch {
+		case k.Kty == "RSA":
+			key, err = rsaKey(k)
+		case k.Kty == "EC" && k.Crv == "P-256":
+			key, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func rsaKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("bad RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func ecKey(k jwk) (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point isn't on P-256")
+	}
+	return key, nil
+}
+
+// TokenVerifier accepts end-user JWTs signed with RS256 or ES256 by a key of the JWKS.
+// Issuer and Audience are checked when set.
+type TokenVerifier struct {
+	JWKS     *JWKS
+	Issuer   string
+	Audience string
+}
+
+// Verify checks the token and returns a key that can only read the balance and history of the user in `sub`.
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (server.APIKey, error) {
+	var claims jwt.RegisteredClaims
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "ES256"}))
+	_, err := parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.JWKS.Key(ctx, kid)
+	})
+	if err != nil {
+		return server.APIKey{}, fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	if claims.ExpiresAt == nil {
+		return server.APIKey{}, fmt.Errorf("%w: token without exp", ErrUnauthorized)
+	}
+	if v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true) {
+		return server.APIKey{}, fmt.Errorf("%w: issuer %q", ErrUnauthorized, claims.Issuer)
+	}
+	if v.Audience != "" && !claims.VerifyAudience(v.Audience, true) {
+		return server.APIKey{}, fmt.Errorf("%w: audience %q", ErrUnauthorized, claims.Audience)
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return server.APIKey{}, fmt.Errorf("%w: subject %q isn't a user id", ErrUnauthorized, claims.Subject)
+	}
+	return server.APIKey{Name: "user " + claims.Subject, Scopes: []string{ScopeReadBalance}, UserID: userID}, nil
+}
+
+// isJWT tells tokens from API keys, which never contain dots.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "RSA", "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": b64(key.X.Bytes()), "y": b64(key.Y.Bytes())}
+}
+
+func jwks(t *testing.T, keys ...map[string]string) []byte {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.RegisteredClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, jwks(t, rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verifier := &TokenVerifier{JWKS: NewJWKS(path, time.Hour), Issuer: "https://id.example.com", Audience: "billing"}
+
+	valid := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Subject:   "42",
+			Issuer:    "https://id.example.com",
+			Audience:  jwt.ClaimStrings{"billing"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}
+	}
+	with := func(change func(*jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		claims := valid()
+		change(&claims)
+		return claims
+	}
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, valid()), true},
+		{"ES256", sign(t, jwt.SigningMethodES256, "ec", ecKey, valid()), true},
+		{"HS256", sign(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), valid()), false},
+		{"wrong key", sign(t, jwt.SigningMethodES256, "rsa", ecKey, valid()), false},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, "old", rsaKey, valid()), false},
+		{"expired", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, with(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		})), false},
+		{"no exp", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil })), false},
+		{"issuer", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, with(func(c *jwt.RegisteredClaims) { c.Issuer = "evil" })), false},
+		{"audience", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, with(func(c *jwt.RegisteredClaims) {
+			c.Audience = jwt.ClaimStrings{"shop"}
+		})), false},
+		{"subject", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, with(func(c *jwt.RegisteredClaims) { c.Subject = "admin" })), false},
+	}
+	for _, tc := range cases {
+		key, err := verifier.Verify(context.Background(), tc.token)
+		if !tc.ok {
+			if !errors.Is(err, ErrUnauthorized) {
+				t.Errorf("%s: expected ErrUnauthorized, got %+v, %v", tc.name, key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if key.UserID != 42 || !Allows(key, ScopeReadBalance) || Allows(key, ScopeCredit) || Allows(key, ScopeReports) {
+			t.Errorf("%s: expected a read-only key of user 42, got %+v", tc.name, key)
+		}
+		if AuthorizeUser(key, 42) != nil || !errors.Is(AuthorizeUser(key, 43), ErrForbidden) {
+			t.Errorf("%s: token isn't limited to its user", tc.name)
+		}
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var (
+		mu    sync.Mutex
+		set   = jwks(t, ecJWK("old", &oldKey.PublicKey))
+		loads int
+	)
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads++
+		w.Write(set)
+	}))
+	defer issuer.Close()
+	keys := NewJWKS(issuer.URL, time.Hour)
+	authn := NewAuthenticator(fakeKeys{}, "")
+	authn.Tokens = &TokenVerifier{JWKS: keys}
+	claims := jwt.RegisteredClaims{Subject: "7", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	for i := 0; i < 2; i++ {
+		if _, err := authn.Authenticate(context.Background(), sign(t, jwt.SigningMethodES256, "old", oldKey, claims)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	set = jwks(t, ecJWK("new", &newKey.PublicKey))
+	mu.Unlock()
+	// pretend the set is older than minRefresh, a new kid then triggers a reload
+	keys.loadedAt = time.Now().Add(-time.Minute)
+	key, err := authn.Authenticate(context.Background(), sign(t, jwt.SigningMethodES256, "new", newKey, claims))
+	if err != nil || key.UserID != 7 {
+		t.Fatalf("expected the rotated key to be picked up, got %+v, %v", key, err)
+	}
+	// another unknown kid right after a reload is rejected without fetching the set again
+	if _, err = authn.Authenticate(context.Background(), sign(t, jwt.SigningMethodES256, "other", newKey, claims)); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if loads != 2 {
+		t.Errorf("expected the set to be loaded twice, got %d", loads)
+	}
+}
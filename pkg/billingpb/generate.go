@@ -0,0 +1,4 @@
+// Package billingpb holds the protobuf definition of the gRPC API and the code generated from it.
+package billingpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative billing.proto
@@ -0,0 +1,13 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Store keeps generated files and hands out expiring download links for them.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	URL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
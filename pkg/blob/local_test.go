@@ -0,0 +1,63 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	store, err := NewLocal(t.TempDir(), "http://billing:8080/", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 11, 3, 14, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if err = store.Put(ctx, "report.csv", strings.NewReader("service_id,price\n"), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	link, err := store.URL(ctx, "report.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "billing:8080" || u.Path != "/files/report.csv" {
+		t.Fatalf("unexpected link %s", link)
+	}
+	key, expires, signature := path.Base(u.Path), u.Query().Get("expires"), u.Query().Get("signature")
+
+	f, err := store.Open(key, expires, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "service_id,price\n" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	if _, err = store.Open(key, expires, strings.Repeat("0", len(signature))); err == nil {
+		t.Error("expected error for a forged signature")
+	}
+	if _, err = store.Open(key, "9999999999", signature); err == nil {
+		t.Error("expected error for a changed expiry")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err = store.Open(key, expires, signature); err == nil {
+		t.Error("expected error for an expired link")
+	}
+	for _, key := range []string{"../etc/passwd", ".upload-1", ""} {
+		if err = store.Put(ctx, key, strings.NewReader(""), "text/plain"); err == nil {
+			t.Errorf("%q: expected error for a wrong key", key)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestS3 runs against a local MinIO, e.g.
+// docker run -p 9000:9000 minio/minio server /data
+// MINIO_ENDPOINT=localhost:9000 go test ./pkg/blob
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT is not set")
+	}
+	accessKey, secretKey := os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = "minioadmin", "minioadmin"
+	}
+	ctx := context.Background()
+	store, err := NewS3(ctx, endpoint, "billing-test", accessKey, secretKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Put(ctx, "report.csv", strings.NewReader("service_id,price\n"), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	link, err := store.URL(ctx, "report.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK || string(content) != "service_id,price\n" {
+		t.Fatalf("unexpected response %d %q: %v", resp.StatusCode, content, err)
+	}
+}
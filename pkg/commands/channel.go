@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"context"
+)
+
+// Reply is an answer sent through a Channel broker.
+type Reply struct {
+	To        string
+	MessageID string
+	Body      []byte
+}
+
+// Channel is an in-process broker for tests and embedding.
+type Channel struct {
+	messages chan Message
+	replies  chan Reply
+}
+
+func NewChannel(size int) *Channel {
+	return &Channel{
+		messages: make(chan Message, size),
+		replies:  make(chan Reply, size),
+	}
+}
+
+// Send queues a command as a producer would.
+func (b *Channel) Send(msg Message) {
+	b.messages <- msg
+}
+
+// Replies returns the answers of the consumer in the order they were sent.
+func (b *Channel) Replies() <-chan Reply {
+	return b.replies
+}
+
+func (b *Channel) Consume(ctx context.Context, handle func(context.Context, Message) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-b.messages:
+			if err := retry(ctx, handle, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *Channel) Reply(ctx context.Context, msg Message, body []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case b.replies <- Reply{To: msg.ReplyTo, MessageID: msg.ID, Body: body}:
+		return nil
+	}
+}
+
+func (b *Channel) Close() error {
+	return nil
+}
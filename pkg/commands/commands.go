@@ -0,0 +1,87 @@
+// Package commands takes billing commands from a message broker and answers on a reply topic.
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// retryDelay is the pause before a message whose handling failed is handled again.
+var retryDelay = time.Second
+
+// Message is a command read from the broker. ID is the idempotency key,
+// ReplyTo overrides the broker's reply topic when the sender asked for one.
+type Message struct {
+	ID      string
+	Body    []byte
+	ReplyTo string
+}
+
+// Broker delivers messages at least once: a message is acknowledged only after handle returned nil.
+type Broker interface {
+	Consume(ctx context.Context, handle func(context.Context, Message) error) error
+	Reply(ctx context.Context, msg Message, body []byte) error
+	Close() error
+}
+
+// Consumer applies the commands with BillingDB and sends a reply for each of them.
+type Consumer struct {
+	broker Broker
+	apply  func(ctx context.Context, messageID string, cmd server.Command) (server.CommandReply, error)
+}
+
+func NewConsumer(db *server.BillingDB, broker Broker) *Consumer {
+	return &Consumer{
+		broker: broker,
+		apply:  db.ApplyCommand,
+	}
+}
+
+// Run consumes commands until ctx is cancelled or the broker fails.
+func (c *Consumer) Run(ctx context.Context) error {
+	return c.broker.Consume(ctx, c.handle)
+}
+
+// handle returns an error only when the message has to be delivered again.
+func (c *Consumer) handle(ctx context.Context, msg Message) error {
+	log.Printf("COMMAND %s: %s", msg.ID, msg.Body)
+	var reply server.CommandReply
+	var cmd server.Command
+	switch err := json.Unmarshal(msg.Body, &cmd); {
+	case msg.ID == "":
+		reply = server.CommandReply{Status: server.CommandError, Error: "message has no id"}
+	case err != nil:
+		reply = server.CommandReply{MessageID: msg.ID, Status: server.CommandError, Error: fmt.Sprintf("wrong command: %s", err)}
+	default:
+		audit := server.AuditInfo{Actor: server.ActorCommand, RequestID: msg.ID, Request: string(msg.Body)}
+		if reply, err = c.apply(server.WithAudit(ctx, audit), msg.ID, cmd); err != nil {
+			return err
+		}
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return c.broker.Reply(ctx, msg, body)
+}
+
+// retry calls handle until it succeeds or ctx is cancelled, keeping later messages behind the failed one.
+func retry(ctx context.Context, handle func(context.Context, Message) error, msg Message) error {
+	for {
+		err := handle(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		log.Printf("ERROR: command %s: %s", msg.ID, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// fakeBilling stores replies per message id like ApplyCommand does and fails the first failures calls.
+type fakeBilling struct {
+	replies  map[string]server.CommandReply
+	applied  []server.Command
+	failures int
+}
+
+func (f *fakeBilling) apply(ctx context.Context, messageID string, cmd server.Command) (server.CommandReply, error) {
+	if f.failures > 0 {
+		f.failures--
+		return server.CommandReply{}, errors.New("connection refused")
+	}
+	if reply, ok := f.replies[messageID]; ok {
+		return reply, nil
+	}
+	f.applied = append(f.applied, cmd)
+	reply := server.CommandReply{MessageID: messageID, Type: cmd.Type, Status: server.CommandOK}
+	if err := cmd.Validate(); err != nil {
+		reply.Status, reply.Error = server.CommandError, err.Error()
+	}
+	f.replies[messageID] = reply
+	return reply, nil
+}
+
+func TestConsumer(t *testing.T) {
+	retryDelay = time.Millisecond
+	billing := &fakeBilling{replies: map[string]server.CommandReply{}, failures: 2}
+	broker := NewChannel(10)
+	consumer := &Consumer{broker: broker, apply: billing.apply}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx) }()
+
+	reserve := []byte(`{"type":"reserve","user_id":1,"service_id":2,"order_id":3,"price":100}`)
+	broker.Send(Message{ID: "m1", Body: reserve, ReplyTo: "orders.replies"})
+	broker.Send(Message{ID: "m1", Body: reserve})
+	broker.Send(Message{ID: "m2", Body: []byte(`{"type":"withdraw","user_id":1}`)})
+	broker.Send(Message{ID: "m3", Body: []byte(`not json`)})
+	broker.Send(Message{Body: reserve})
+
+	want := []struct {
+		to, messageID, status string
+	}{
+		{"orders.replies", "m1", server.CommandOK},
+		{"", "m1", server.CommandOK},
+		{"", "m2", server.CommandError},
+		{"", "m3", server.CommandError},
+		{"", "", server.CommandError},
+	}
+	for i, w := range want {
+		var reply Reply
+		select {
+		case reply = <-broker.Replies():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: no reply", i)
+		}
+		var body server.CommandReply
+		if err := json.Unmarshal(reply.Body, &body); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if reply.To != w.to || reply.MessageID != w.messageID || body.MessageID != w.messageID || body.Status != w.status {
+			t.Errorf("#%d: unexpected reply to %q for %q: %s", i, reply.To, reply.MessageID, reply.Body)
+		}
+	}
+	// the duplicate of m1 got the stored reply, the invalid type was still recorded
+	if len(billing.applied) != 2 {
+		t.Errorf("expected 2 applied commands, got %+v", billing.applied)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka message headers, message_id is the idempotency key and reply_to overrides the reply topic.
+const (
+	headerMessageID = "message_id"
+	headerReplyTo   = "reply_to"
+)
+
+// Kafka reads commands with a consumer group and commits an offset only after its command was handled.
+// Messages without a message_id header are identified by topic, partition and offset.
+type Kafka struct {
+	reader     *kafka.Reader
+	writer     *kafka.Writer
+	replyTopic string
+}
+
+func NewKafka(brokers []string, topic, group, replyTopic string) *Kafka {
+	return &Kafka{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: brokers,
+			Topic:   topic,
+			GroupID: group,
+		}),
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+		replyTopic: replyTopic,
+	}
+}
+
+func (b *Kafka) Consume(ctx context.Context, handle func(context.Context, Message) error) error {
+	for {
+		m, err := b.reader.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+		msg := Message{
+			ID:   fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset),
+			Body: m.Value,
+		}
+		for _, header := range m.Headers {
+			switch header.Key {
+			case headerMessageID:
+				msg.ID = string(header.Value)
+			case headerReplyTo:
+				msg.ReplyTo = string(header.Value)
+			}
+		}
+		if err = retry(ctx, handle, msg); err != nil {
+			return err
+		}
+		if err = b.reader.CommitMessages(ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Kafka) Reply(ctx context.Context, msg Message, body []byte) error {
+	topic := msg.ReplyTo
+	if topic == "" {
+		topic = b.replyTopic
+	}
+	return b.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   topic,
+		Key:     []byte(msg.ID),
+		Value:   body,
+		Headers: []kafka.Header{{Key: headerMessageID, Value: []byte(msg.ID)}},
+	})
+}
+
+func (b *Kafka) Close() error {
+	err := b.reader.Close()
+	if werr := b.writer.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS pulls commands from a durable JetStream consumer and acknowledges each after it was handled.
+// The Nats-Msg-Id header is the idempotency key, messages without it are identified by stream sequence.
+// A Reply-To header overrides the reply subject.
+type NATS struct {
+	conn         *nats.Conn
+	sub          *nats.Subscription
+	replySubject string
+}
+
+func NewNATS(url, subject, durable, replySubject string) (*NATS, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(subject, durable, nats.ManualAck())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATS{conn: conn, sub: sub, replySubject: replySubject}, nil
+}
+
+func (b *NATS) Consume(ctx context.Context, handle func(context.Context, Message) error) error {
+	for {
+		batch, err := b.sub.Fetch(10, nats.Context(ctx))
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			// nothing arrived before the fetch timed out
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, m := range batch {
+			msg := Message{
+				ID:      m.Header.Get(nats.MsgIdHdr),
+				Body:    m.Data,
+				ReplyTo: m.Header.Get("Reply-To"),
+			}
+			if msg.ID == "" {
+				meta, err := m.Metadata()
+				if err != nil {
+					return err
+				}
+				msg.ID = fmt.Sprintf("%s/%d", meta.Stream, meta.Sequence.Stream)
+			}
+			if err = retry(ctx, handle, msg); err != nil {
+				return err
+			}
+			if err = m.Ack(nats.Context(ctx)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *NATS) Reply(ctx context.Context, msg Message, body []byte) error {
+	subject := msg.ReplyTo
+	if subject == "" {
+		subject = b.replySubject
+	}
+	reply := nats.NewMsg(subject)
+	reply.Header.Set(nats.MsgIdHdr, msg.ID)
+	reply.Data = body
+	if err := b.conn.PublishMsg(reply); err != nil {
+		return err
+	}
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *NATS) Close() error {
+	return b.conn.Drain()
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the service settings, every field can be overridden with an environment variable.
+type Config struct {
+	// BaseURL is the externally visible address used in generated links.
+	BaseURL string
+	// AdminAPIKey is an admin key kept only in the config, used to create the first stored keys.
+	AdminAPIKey string
+	// JWKSSource is a file or URL with the keys of end-user JWTs, empty disables them.
+	// The set is reloaded every JWKSRefresh and on unknown key ids.
+	JWKSSource  string
+	JWKSRefresh time.Duration
+	JWTIssuer   string
+	JWTAudience string
+	// GRPCAddr is where the gRPC API listens, next to the HTTP API on :8080.
+	GRPCAddr string
+
+	// Currencies users can hold wallets in, the first one is used when a request names none.
+	Currencies []string
+	// RatesFile enables /convert with exchange rates from a static file.
+	RatesFile string
+
+	// ReserveTTL is how long reserves are held, 0 keeps them until captured or cancelled.
+	ReserveTTL time.Duration
+	// ReserveSweepInterval is how often expired reserves are released.
+	ReserveSweepInterval time.Duration
+
+	// RateLimitKey, RateLimitUser and RateLimitRoutes ("/reserve=10/s") are token buckets per API key,
+	// per user and per key and route, an empty value disables the bucket. RateLimitBackend is "memory" or "redis".
+	RateLimitBackend string
+	RateLimitKey     string
+	RateLimitUser    string
+	RateLimitRoutes  []string
+	RedisAddr        string
+
+	// AdjustmentThreshold is the largest manual adjustment posted without approval by a second admin.
+	AdjustmentThreshold float64
+	// DebtTerm is how long an overdrawn wallet may stay in debt before it is past due.
+	DebtTerm time.Duration
+	// RiskRules is the JSON file with the risk rules, empty runs no rules.
+	RiskRules string
+	// BonusPriority orders the bonus grants a reserve spends first (restricted, expiring, oldest, smallest),
+	// BonusMaxShare is the largest part of a price bonus may pay.
+	BonusPriority []string
+	BonusMaxShare float64
+
+	// DBTimeout bounds every database operation, DBTimeouts overrides it per operation
+	// (credit, reserve, capture, cancel, refund, expire, convert, command, read, report, write).
+	DBTimeout  time.Duration
+	DBTimeouts map[string]time.Duration
+
+	ReportWorkers int
+	ReportURLTTL  time.Duration
+	// ReportJobLease is how long a report job may go without a heartbeat before another worker takes it over.
+	ReportJobLease time.Duration
+
+	// BlobStore is "local" or "s3".
+	BlobStore  string
+	BlobDir    string
+	BlobSecret string
+
+	S3Endpoint  string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+
+	// EventSink is where outbox events are relayed besides webhook subscriptions:
+	// "stdout", "file", "webhook", "kafka", "nats" or empty for none.
+	EventSink         string
+	EventFile         string
+	EventWebhookURL   string
+	EventPollInterval time.Duration
+
+	KafkaBrokers []string
+	KafkaTopic   string
+
+	NATSURL     string
+	NATSSubject string
+
+	// CommandBroker enables reading commands from "kafka" or "nats", replies go to CommandReplyTopic.
+	// CommandGroup is the Kafka consumer group or the durable JetStream consumer.
+	CommandBroker     string
+	CommandTopic      string
+	CommandReplyTopic string
+	CommandGroup      string
+
+	// Failed webhook deliveries are retried after WebhookBackoff, doubling up to WebhookMaxBackoff,
+	// and become dead after WebhookMaxAttempts.
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookMaxBackoff  time.Duration
+}
+
+func Load() Config {
+	return Config{
+		BaseURL:     env("BASE_URL", "http://localhost:8080"),
+		GRPCAddr:    env("GRPC_ADDR", ":9090"),
+		AdminAPIKey: env("ADMIN_API_KEY", ""),
+		JWKSSource:  env("JWKS_SOURCE", ""),
+		JWKSRefresh: envDuration("JWKS_REFRESH", time.Hour),
+		JWTIssuer:   env("JWT_ISSUER", ""),
+		JWTAudience: env("JWT_AUDIENCE", ""),
+		Currencies:  envList("CURRENCIES", []string{"RUB", "KZT", "BYN"}),
+		RatesFile:   env("RATES_FILE", ""),
+		ReserveTTL:  envDuration("RESERVE_TTL", 0),
+
+		ReserveSweepInterval: envDuration("RESERVE_SWEEP_INTERVAL", time.Minute),
+
+		RateLimitBackend: env("RATE_LIMIT_BACKEND", "memory"),
+		RateLimitKey:     env("RATE_LIMIT_KEY", "100/s"),
+		RateLimitUser:    env("RATE_LIMIT_USER", "20/s"),
+		RateLimitRoutes:  envList("RATE_LIMIT_ROUTES", nil),
+		RedisAddr:        env("REDIS_ADDR", "localhost:6379"),
+
+		AdjustmentThreshold: envFloat("ADJUSTMENT_APPROVAL_THRESHOLD", 10000),
+		DebtTerm:            envDuration("DEBT_PAYMENT_TERM", 30*24*time.Hour),
+		RiskRules:           env("RISK_RULES", ""),
+		BonusPriority:       envList("BONUS_PRIORITY", []string{"restricted", "expiring"}),
+		BonusMaxShare:       envFloat("BONUS_MAX_SHARE", 1),
+
+		DBTimeout:  envDuration("DB_TIMEOUT", 5*time.Second),
+		DBTimeouts: envDurations("DB_TIMEOUTS", map[string]time.Duration{"report": time.Minute}),
+
+		ReportWorkers:  envInt("REPORT_WORKERS", 2),
+		ReportURLTTL:   envDuration("REPORT_URL_TTL", time.Hour),
+		ReportJobLease: envDuration("REPORT_JOB_LEASE", 5*time.Minute),
+		BlobStore:      env("BLOB_STORE", "local"),
+		BlobDir:        env("BLOB_DIR", "/var/lib/billing/reports"),
+		BlobSecret:     env("BLOB_SECRET", ""),
+		S3Endpoint:     env("S3_ENDPOINT", "localhost:9000"),
+		S3Bucket:       env("S3_BUCKET", "reports"),
+		S3AccessKey:    env("S3_ACCESS_KEY", ""),
+		S3SecretKey:    env("S3_SECRET_KEY", ""),
+		S3UseSSL:       envBool("S3_USE_SSL", false),
+
+		EventSink:         env("EVENT_SINK", ""),
+		EventFile:         env("EVENT_FILE", "events.jsonl"),
+		EventWebhookURL:   env("EVENT_WEBHOOK_URL", ""),
+		EventPollInterval: envDuration("EVENT_POLL_INTERVAL", time.Second),
+		KafkaBrokers:      envList("KAFKA_BROKERS", []string{"localhost:9092"}),
+		KafkaTopic:        env("KAFKA_TOPIC", "billing-events"),
+		NATSURL:           env("NATS_URL", "nats://localhost:4222"),
+		NATSSubject:       env("NATS_SUBJECT", "billing"),
+
+		CommandBroker:     env("COMMAND_BROKER", ""),
+		CommandTopic:      env("COMMAND_TOPIC", "billing.commands"),
+		CommandReplyTopic: env("COMMAND_REPLY_TOPIC", "billing.replies"),
+		CommandGroup:      env("COMMAND_GROUP", "billing"),
+
+		WebhookTimeout:     envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookBackoff:     envDuration("WEBHOOK_BACKOFF", 30*time.Second),
+		WebhookMaxBackoff:  envDuration("WEBHOOK_MAX_BACKOFF", 6*time.Hour),
+	}
+}
+
+func env(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envDurations parses a list like "report=1m,reserve=2s", entries that don't parse are skipped.
+func envDurations(key string, fallback map[string]time.Duration) map[string]time.Duration {
+	list := envList(key, nil)
+	if list == nil {
+		return fallback
+	}
+	durations := map[string]time.Duration{}
+	for _, item := range list {
+		name, value, _ := strings.Cut(item, "=")
+		duration, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		durations[strings.TrimSpace(name)] = duration
+	}
+	return durations
+}
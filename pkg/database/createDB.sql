@@ -1,14 +1,528 @@
+-- Applied by the postgres container to a new database and by cmd/migrate to an existing one, so every
+-- statement is safe to run again: columns added to a table later are added by ALTER TABLE right after it.
+
 CREATE TABLE IF NOT EXISTS Users (
-    id       INT NOT NULL PRIMARY KEY,
+    id       INT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'RUB',
     balance  NUMERIC NOT NULL,
-    reserved NUMERIC NOT NULL
+    reserved NUMERIC NOT NULL,
+    segment  TEXT NOT NULL DEFAULT '',
+    -- how far below zero the available balance may go
+    credit_limit NUMERIC NOT NULL DEFAULT 0,
+    -- debt and debt_since are kept by the users_debt trigger
+    debt       NUMERIC NOT NULL DEFAULT 0,
+    debt_since TIMESTAMP,
+    PRIMARY KEY (id, currency)
 );
 
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS segment TEXT NOT NULL DEFAULT '';
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS credit_limit NUMERIC NOT NULL DEFAULT 0;
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS debt NUMERIC NOT NULL DEFAULT 0;
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS debt_since TIMESTAMP;
+
+-- wallets used to be keyed by the user alone, the existing ones become the user's wallets in RUB
+DO $$
+DECLARE
+    pk TEXT;
+BEGIN
+    SELECT conname INTO pk FROM pg_constraint WHERE conrelid = 'users'::regclass AND contype = 'p';
+    IF pk IS NULL OR NOT EXISTS (
+        SELECT 1 FROM pg_constraint c JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+        WHERE c.conrelid = 'users'::regclass AND c.conname = pk AND a.attname = 'currency'
+    ) THEN
+        IF pk IS NOT NULL THEN
+            EXECUTE format('ALTER TABLE Users DROP CONSTRAINT %I', pk);
+        END IF;
+        ALTER TABLE Users ADD PRIMARY KEY (id, currency);
+    END IF;
+END;
+$$;
+
+-- a negative balance is debt: it is repaid first by the next credit, debt_since is when it started
+CREATE OR REPLACE FUNCTION users_debt() RETURNS trigger AS $$
+BEGIN
+    NEW.debt = greatest(-NEW.balance, 0);
+    IF NEW.debt = 0 THEN
+        NEW.debt_since = NULL;
+    ELSIF NEW.debt_since IS NULL THEN
+        NEW.debt_since = now() at time zone 'UTC';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_debt ON Users;
+CREATE TRIGGER users_debt BEFORE INSERT OR UPDATE OF balance ON Users
+    FOR EACH ROW EXECUTE PROCEDURE users_debt();
+
+CREATE INDEX IF NOT EXISTS users_debtors ON Users (debt_since) WHERE debt > 0;
+
 CREATE TABLE IF NOT EXISTS Transactions (
     order_id INT NOT NULL,
     service_id INT NOT NULL,
     user_id INT NOT NULL,
     cost NUMERIC NOT NULL,
+    -- the part of cost paid by bonus grants
+    bonus NUMERIC NOT NULL DEFAULT 0,
+    -- the voucher discount taken off the price before cost
+    discount NUMERIC NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT 'RUB',
     order_status TEXT,
-    date TIMESTAMP NOT NULL
-);
\ No newline at end of file
+    date TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
+
+ALTER TABLE Transactions ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE Transactions ADD COLUMN IF NOT EXISTS bonus NUMERIC NOT NULL DEFAULT 0;
+ALTER TABLE Transactions ADD COLUMN IF NOT EXISTS discount NUMERIC NOT NULL DEFAULT 0;
+-- reserves made before expiry are held until they are captured or cancelled
+ALTER TABLE Transactions ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS ReportJobs (
+    id          TEXT NOT NULL PRIMARY KEY,
+    params      JSONB NOT NULL,
+    status      TEXT NOT NULL,
+    error       TEXT NOT NULL DEFAULT '',
+    blob_key    TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP,
+    -- a running job whose claimed_at is older than the lease is claimed again
+    claimed_at  TIMESTAMP,
+    attempts    INT NOT NULL DEFAULT 0
+);
+
+ALTER TABLE ReportJobs ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMP;
+ALTER TABLE ReportJobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS report_jobs_queue ON ReportJobs (created_at) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS report_jobs_running ON ReportJobs (claimed_at) WHERE status = 'running';
+
+CREATE TABLE IF NOT EXISTS Ledger (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INT NOT NULL,
+    currency   TEXT NOT NULL DEFAULT 'RUB',
+    operation  TEXT NOT NULL,
+    order_id   INT,
+    service_id INT,
+    amount     NUMERIC NOT NULL,
+    balance    NUMERIC NOT NULL,
+    reserved   NUMERIC NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+ALTER TABLE Ledger ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+
+-- the index used to leave currency out
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'ledger_user'
+        AND indexdef NOT LIKE '%currency%') THEN
+        DROP INDEX ledger_user;
+    END IF;
+END;
+$$;
+
+CREATE INDEX IF NOT EXISTS ledger_user ON Ledger (user_id, currency, created_at, id);
+
+CREATE TABLE IF NOT EXISTS Credits (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INT NOT NULL,
+    currency   TEXT NOT NULL DEFAULT 'RUB',
+    amount     NUMERIC NOT NULL,
+    status     TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    settled_at TIMESTAMP,
+    rejected_at TIMESTAMP
+);
+
+ALTER TABLE Credits ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+ALTER TABLE Credits ADD COLUMN IF NOT EXISTS rejected_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS credits_pending ON Credits (user_id) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS Conversions (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       INT NOT NULL,
+    from_currency TEXT NOT NULL,
+    to_currency   TEXT NOT NULL,
+    amount        NUMERIC NOT NULL,
+    rate          NUMERIC NOT NULL,
+    converted     NUMERIC NOT NULL,
+    rate_source   TEXT NOT NULL,
+    rate_date     TIMESTAMP NOT NULL,
+    created_at    TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS Transfers (
+    id           BIGSERIAL PRIMARY KEY,
+    from_user_id INT NOT NULL,
+    to_user_id   INT NOT NULL,
+    currency     TEXT NOT NULL,
+    amount       NUMERIC NOT NULL,
+    created_at   TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS Outbox (
+    id           BIGSERIAL PRIMARY KEY,
+    event_type   TEXT NOT NULL,
+    user_id      INT NOT NULL,
+    payload      JSONB NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished ON Outbox (id) WHERE published_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS WebhookSubscriptions (
+    id         BIGSERIAL PRIMARY KEY,
+    service_id INT NOT NULL,
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL,
+    events     TEXT[] NOT NULL DEFAULT '{}',
+    active     BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_service ON WebhookSubscriptions (service_id);
+
+CREATE TABLE IF NOT EXISTS WebhookDeliveries (
+    id              BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES WebhookSubscriptions (id) ON DELETE CASCADE,
+    event_id        BIGINT NOT NULL,
+    event_type      TEXT NOT NULL,
+    payload         JSONB NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMP NOT NULL,
+    delivered_at    TIMESTAMP,
+    UNIQUE (subscription_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON WebhookDeliveries (next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS WebhookAttempts (
+    id           BIGSERIAL PRIMARY KEY,
+    delivery_id  BIGINT NOT NULL REFERENCES WebhookDeliveries (id) ON DELETE CASCADE,
+    status_code  INT NOT NULL DEFAULT 0,
+    error        TEXT NOT NULL DEFAULT '',
+    duration_ms  BIGINT NOT NULL,
+    attempted_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_attempts_delivery ON WebhookAttempts (delivery_id, id);
+
+CREATE TABLE IF NOT EXISTS ProcessedCommands (
+    message_id   TEXT PRIMARY KEY,
+    command      JSONB NOT NULL,
+    reply        JSONB NOT NULL,
+    processed_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ApiKeys (
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL,
+    key_hash     TEXT NOT NULL UNIQUE,
+    scopes       TEXT[] NOT NULL DEFAULT '{}',
+    service_ids  BIGINT[] NOT NULL DEFAULT '{}',
+    created_at   TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at   TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ApiKeyUsage (
+    id         BIGSERIAL PRIMARY KEY,
+    key_id     BIGINT REFERENCES ApiKeys (id),
+    method     TEXT NOT NULL,
+    route      TEXT NOT NULL,
+    status     INT NOT NULL,
+    ip         TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS api_key_usage_key ON ApiKeyUsage ((coalesce(key_id, 0)), id);
+
+CREATE TABLE IF NOT EXISTS Audit (
+    id              BIGSERIAL PRIMARY KEY,
+    actor           TEXT NOT NULL,
+    request_id      TEXT NOT NULL,
+    ip              TEXT NOT NULL,
+    operation       TEXT NOT NULL,
+    user_id         INT NOT NULL,
+    currency        TEXT NOT NULL,
+    order_id        INT NOT NULL,
+    service_id      INT NOT NULL,
+    amount          NUMERIC NOT NULL,
+    balance_before  NUMERIC NOT NULL,
+    reserved_before NUMERIC NOT NULL,
+    balance_after   NUMERIC NOT NULL,
+    reserved_after  NUMERIC NOT NULL,
+    request         TEXT NOT NULL,
+    created_at      TIMESTAMP NOT NULL,
+    prev_hash       TEXT NOT NULL,
+    hash            TEXT NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS audit_user ON Audit (user_id, id);
+
+-- entries before first_id were chained through the whole log, later ones per user
+CREATE TABLE IF NOT EXISTS AuditPerUser (
+    first_id BIGINT NOT NULL
+);
+
+INSERT INTO AuditPerUser (first_id)
+SELECT coalesce(max(id), 0) + 1 FROM Audit
+WHERE NOT EXISTS (SELECT 1 FROM AuditPerUser);
+
+-- the audit log is append-only, the hash chain catches changes made around this trigger
+CREATE OR REPLACE FUNCTION audit_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'Audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_append_only ON Audit;
+CREATE TRIGGER audit_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON Audit
+    FOR EACH STATEMENT EXECUTE PROCEDURE audit_append_only();
+
+CREATE TABLE IF NOT EXISTS Adjustments (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INT NOT NULL,
+    currency   TEXT NOT NULL,
+    amount     NUMERIC NOT NULL,
+    reason     TEXT NOT NULL,
+    ticket     TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    decided_by TEXT,
+    created_at TIMESTAMP NOT NULL,
+    decided_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS adjustments_pending ON Adjustments (id) WHERE status = 'pending';
+
+-- a user without a row here is active
+CREATE TABLE IF NOT EXISTS Accounts (
+    user_id    INT PRIMARY KEY,
+    status     TEXT NOT NULL,
+    reason     TEXT,
+    updated_by TEXT,
+    updated_at TIMESTAMP NOT NULL,
+    -- spending limit days and months start in this timezone
+    timezone   TEXT NOT NULL DEFAULT 'UTC'
+);
+
+ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+
+CREATE TABLE IF NOT EXISTS AccountStatusHistory (
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     INT NOT NULL,
+    from_status TEXT NOT NULL,
+    to_status   TEXT NOT NULL,
+    reason      TEXT NOT NULL,
+    actor       TEXT NOT NULL,
+    created_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_status_history_user ON AccountStatusHistory (user_id, id);
+
+-- service_id 0 applies to all services, a 0 cap means no cap
+CREATE TABLE IF NOT EXISTS SpendingLimits (
+    user_id         INT NOT NULL,
+    currency        TEXT NOT NULL,
+    service_id      INT NOT NULL,
+    per_transaction NUMERIC NOT NULL,
+    per_day         NUMERIC NOT NULL,
+    per_month       NUMERIC NOT NULL,
+    updated_by      TEXT NOT NULL,
+    updated_at      TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, currency, service_id)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_order ON Ledger (user_id, order_id, id);
+
+CREATE TABLE IF NOT EXISTS Reviews (
+    id         BIGSERIAL PRIMARY KEY,
+    operation  TEXT NOT NULL,
+    user_id    INT NOT NULL,
+    to_user_id INT NOT NULL DEFAULT 0,
+    service_id INT NOT NULL,
+    order_id   INT NOT NULL,
+    currency   TEXT NOT NULL,
+    amount     NUMERIC NOT NULL,
+    voucher    TEXT NOT NULL DEFAULT '',
+    pending    BOOLEAN NOT NULL DEFAULT false,
+    rule       TEXT NOT NULL,
+    reason     TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    decided_by TEXT,
+    created_at TIMESTAMP NOT NULL,
+    decided_at TIMESTAMP
+);
+
+ALTER TABLE Reviews ADD COLUMN IF NOT EXISTS to_user_id INT NOT NULL DEFAULT 0;
+ALTER TABLE Reviews ADD COLUMN IF NOT EXISTS voucher TEXT NOT NULL DEFAULT '';
+ALTER TABLE Reviews ADD COLUMN IF NOT EXISTS pending BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS reviews_pending ON Reviews (id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS ledger_user_operation ON Ledger (user_id, operation, created_at);
+
+-- empty service_ids means the bonus can be spent on any service
+CREATE TABLE IF NOT EXISTS Bonuses (
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     INT NOT NULL,
+    currency    TEXT NOT NULL,
+    amount      NUMERIC NOT NULL,
+    remaining   NUMERIC NOT NULL,
+    service_ids INT[] NOT NULL DEFAULT '{}',
+    reason      TEXT NOT NULL,
+    expires_at  TIMESTAMP NOT NULL,
+    created_by  TEXT NOT NULL,
+    created_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS bonuses_user ON Bonuses (user_id, currency, expires_at) WHERE remaining > 0;
+
+CREATE TABLE IF NOT EXISTS BonusSpends (
+    id         BIGSERIAL PRIMARY KEY,
+    bonus_id   BIGINT NOT NULL REFERENCES Bonuses (id),
+    user_id    INT NOT NULL,
+    service_id INT NOT NULL,
+    order_id   INT NOT NULL,
+    amount     NUMERIC NOT NULL,
+    returned   BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- spends used to be keyed by the order alone, they get the service of the order they paid
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+        AND table_name = 'bonusspends' AND column_name = 'service_id') THEN
+        ALTER TABLE BonusSpends ADD COLUMN service_id INT;
+        UPDATE BonusSpends b SET service_id = t.service_id FROM Transactions t
+            WHERE t.user_id = b.user_id AND t.order_id = b.order_id AND t.bonus > 0;
+        UPDATE BonusSpends SET service_id = 0 WHERE service_id IS NULL;
+        ALTER TABLE BonusSpends ALTER COLUMN service_id SET NOT NULL;
+    END IF;
+    IF EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'bonus_spends_order'
+        AND indexdef NOT LIKE '%service_id%') THEN
+        DROP INDEX bonus_spends_order;
+    END IF;
+END;
+$$;
+
+CREATE INDEX IF NOT EXISTS bonus_spends_order ON BonusSpends (user_id, service_id, order_id);
+
+-- max_redemptions caps the uses of the whole batch, per_code the uses of each code and per_user the uses of the
+-- batch by one user, 0 means no cap; redemptions counts the uses of the batch for max_redemptions
+CREATE TABLE IF NOT EXISTS VoucherBatches (
+    id              BIGSERIAL PRIMARY KEY,
+    name            TEXT NOT NULL,
+    kind            TEXT NOT NULL,
+    value_type      TEXT NOT NULL,
+    value           NUMERIC NOT NULL,
+    currency        TEXT NOT NULL,
+    service_ids     INT[] NOT NULL DEFAULT '{}',
+    max_redemptions INT NOT NULL,
+    per_code        INT NOT NULL DEFAULT 0,
+    per_user        INT NOT NULL,
+    valid_from      TIMESTAMP NOT NULL,
+    valid_until     TIMESTAMP NOT NULL,
+    created_by      TEXT NOT NULL,
+    created_at      TIMESTAMP NOT NULL,
+    redemptions     INT NOT NULL DEFAULT 0
+);
+
+-- max_redemptions used to cap each code: it becomes per_code, the batch is left uncapped
+-- and its redemptions are counted from its codes
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+        AND table_name = 'voucherbatches' AND column_name = 'per_code') THEN
+        ALTER TABLE VoucherBatches ADD COLUMN per_code INT NOT NULL DEFAULT 0;
+        ALTER TABLE VoucherBatches ADD COLUMN IF NOT EXISTS redemptions INT NOT NULL DEFAULT 0;
+        UPDATE VoucherBatches b SET per_code = b.max_redemptions, max_redemptions = 0,
+            redemptions = (SELECT coalesce(sum(v.redemptions), 0) FROM Vouchers v WHERE v.batch_id = b.id);
+    END IF;
+END;
+$$;
+
+CREATE TABLE IF NOT EXISTS Vouchers (
+    code        TEXT PRIMARY KEY,
+    batch_id    BIGINT NOT NULL REFERENCES VoucherBatches (id),
+    redemptions INT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS vouchers_batch ON Vouchers (batch_id);
+
+CREATE TABLE IF NOT EXISTS VoucherRedemptions (
+    id         BIGSERIAL PRIMARY KEY,
+    code       TEXT NOT NULL REFERENCES Vouchers (code),
+    batch_id   BIGINT NOT NULL,
+    user_id    INT NOT NULL,
+    service_id INT NOT NULL,
+    order_id   INT NOT NULL,
+    currency   TEXT NOT NULL,
+    amount     NUMERIC NOT NULL,
+    status     TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS voucher_redemptions_batch ON VoucherRedemptions (batch_id, user_id);
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'voucher_redemptions_order'
+        AND indexdef NOT LIKE '%service_id%') THEN
+        DROP INDEX voucher_redemptions_order;
+    END IF;
+END;
+$$;
+
+CREATE INDEX IF NOT EXISTS voucher_redemptions_order ON VoucherRedemptions (user_id, service_id, order_id) WHERE status = 'redeemed';
+
+-- Wallets older than the Ledger get their history from their orders: an opening entry with what the orders
+-- don't explain, dated at the first order, then a reserve and its capture or cancel at the date of each order.
+-- Cancels used to give the price back to the balance, that money is part of the opening entry.
+WITH wallets AS (
+    SELECT u.id, u.currency, u.balance, u.reserved FROM Users u
+    WHERE NOT EXISTS (SELECT 1 FROM Ledger l WHERE l.user_id = u.id AND l.currency = u.currency)
+), steps AS (
+    SELECT t.user_id, t.currency, t.order_id, t.service_id, t.cost, t.date, s.step, s.operation,
+        s.balance_sign * t.cost AS balance_delta, s.reserved_sign * t.cost AS reserved_delta
+    FROM Transactions t
+    JOIN wallets w ON w.id = t.user_id AND w.currency = t.currency
+    JOIN (VALUES
+        ('reserved', 1, 'reserve', 0, 1),
+        ('done', 1, 'reserve', 0, 1),
+        ('done', 2, 'capture', -1, -1),
+        ('cancelled', 1, 'reserve', 0, 1),
+        ('cancelled', 2, 'cancel', 0, -1)
+    ) AS s (order_status, step, operation, balance_sign, reserved_sign) ON s.order_status = t.order_status
+), opening AS (
+    SELECT w.id AS user_id, w.currency,
+        w.balance - coalesce(sum(s.balance_delta), 0) AS balance,
+        w.reserved - coalesce(sum(s.reserved_delta), 0) AS reserved,
+        coalesce(min(s.date), now() at time zone 'UTC') AS created_at
+    FROM wallets w LEFT JOIN steps s ON s.user_id = w.id AND s.currency = w.currency
+    GROUP BY w.id, w.currency, w.balance, w.reserved
+)
+INSERT INTO Ledger (user_id, currency, operation, order_id, service_id, amount, balance, reserved, created_at)
+SELECT user_id, currency, operation, order_id, service_id, amount, balance, reserved, created_at FROM (
+    SELECT user_id, currency, 'opening' AS operation, NULL::INT AS order_id, NULL::INT AS service_id,
+        balance AS amount, balance, reserved, created_at, 0 AS seq, 0 AS step
+    FROM opening
+    UNION ALL
+    SELECT s.user_id, s.currency, s.operation, s.order_id, s.service_id, s.cost,
+        o.balance + sum(s.balance_delta) OVER running, o.reserved + sum(s.reserved_delta) OVER running,
+        s.date, 1, s.step
+    FROM steps s JOIN opening o ON o.user_id = s.user_id AND o.currency = s.currency
+    WINDOW running AS (PARTITION BY s.user_id, s.currency ORDER BY s.date, s.order_id, s.service_id, s.step
+        ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW)
+) entries
+ORDER BY user_id, currency, created_at, seq, order_id, service_id, step;
@@ -0,0 +1,32 @@
+// Package database holds the schema of the billing database.
+package database
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+)
+
+// Schema creates a new database and brings one created by an older version up to date,
+// it can be applied any number of times.
+//
+//go:embed createDB.sql
+var Schema string
+
+// Migrate applies Schema in one transaction, a failed step leaves the database as it was.
+// Concurrent runs wait for each other.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "select pg_advisory_xact_lock(hashtext('migrate'));"); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, Schema); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
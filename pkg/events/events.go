@@ -0,0 +1,129 @@
+// Package events relays domain events from the outbox table to a message sink.
+package events
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// batchSize is how many outbox events are read at once.
+const batchSize = 100
+
+// Sink delivers events, Publish must not return nil before the event is durably accepted.
+type Sink interface {
+	Publish(ctx context.Context, event server.Event) error
+	Close() error
+}
+
+// Relay publishes committed outbox events. Events are delivered at least once:
+// an event is marked published only after the sink accepted it, and a failed event
+// holds back the later events of the same user until it goes through.
+type Relay struct {
+	db       *server.BillingDB
+	sink     Sink
+	interval time.Duration
+}
+
+func NewRelay(db *server.BillingDB, sink Sink, interval time.Duration) *Relay {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Relay{
+		db:       db,
+		sink:     sink,
+		interval: interval,
+	}
+}
+
+// Run polls the outbox until ctx is cancelled. Only one instance relays at a time,
+// so events leave in the order they were committed.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		release, ok, err := r.db.LockOutbox(ctx)
+		if err != nil {
+			log.Print("ERROR: ", err)
+		}
+		if ok {
+			r.drain(ctx)
+			release()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		events, err := r.db.PendingEvents(ctx, batchSize)
+		if err != nil {
+			log.Print("ERROR: ", err)
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+		published := publish(ctx, r.sink, events)
+		if err = r.db.MarkEventsPublished(ctx, published); err != nil {
+			// the events go out again on the next poll
+			log.Print("ERROR: ", err)
+			return
+		}
+		if len(published) < len(events) {
+			return
+		}
+	}
+}
+
+// publish sends the events in order and returns the ids the sink accepted.
+// After a failure the remaining events of that user are skipped to keep their order.
+func publish(ctx context.Context, sink Sink, events []server.Event) []int64 {
+	published := make([]int64, 0, len(events))
+	blocked := map[int]bool{}
+	for _, event := range events {
+		if blocked[event.UserID] {
+			continue
+		}
+		if err := sink.Publish(ctx, event); err != nil {
+			log.Printf("ERROR: publishing event %d: %s", event.ID, err)
+			blocked[event.UserID] = true
+			continue
+		}
+		published = append(published, event.ID)
+	}
+	return published
+}
+
+type multiSink []Sink
+
+// Multi publishes every event to all sinks. An event failing in one sink is sent to all of them
+// again, so each sink has to tolerate duplicates anyway.
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+func (m multiSink) Publish(ctx context.Context, event server.Event) error {
+	for _, sink := range m {
+		if err := sink.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSink) Close() error {
+	var first error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+type failingSink struct {
+	fail map[int64]bool
+	sent []int64
+}
+
+func (s *failingSink) Publish(ctx context.Context, event server.Event) error {
+	if s.fail[event.ID] {
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, event.ID)
+	return nil
+}
+
+func (s *failingSink) Close() error {
+	return nil
+}
+
+func TestPublishKeepsUserOrder(t *testing.T) {
+	events := []server.Event{
+		{ID: 1, UserID: 1},
+		{ID: 2, UserID: 2},
+		{ID: 3, UserID: 1},
+		{ID: 4, UserID: 2},
+		{ID: 5, UserID: 3},
+	}
+	sink := &failingSink{fail: map[int64]bool{2: true}}
+	published := publish(context.Background(), sink, events)
+	// user 2 is held back after its first failure, the others go through
+	if want := []int64{1, 3, 5}; !reflect.DeepEqual(published, want) {
+		t.Errorf("expected %v published, got %v", want, published)
+	}
+	if !reflect.DeepEqual(sink.sent, published) {
+		t.Errorf("sink got %v, reported %v", sink.sent, published)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriter(&buf)
+	for _, event := range []server.Event{
+		{ID: 1, Type: server.EventUserCredited, UserID: 7, Data: json.RawMessage(`{"amount":100}`)},
+		{ID: 2, Type: server.EventFundsReserved, UserID: 7, Data: json.RawMessage(`{"amount":40}`)},
+	} {
+		if err := sink.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := json.NewDecoder(&buf)
+	var ids []int64
+	for {
+		var event server.Event
+		if err := decoder.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, event.ID)
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("expected events 1 and 2, got %v", ids)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got server.Event
+	var header http.Header
+	status := http.StatusNoContent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	sink := NewWebhook(receiver.URL)
+	event := server.Event{ID: 42, Type: server.EventReserveCaptured, UserID: 7, Data: json.RawMessage(`{"order_id":3}`)}
+	if err := sink.Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 42 || got.Type != server.EventReserveCaptured || string(got.Data) != `{"order_id":3}` {
+		t.Errorf("unexpected event %+v", got)
+	}
+	if header.Get("X-Event-ID") != "42" || header.Get("X-Event-Type") != server.EventReserveCaptured {
+		t.Errorf("unexpected headers %v", header)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := sink.Publish(context.Background(), event); err == nil {
+		t.Error("expected an error for a 503 answer")
+	}
+}
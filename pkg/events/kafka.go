@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes events to a topic keyed by user id, so all events of a user
+// land in one partition and keep their order.
+type Kafka struct {
+	writer *kafka.Writer
+}
+
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (s *Kafka) Publish(ctx context.Context, event server.Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(strconv.Itoa(event.UserID)),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "event_id", Value: []byte(strconv.FormatInt(event.ID, 10))},
+			{Key: "event_type", Value: []byte(event.Type)},
+		},
+	})
+}
+
+func (s *Kafka) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes events to JetStream under <subject>.<event type>. A stream has to
+// cover the subjects; its acknowledgement makes the event durable and the message id
+// lets JetStream drop redelivered duplicates.
+type NATS struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+}
+
+func NewNATS(url, subject string) (*NATS, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATS{conn: conn, js: js, subject: subject}, nil
+}
+
+func (s *NATS) Publish(ctx context.Context, event server.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.js.Publish(s.subject+"."+event.Type, data,
+		nats.Context(ctx), nats.MsgId(strconv.FormatInt(event.ID, 10)))
+	return err
+}
+
+func (s *NATS) Close() error {
+	return s.conn.Drain()
+}
@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// Writer writes events as JSON lines, it is meant for local development.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// OpenFile appends events to the file at path, creating it if needed.
+func OpenFile(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: file, closer: file}, nil
+}
+
+func (s *Writer) Publish(ctx context.Context, event server.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *Writer) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,145 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/billingpb"
+	"github.com/Placebo900/billing_service_test/pkg/ratelimit"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// methodScopes is the scope each BillingService method needs, the same as its HTTP counterpart.
+var methodScopes = map[string]string{
+	billingpb.BillingService_Credit_FullMethodName:           auth.ScopeCredit,
+	billingpb.BillingService_Reserve_FullMethodName:          auth.ScopeReserve,
+	billingpb.BillingService_Capture_FullMethodName:          auth.ScopeCapture,
+	billingpb.BillingService_Cancel_FullMethodName:           auth.ScopeReserve,
+	billingpb.BillingService_GetBalance_FullMethodName:       auth.ScopeReadBalance,
+	billingpb.BillingService_ListTransactions_FullMethodName: auth.ScopeReadBalance,
+}
+
+// keyUsage is the part of BillingDB the interceptor needs besides the authenticator.
+type keyUsage interface {
+	RecordKeyUsage(ctx context.Context, usage server.KeyUsage) error
+}
+
+// authorize checks the API key or end-user JWT from the authorization (or x-api-key) metadata and its rate limits,
+// and records the call in the usage audit.
+func authorize(authn *auth.Authenticator, db keyUsage, limiter *ratelimit.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		scope, ok := methodScopes[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		key, err := authn.Authenticate(ctx, auth.FromHeader(first(md, "authorization"), first(md, "x-api-key")))
+		if err != nil {
+			if !errors.Is(err, auth.ErrUnauthorized) {
+				log.Print("ERROR: ", err)
+			}
+			return nil, status.Error(codes.Unauthenticated, auth.ErrUnauthorized.Error())
+		}
+		var resp interface{}
+		err = checkKey(key, scope, req)
+		if err == nil && limiter != nil {
+			err = checkLimit(ctx, limiter, key, info.FullMethod, req)
+		}
+		if err == nil {
+			resp, err = handler(withAudit(ctx, md, key, info.FullMethod, req), req)
+		}
+		if key.UserID != 0 {
+			// end-user tokens aren't keys, there is nothing to audit
+			return resp, err
+		}
+
+		usage := server.KeyUsage{KeyID: key.ID, Method: "GRPC", Route: info.FullMethod, Status: int(status.Code(err))}
+		if p, ok := peer.FromContext(ctx); ok {
+			usage.IP, _, _ = net.SplitHostPort(p.Addr.String())
+		}
+		if err := db.RecordKeyUsage(context.Background(), usage); err != nil {
+			log.Print("ERROR: ", err)
+		}
+		return resp, err
+	}
+}
+
+// checkKey applies the scope and service restrictions of the key to the request.
+func checkKey(key server.APIKey, scope string, req interface{}) error {
+	if !auth.Allows(key, scope) {
+		return status.Errorf(codes.PermissionDenied, "API key needs the %s scope", scope)
+	}
+	var err error
+	switch req := req.(type) {
+	case *billingpb.ReserveRequest:
+		err = auth.AuthorizeService(key, int(req.ServiceId))
+	case *billingpb.CaptureRequest:
+		err = auth.AuthorizeService(key, int(req.ServiceId))
+	case *billingpb.CancelRequest:
+		err = auth.AuthorizeService(key, int(req.ServiceId))
+	case *billingpb.GetBalanceRequest:
+		err = auth.AuthorizeUser(key, int(req.UserId))
+	case *billingpb.ListTransactionsRequest:
+		err = auth.AuthorizeUser(key, int(req.UserId))
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// checkLimit answers RESOURCE_EXHAUSTED with a retry-after header once a bucket of the call runs out.
+func checkLimit(ctx context.Context, limiter *ratelimit.Limiter, key server.APIKey, method string, req interface{}) error {
+	var userID int32
+	if req, ok := req.(interface{ GetUserId() int32 }); ok {
+		userID = req.GetUserId()
+	}
+	res := limiter.Allow(ctx, ratelimit.Request{Key: auth.Caller(key), UserID: int(userID), Route: method})
+	if res.Allowed {
+		return nil
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds())))
+	if err := grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfter)); err != nil {
+		log.Print("ERROR: ", err)
+	}
+	return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %ss", retryAfter)
+}
+
+// withAudit puts the caller and the request into ctx for the audit records of the changes the call makes.
+func withAudit(ctx context.Context, md metadata.MD, key server.APIKey, method string, req interface{}) context.Context {
+	audit := server.AuditInfo{Actor: auth.Caller(key), RequestID: first(md, "x-request-id"), Request: method}
+	if audit.RequestID == "" {
+		audit.RequestID = server.NewRequestID()
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		audit.IP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if msg, ok := req.(proto.Message); ok {
+		if body, err := protojson.Marshal(msg); err == nil {
+			audit.Request += "\n\n" + string(body)
+		}
+	}
+	return server.WithAudit(ctx, audit)
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+// Package grpcapi serves the BillingService gRPC API on top of the same BillingDB as the HTTP API.
+package grpcapi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/billingpb"
+	"github.com/Placebo900/billing_service_test/pkg/ratelimit"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxTransactions caps one page of ListTransactions, 0 in the request means this many.
+const maxTransactions = 1000
+
+// Service implements billingpb.BillingServiceServer. The request context carries the client's deadline
+// into the SQL queries, so a call that runs out of time rolls its transaction back.
+type Service struct {
+	billingpb.UnimplementedBillingServiceServer
+	db *server.BillingDB
+}
+
+// NewServer returns a gRPC server with BillingService and reflection registered,
+// BillingService calls need an API key with the same scopes and rate limits as over HTTP.
+func NewServer(db *server.BillingDB, authn *auth.Authenticator, limiter *ratelimit.Limiter, opts ...grpc.ServerOption) *grpc.Server {
+	return newServer(db, authn, db, limiter, opts...)
+}
+
+func newServer(db *server.BillingDB, authn *auth.Authenticator, usage keyUsage, limiter *ratelimit.Limiter, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(authorize(authn, usage, limiter)))
+	srv := grpc.NewServer(opts...)
+	billingpb.RegisterBillingServiceServer(srv, &Service{db: db})
+	reflection.Register(srv)
+	return srv
+}
+
+func (s *Service) Credit(ctx context.Context, req *billingpb.CreditRequest) (*billingpb.CreditResponse, error) {
+	log.Printf("GRPC CREDIT WITH VALUES %v", req)
+	if err := s.db.CreditUser(ctx, int(req.UserId), req.Currency, req.Price); err != nil {
+		return nil, toStatus(err)
+	}
+	return &billingpb.CreditResponse{}, nil
+}
+
+func (s *Service) Reserve(ctx context.Context, req *billingpb.ReserveRequest) (*billingpb.ReserveResponse, error) {
+	log.Printf("GRPC RESERVE WITH VALUES %v", req)
+	err := s.db.ReserveMoney(ctx, int(req.UserId), int(req.ServiceId), int(req.OrderId), req.Currency, req.Price)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &billingpb.ReserveResponse{}, nil
+}
+
+func (s *Service) Capture(ctx context.Context, req *billingpb.CaptureRequest) (*billingpb.CaptureResponse, error) {
+	log.Printf("GRPC CAPTURE WITH VALUES %v", req)
+	err := s.db.Confirmation(ctx, int(req.UserId), int(req.ServiceId), int(req.OrderId), req.Currency, req.Price)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &billingpb.CaptureResponse{}, nil
+}
+
+func (s *Service) Cancel(ctx context.Context, req *billingpb.CancelRequest) (*billingpb.CancelResponse, error) {
+	log.Printf("GRPC CANCEL WITH VALUES %v", req)
+	if err := s.db.Cancellation(ctx, int(req.UserId), int(req.ServiceId), int(req.OrderId)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &billingpb.CancelResponse{}, nil
+}
+
+func (s *Service) GetBalance(ctx context.Context, req *billingpb.GetBalanceRequest) (*billingpb.GetBalanceResponse, error) {
+	account, err := s.db.CheckAccount(ctx, int(req.UserId), req.Currency, false)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &billingpb.GetBalanceResponse{
+		Currency:  account.Currency,
+		Total:     account.Total,
+		Held:      account.Held,
+		Available: account.Available,
+	}, nil
+}
+
+func (s *Service) ListTransactions(ctx context.Context, req *billingpb.ListTransactionsRequest) (*billingpb.ListTransactionsResponse, error) {
+	if req.Limit < 0 || req.Limit > maxTransactions || req.Offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be within [0, %d] and offset not negative", maxTransactions)
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = maxTransactions
+	}
+	reports, err := s.db.CheckClientTransactions(ctx, int(req.UserId), limit, int(req.Offset))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &billingpb.ListTransactionsResponse{
+		Transactions: make([]*billingpb.Transaction, 0, len(reports.Reports)),
+	}
+	for _, report := range reports.Reports {
+		resp.Transactions = append(resp.Transactions, &billingpb.Transaction{
+			OrderId:   int32(report.OrderID),
+			ServiceId: int32(report.ServiceID),
+			Currency:  report.Currency,
+			Cost:      report.Cost,
+			Status:    report.OrderStatus,
+			Date:      timestamppb.New(report.Date),
+		})
+	}
+	return resp, nil
+}
+
+// toStatus maps domain errors to gRPC codes, anything unexpected is logged and hidden behind INTERNAL.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, server.ErrInvalidAmount), errors.Is(err, server.ErrUnsupportedCurrency):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, "not found")
+	case errors.Is(err, server.ErrNotEnoughMoney), errors.Is(err, server.ErrWrongOperation),
+		errors.Is(err, server.ErrAccountStatus), errors.Is(err, server.ErrLimitExceeded),
+		errors.Is(err, server.ErrRiskDenied), errors.Is(err, server.ErrHeldForReview):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	log.Print("ERROR: ", err)
+	return status.Error(codes.Internal, "internal server error")
+}
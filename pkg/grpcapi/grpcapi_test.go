@@ -0,0 +1,213 @@
+package grpcapi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Placebo900/billing_service_test/pkg/auth"
+	"github.com/Placebo900/billing_service_test/pkg/billingpb"
+	"github.com/Placebo900/billing_service_test/pkg/ratelimit"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestToStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want codes.Code
+	}{
+		{server.ErrInvalidAmount, codes.InvalidArgument},
+		{fmt.Errorf("%w %q", server.ErrUnsupportedCurrency, "USD"), codes.InvalidArgument},
+		{sql.ErrNoRows, codes.NotFound},
+		{fmt.Errorf("%w for reserve", server.ErrNotEnoughMoney), codes.FailedPrecondition},
+		{fmt.Errorf("%w. Order 1 of user 1 isn't reserved", server.ErrWrongOperation), codes.FailedPrecondition},
+		{fmt.Errorf("%w. Account of user 1 is frozen, reserve isn't allowed", server.ErrAccountStatus), codes.FailedPrecondition},
+		{&server.LimitError{Window: server.LimitDay, Currency: "RUB", Limit: 100, Remaining: 20}, codes.FailedPrecondition},
+		{fmt.Errorf("begin: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{context.Canceled, codes.Canceled},
+		{errors.New("pq: connection refused"), codes.Internal},
+	}
+	for _, tc := range cases {
+		if got := status.Code(toStatus(tc.err)); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
+
+// fakeKeys stores keys by secret and collects the usage audit.
+type fakeKeys struct {
+	mu     sync.Mutex
+	keys   map[string]server.APIKey
+	usages []server.KeyUsage
+}
+
+func (f *fakeKeys) APIKeyByHash(_ context.Context, hash string) (server.APIKey, error) {
+	for secret, key := range f.keys {
+		if auth.Hash(secret) == hash {
+			return key, nil
+		}
+	}
+	return server.APIKey{}, sql.ErrNoRows
+}
+
+func (f *fakeKeys) RecordKeyUsage(_ context.Context, usage server.KeyUsage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.usages = append(f.usages, usage)
+	return nil
+}
+
+const bootstrapKey = "bootstrap-secret"
+
+func dial(t *testing.T) *grpc.ClientConn {
+	return dialKeys(t, &fakeKeys{}, nil)
+}
+
+func dialKeys(t *testing.T, keys *fakeKeys, limiter *ratelimit.Limiter) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	srv := newServer(&server.BillingDB{}, auth.NewAuthenticator(keys, bootstrapKey), keys, limiter)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListTransactionsValidation(t *testing.T) {
+	client := billingpb.NewBillingServiceClient(dial(t))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+bootstrapKey)
+	_, err := client.ListTransactions(ctx, &billingpb.ListTransactionsRequest{UserId: 1, Limit: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	keys := &fakeKeys{
+		keys: map[string]server.APIKey{
+			"reader": {ID: 1, Scopes: []string{auth.ScopeReadBalance}},
+			"video":  {ID: 2, Scopes: []string{auth.ScopeReserve, auth.ScopeCapture}, ServiceIDs: []int64{1}},
+			// what an end-user token resolves to
+			"mobile": {Scopes: []string{auth.ScopeReadBalance}, UserID: 5},
+		},
+	}
+	client := billingpb.NewBillingServiceClient(dialKeys(t, keys, nil))
+	call := func(secret string, rpc func(ctx context.Context) error) codes.Code {
+		ctx := context.Background()
+		if secret != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", secret)
+		}
+		return status.Code(rpc(ctx))
+	}
+	list := func(ctx context.Context) error {
+		// an invalid page fails after authorization without touching the database
+		_, err := client.ListTransactions(ctx, &billingpb.ListTransactionsRequest{UserId: 1, Limit: -1})
+		return err
+	}
+	cases := []struct {
+		name   string
+		secret string
+		rpc    func(ctx context.Context) error
+		want   codes.Code
+	}{
+		{"no key", "", list, codes.Unauthenticated},
+		{"unknown key", "guess", list, codes.Unauthenticated},
+		{"scope", "reader", list, codes.InvalidArgument},
+		{"missing scope", "reader", func(ctx context.Context) error {
+			_, err := client.Credit(ctx, &billingpb.CreditRequest{UserId: 1, Price: 100})
+			return err
+		}, codes.PermissionDenied},
+		{"other service", "video", func(ctx context.Context) error {
+			_, err := client.Reserve(ctx, &billingpb.ReserveRequest{UserId: 1, ServiceId: 2, OrderId: 3, Price: 100})
+			return err
+		}, codes.PermissionDenied},
+		{"order of other service", "video", func(ctx context.Context) error {
+			_, err := client.Cancel(ctx, &billingpb.CancelRequest{UserId: 1, ServiceId: 2, OrderId: 7})
+			return err
+		}, codes.PermissionDenied},
+		{"other user", "mobile", func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, &billingpb.GetBalanceRequest{UserId: 6})
+			return err
+		}, codes.PermissionDenied},
+		{"bootstrap", bootstrapKey, list, codes.InvalidArgument},
+	}
+	for _, tc := range cases {
+		if got := call(tc.secret, tc.rpc); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	if len(keys.usages) != 5 {
+		t.Fatalf("expected 5 audited calls, got %+v", keys.usages)
+	}
+	if usage := keys.usages[2]; usage.KeyID != 2 || usage.Route != billingpb.BillingService_Reserve_FullMethodName ||
+		usage.Status != int(codes.PermissionDenied) {
+		t.Errorf("unexpected usage record %+v", usage)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.NewMemory(), ratelimit.Limit{}, ratelimit.Limit{Rate: 0.5, Burst: 1}, nil)
+	client := billingpb.NewBillingServiceClient(dialKeys(t, &fakeKeys{}, limiter))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", bootstrapKey)
+	req := &billingpb.ListTransactionsRequest{UserId: 1, Limit: -1}
+
+	if _, err := client.ListTransactions(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected the first call to pass the limiter, got %v", err)
+	}
+	var header metadata.MD
+	_, err := client.ListTransactions(ctx, req, grpc.Header(&header))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if got := header.Get("retry-after"); len(got) != 1 || got[0] != "2" {
+		t.Errorf("expected retry-after 2, got %v", got)
+	}
+	// the bucket belongs to user 1, user 2 isn't affected
+	if _, err = client.ListTransactions(ctx, &billingpb.ListTransactionsRequest{UserId: 2, Limit: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected user 2 to pass, got %v", err)
+	}
+}
+
+func TestReflection(t *testing.T) {
+	client := grpc_reflection_v1alpha.NewServerReflectionClient(dial(t))
+	stream, err := client.ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&grpc_reflection_v1alpha.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		found = found || service.Name == "billing.v1.BillingService"
+	}
+	if !found {
+		t.Errorf("billing.v1.BillingService is not listed: %v", resp)
+	}
+}
@@ -0,0 +1,192 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/blob"
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// pollInterval bounds how long a job enqueued by another instance waits in the queue.
+const pollInterval = 5 * time.Second
+
+// DefaultLease is how long a claimed job may go without a heartbeat before another worker takes it over.
+const DefaultLease = 5 * time.Minute
+
+// Queue stores the jobs and builds their reports, *server.BillingDB is the one the service uses.
+type Queue interface {
+	CreateReportJob(ctx context.Context, params server.ReportParams) (server.ReportJob, error)
+	ClaimReportJob(ctx context.Context, lease time.Duration) (server.ReportJob, error)
+	HeartbeatReportJob(ctx context.Context, id string) error
+	FinishReportJob(ctx context.Context, id, blobKey string, jobErr error) error
+	BuildReport(ctx context.Context, params server.ReportParams) (*report.Table, error)
+}
+
+// Pool builds queued reports in the background and uploads them to the blob store.
+type Pool struct {
+	db      Queue
+	store   blob.Store
+	workers int
+	lease   time.Duration
+	wake    chan struct{}
+}
+
+// NewPool makes a pool of workers, a job they claimed is taken over by another worker
+// when its heartbeats stop for lease.
+func NewPool(db Queue, store blob.Store, workers int, lease time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	return &Pool{
+		db:      db,
+		store:   store,
+		workers: workers,
+		lease:   lease,
+		wake:    make(chan struct{}, workers),
+	}
+}
+
+// Enqueue validates the report parameters and queues a job for them.
+func (p *Pool) Enqueue(ctx context.Context, params server.ReportParams) (server.ReportJob, error) {
+	if _, err := reportFormat(params); err != nil {
+		return server.ReportJob{}, err
+	}
+	switch params.Type {
+	case server.ReportMonthly:
+		if _, err := server.ParseMonth(params.Date); err != nil {
+			return server.ReportJob{}, err
+		}
+	case server.ReportRevenue:
+		if _, err := server.NewRevenueQuery(params); err != nil {
+			return server.ReportJob{}, err
+		}
+	case server.ReportDebtors, server.ReportVouchers:
+	default:
+		return server.ReportJob{}, fmt.Errorf("unknown report type %q", params.Type)
+	}
+	job, err := p.db.CreateReportJob(ctx, params)
+	if err != nil {
+		return server.ReportJob{}, err
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// URL returns a download link for a finished job.
+func (p *Pool) URL(ctx context.Context, job server.ReportJob, expires time.Duration) (string, error) {
+	if job.Status != server.JobDone {
+		return "", fmt.Errorf("report %s is %s", job.ID, job.Status)
+	}
+	return p.store.URL(ctx, job.BlobKey, expires)
+}
+
+// Run starts the workers and blocks until ctx is cancelled.
+func (p *Pool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := p.db.ClaimReportJob(ctx, p.lease)
+		switch {
+		case err == nil:
+			p.process(ctx, job)
+			continue
+		case !errors.Is(err, sql.ErrNoRows):
+			log.Print("ERROR: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) process(ctx context.Context, job server.ReportJob) {
+	log.Printf("BUILDING REPORT %s WITH VALUES %+v, ATTEMPT %d", job.ID, job.Params, job.Attempts)
+	done := make(chan struct{})
+	go p.heartbeat(ctx, job.ID, done)
+	key, err := p.build(ctx, job)
+	close(done)
+	if err != nil {
+		log.Printf("ERROR: report %s: %s", job.ID, err)
+	}
+	if err = p.db.FinishReportJob(ctx, job.ID, key, err); err != nil {
+		log.Print("ERROR: ", err)
+	}
+}
+
+// heartbeat renews the lease of the job until done is closed.
+func (p *Pool) heartbeat(ctx context.Context, id string, done <-chan struct{}) {
+	ticker := time.NewTicker(p.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.db.HeartbeatReportJob(ctx, id); err != nil {
+				log.Print("ERROR: ", err)
+			}
+		}
+	}
+}
+
+func (p *Pool) build(ctx context.Context, job server.ReportJob) (string, error) {
+	format, err := reportFormat(job.Params)
+	if err != nil {
+		return "", err
+	}
+	table, err := p.db.BuildReport(ctx, job.Params)
+	if err != nil {
+		return "", err
+	}
+	defer table.Close()
+	key := fmt.Sprintf("%s_%s.%s", table.Name, job.ID, format.Extension())
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(format.Encode(pw, table))
+	}()
+	err = p.store.Put(ctx, key, pr, format.ContentType())
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func reportFormat(params server.ReportParams) (report.Format, error) {
+	var fallback report.Format = report.CSV{}
+	if params.Type == server.ReportRevenue {
+		fallback = report.JSON{}
+	}
+	return report.Negotiate(params.Format, "", params.Delimiter, fallback)
+}
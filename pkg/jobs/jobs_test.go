@@ -0,0 +1,209 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// fakeQueue keeps the jobs in memory and builds a one row table, or fails for the month in failing.
+type fakeQueue struct {
+	mu         sync.Mutex
+	jobs       []server.ReportJob
+	failing    string
+	slow       time.Duration
+	heartbeats int
+	finished   map[string]error
+	keys       map[string]string
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{finished: map[string]error{}, keys: map[string]string{}}
+}
+
+func (q *fakeQueue) CreateReportJob(_ context.Context, params server.ReportParams) (server.ReportJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := server.ReportJob{ID: params.Date, Params: params, Status: server.JobQueued}
+	q.jobs = append(q.jobs, job)
+	return job, nil
+}
+
+func (q *fakeQueue) ClaimReportJob(context.Context, time.Duration) (server.ReportJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.jobs {
+		if job.Status == server.JobQueued {
+			q.jobs[i].Status = server.JobRunning
+			q.jobs[i].Attempts++
+			return q.jobs[i], nil
+		}
+	}
+	return server.ReportJob{}, sql.ErrNoRows
+}
+
+func (q *fakeQueue) HeartbeatReportJob(context.Context, string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heartbeats++
+	return nil
+}
+
+func (q *fakeQueue) FinishReportJob(_ context.Context, id, blobKey string, jobErr error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished[id], q.keys[id] = jobErr, blobKey
+	return nil
+}
+
+func (q *fakeQueue) BuildReport(ctx context.Context, params server.ReportParams) (*report.Table, error) {
+	if params.Date == q.failing {
+		return nil, errors.New("database is down")
+	}
+	select {
+	case <-time.After(q.slow):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &report.Table{
+		Name:    "report_" + params.Date,
+		Columns: []report.Column{{Name: "service_id", Type: report.Int}, {Name: "price", Type: report.Float}},
+		Rows:    [][]interface{}{{int64(1), 100.5}},
+	}, nil
+}
+
+func (q *fakeQueue) wait(t *testing.T, jobs int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		q.mu.Lock()
+		finished := len(q.finished)
+		q.mu.Unlock()
+		if finished == jobs {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d jobs finished", finished, jobs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type memStore struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (s *memStore) Put(_ context.Context, key string, r io.Reader, _ string) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[key] = buf.String()
+	return nil
+}
+
+func (s *memStore) URL(_ context.Context, key string, _ time.Duration) (string, error) {
+	return "http://billing/files/" + key, nil
+}
+
+func TestEnqueue(t *testing.T) {
+	cases := []struct {
+		name    string
+		params  server.ReportParams
+		wantErr bool
+	}{
+		{name: "monthly", params: server.ReportParams{Type: server.ReportMonthly, Date: "2022-11"}},
+		{name: "monthly without a date", params: server.ReportParams{Type: server.ReportMonthly}, wantErr: true},
+		{name: "monthly with a day", params: server.ReportParams{Type: server.ReportMonthly, Date: "2022-11-01"}, wantErr: true},
+		{name: "monthly out of range", params: server.ReportParams{Type: server.ReportMonthly, Date: "2022-13"}, wantErr: true},
+		{name: "debtors", params: server.ReportParams{Type: server.ReportDebtors}},
+		{name: "unknown type", params: server.ReportParams{Type: "profit"}, wantErr: true},
+		{name: "unknown format", params: server.ReportParams{Type: server.ReportDebtors, Format: "doc"}, wantErr: true},
+	}
+	for _, tc := range cases {
+		queue := newFakeQueue()
+		pool := NewPool(queue, &memStore{files: map[string]string{}}, 1, time.Minute)
+		job, err := pool.Enqueue(context.Background(), tc.params)
+		if tc.wantErr {
+			if err == nil || len(queue.jobs) != 0 {
+				t.Errorf("%s: expected the job to be refused, got %+v", tc.name, job)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if job.Status != server.JobQueued || len(queue.jobs) != 1 {
+			t.Errorf("%s: job wasn't queued: %+v", tc.name, job)
+		}
+		select {
+		case <-pool.wake:
+		default:
+			t.Errorf("%s: workers weren't woken up", tc.name)
+		}
+	}
+}
+
+func TestPoolFinishesJobs(t *testing.T) {
+	queue := newFakeQueue()
+	queue.failing = "2022-10"
+	store := &memStore{files: map[string]string{}}
+	pool := NewPool(queue, store, 2, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Run(ctx)
+	for _, date := range []string{"2022-11", "2022-10"} {
+		if _, err := pool.Enqueue(ctx, server.ReportParams{Type: server.ReportMonthly, Date: date}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.wait(t, 2)
+
+	if err := queue.finished["2022-11"]; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	key := queue.keys["2022-11"]
+	if key != "report_2022-11_2022-11.csv" || !strings.HasPrefix(store.files[key], "service_id,price\n1,100.5") {
+		t.Errorf("unexpected upload %q: %q", key, store.files[key])
+	}
+	if err := queue.finished["2022-10"]; err == nil || queue.keys["2022-10"] != "" {
+		t.Errorf("expected the failed build to be recorded, got %v and key %q", err, queue.keys["2022-10"])
+	}
+	if _, err := pool.URL(ctx, server.ReportJob{ID: "2022-10", Status: server.JobFailed}, time.Minute); err == nil {
+		t.Error("expected no link for a failed job")
+	}
+}
+
+func TestPoolRenewsLease(t *testing.T) {
+	queue := newFakeQueue()
+	queue.slow = 100 * time.Millisecond
+	pool := NewPool(queue, &memStore{files: map[string]string{}}, 1, 30*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Run(ctx)
+	if _, err := pool.Enqueue(ctx, server.ReportParams{Type: server.ReportMonthly, Date: "2022-11"}); err != nil {
+		t.Fatal(err)
+	}
+	queue.wait(t, 1)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.heartbeats == 0 {
+		t.Error("a job building longer than the lease wasn't renewed")
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many takes pass between dropping buckets that have refilled completely.
+const sweepEvery = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Memory keeps the buckets of one instance, use Redis to share them between instances.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}}
+}
+
+func (m *Memory) Take(_ context.Context, name string, limit Limit, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.takes++; m.takes%sweepEvery == 0 {
+		m.sweep(now)
+	}
+	b, ok := m.buckets[name]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[name] = b
+	}
+	b.tokens = refill(limit, b.tokens, now.Sub(b.last))
+	b.last = now
+	b.limit = limit
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return result(limit, b.tokens, allowed), nil
+}
+
+// sweep forgets full buckets, a new bucket starts full anyway.
+func (m *Memory) sweep(now time.Time) {
+	for name, b := range m.buckets {
+		if refill(b.limit, b.tokens, now.Sub(b.last)) >= float64(b.limit.Burst) {
+			delete(m.buckets, name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package ratelimit keeps token buckets per API key, per user and per route.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	checked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "billing_ratelimit_requests_total",
+		Help: "Requests checked by the rate limiter by route and result (allowed, limited or error).",
+	}, []string{"route", "result"})
+	limited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "billing_ratelimit_limited_total",
+		Help: "Rejected requests by route and the bucket that ran out (key, user or route).",
+	}, []string{"route", "bucket"})
+)
+
+// Limit refills Rate tokens per second up to Burst, every request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit reads limits like "100/s", "600/m" or "20/1m", the burst is the number of requests.
+// An empty string means no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("bad rate limit %q, expected requests/period like 100/s", s)
+	}
+	switch period {
+	case "s", "m", "h":
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("bad rate limit period in %q", s)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// ParseRoutes reads per-route limits like "/reserve=10/s,/credit=50/m".
+func ParseRoutes(list []string) (map[string]Limit, error) {
+	routes := map[string]Limit{}
+	for _, item := range list {
+		route, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad route rate limit %q, expected route=requests/period", item)
+		}
+		limit, err := ParseLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		routes[strings.TrimSpace(route)] = limit
+	}
+	return routes, nil
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Result is the state of the bucket after taking a token.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the next token when the request isn't allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// result turns the tokens left in a bucket into a Result, both backends share the arithmetic.
+func result(limit Limit, tokens float64, allowed bool) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		res.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// refill is the token bucket itself: tokens grow with the time since the last request, capped by the burst.
+func refill(limit Limit, tokens float64, elapsed time.Duration) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+}
+
+// Backend stores the buckets.
+type Backend interface {
+	Take(ctx context.Context, bucket string, limit Limit, now time.Time) (Result, error)
+}
+
+// Limiter checks a request against the bucket of its key, its user and its route.
+type Limiter struct {
+	backend Backend
+	key     Limit
+	user    Limit
+	routes  map[string]Limit
+	now     func() time.Time
+}
+
+func New(backend Backend, key, user Limit, routes map[string]Limit) *Limiter {
+	return &Limiter{backend: backend, key: key, user: user, routes: routes, now: time.Now}
+}
+
+// Request identifies the caller, UserID is 0 when the request doesn't name a user.
+type Request struct {
+	Key    string
+	UserID int
+	Route  string
+}
+
+// Allow takes a token from every bucket the request falls into and returns the most restrictive result.
+// A failing backend lets the request through, losing the limits is better than losing the API.
+func (l *Limiter) Allow(ctx context.Context, req Request) Result {
+	buckets := []struct {
+		name, id string
+		limit    Limit
+	}{
+		{"key", "key:" + req.Key, l.key},
+		{"user", "user:" + strconv.Itoa(req.UserID), l.user},
+		{"route", "route:" + req.Route + ":" + req.Key, l.routes[req.Route]},
+	}
+	now := l.now()
+	final := Result{Allowed: true}
+	for _, bucket := range buckets {
+		if !bucket.limit.enabled() || (bucket.name == "user" && req.UserID == 0) {
+			continue
+		}
+		res, err := l.backend.Take(ctx, bucket.id, bucket.limit, now)
+		if err != nil {
+			log.Print("ERROR: rate limit: ", err)
+			checked.WithLabelValues(req.Route, "error").Inc()
+			return Result{Allowed: true}
+		}
+		if !res.Allowed {
+			limited.WithLabelValues(req.Route, bucket.name).Inc()
+			if final.Allowed || res.RetryAfter > final.RetryAfter {
+				final = res
+			}
+			continue
+		}
+		if final.Allowed && (final.Limit == 0 || res.Remaining < final.Remaining) {
+			final = res
+		}
+	}
+	if final.Allowed {
+		checked.WithLabelValues(req.Route, "allowed").Inc()
+	} else {
+		checked.WithLabelValues(req.Route, "limited").Inc()
+	}
+	return final
+}
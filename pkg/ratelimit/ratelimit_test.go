@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Limit
+		ok   bool
+	}{
+		{"", Limit{}, true},
+		{"100/s", Limit{Rate: 100, Burst: 100}, true},
+		{"600/m", Limit{Rate: 10, Burst: 600}, true},
+		{"20/10s", Limit{Rate: 2, Burst: 20}, true},
+		{"0/s", Limit{}, false},
+		{"100", Limit{}, false},
+		{"100/day", Limit{}, false},
+	}
+	for _, tc := range cases {
+		got, err := ParseLimit(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: expected %+v, got %+v, %v", tc.in, tc.want, got, err)
+		}
+	}
+	routes, err := ParseRoutes([]string{"/reserve=10/s", "/users/:id/statement=1/m"})
+	if err != nil || routes["/reserve"].Burst != 10 || routes["/users/:id/statement"].Burst != 1 {
+		t.Errorf("unexpected routes %+v, %v", routes, err)
+	}
+}
+
+// testBackend runs the same bucket scenario against every backend.
+func testBackend(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+	for i := 2; i >= 0; i-- {
+		res, err := backend.Take(ctx, "b", limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != i || res.Limit != 3 {
+			t.Fatalf("take %d: unexpected %+v", 3-i, res)
+		}
+	}
+	res, err := backend.Take(ctx, "b", limit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != 1500*time.Millisecond {
+		t.Fatalf("empty bucket: unexpected %+v", res)
+	}
+	// half a second refills one token
+	if res, err = backend.Take(ctx, "b", limit, now.Add(500*time.Millisecond)); err != nil || !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("after refill: unexpected %+v, %v", res, err)
+	}
+	// buckets are independent and never hold more than the burst
+	if res, err = backend.Take(ctx, "other", limit, now.Add(time.Hour)); err != nil || !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("other bucket: unexpected %+v, %v", res, err)
+	}
+	if res, err = backend.Take(ctx, "b", limit, now.Add(time.Hour)); err != nil || !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("refilled bucket: unexpected %+v, %v", res, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory())
+}
+
+func TestRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	testBackend(t, NewRedis(client, "ratelimit:"))
+	if ttl := mr.TTL("ratelimit:b"); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("expected the bucket to expire once full, TTL %s", ttl)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+	limiter := New(NewMemory(), Limit{Rate: 1, Burst: 10}, Limit{Rate: 1, Burst: 2}, map[string]Limit{"/reserve": {Rate: 1, Burst: 5}})
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+	before := testutil.ToFloat64(limited.WithLabelValues("/reserve", "user"))
+
+	res := limiter.Allow(ctx, Request{Key: "1", UserID: 7, Route: "/reserve"})
+	if !res.Allowed || res.Limit != 2 || res.Remaining != 1 {
+		t.Fatalf("expected the user bucket to be reported, got %+v", res)
+	}
+	limiter.Allow(ctx, Request{Key: "1", UserID: 7, Route: "/reserve"})
+	if res = limiter.Allow(ctx, Request{Key: "1", UserID: 7, Route: "/reserve"}); res.Allowed || res.RetryAfter != time.Second {
+		t.Fatalf("expected user 7 to be limited, got %+v", res)
+	}
+	if got := testutil.ToFloat64(limited.WithLabelValues("/reserve", "user")) - before; got != 1 {
+		t.Errorf("expected one limited request in metrics, got %v", got)
+	}
+	// another user of the same key still has its own bucket, requests without a user skip it
+	if res = limiter.Allow(ctx, Request{Key: "1", UserID: 8, Route: "/reserve"}); !res.Allowed {
+		t.Fatalf("expected user 8 to pass, got %+v", res)
+	}
+	if res = limiter.Allow(ctx, Request{Key: "1", Route: "/reserve"}); !res.Allowed || res.Limit != 5 || res.Remaining != 0 {
+		t.Fatalf("expected the route bucket to be reported, got %+v", res)
+	}
+	if res = limiter.Allow(ctx, Request{Key: "1", Route: "/reserve"}); res.Allowed {
+		t.Fatalf("expected the route to be limited for key 1, got %+v", res)
+	}
+	if res = limiter.Allow(ctx, Request{Key: "2", Route: "/reserve"}); !res.Allowed {
+		t.Fatalf("expected key 2 to pass, got %+v", res)
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript is the token bucket of refill and Memory.Take run atomically inside Redis.
+// The bucket expires once it would be full again.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// Redis shares the buckets between instances. Instances should keep their clocks in sync,
+// the time of a request is the caller's.
+type Redis struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedis(client redis.Scripter, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) Take(ctx context.Context, name string, limit Limit, now time.Time) (Result, error) {
+	reply, err := takeScript.Run(ctx, r.client, []string{r.prefix + name},
+		strconv.FormatFloat(limit.Rate, 'g', -1, 64), limit.Burst, now.UnixMilli()).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(reply) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := reply[0].(int64)
+	value, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(tokens) {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	return result(limit, tokens, allowed == 1), nil
+}
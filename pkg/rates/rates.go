@@ -0,0 +1,81 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rate is the price of one unit of From in units of To.
+type Rate struct {
+	From   string
+	To     string
+	Value  float64
+	Source string
+	Date   time.Time
+}
+
+// Provider looks up exchange rates, implementations may call external services.
+type Provider interface {
+	Rate(ctx context.Context, from, to string) (Rate, error)
+}
+
+// Static serves rates from a file, so conversions work offline.
+// The file lists how many units of every currency one unit of the base currency buys:
+//
+//	{"base": "RUB", "date": "2022-11-01", "rates": {"KZT": 7.6, "BYN": 0.041}}
+type Static struct {
+	base   string
+	date   time.Time
+	rates  map[string]float64
+	source string
+}
+
+type staticFile struct {
+	Base  string             `json:"base"`
+	Date  string             `json:"date"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+func LoadStatic(path string) (*Static, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file staticFile
+	if err = json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("wrong rates file %s: %w", path, err)
+	}
+	date, err := time.Parse("2006-01-02", file.Date)
+	if err != nil {
+		return nil, fmt.Errorf("wrong rates date in %s: %w", path, err)
+	}
+	static := &Static{
+		base:   strings.ToUpper(file.Base),
+		date:   date,
+		rates:  map[string]float64{strings.ToUpper(file.Base): 1},
+		source: "file:" + path,
+	}
+	for currency, rate := range file.Rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("wrong rate %f for %s in %s", rate, currency, path)
+		}
+		static.rates[strings.ToUpper(currency)] = rate
+	}
+	return static, nil
+}
+
+func (s *Static) Rate(ctx context.Context, from, to string) (Rate, error) {
+	fromRate, ok := s.rates[from]
+	if !ok {
+		return Rate{}, fmt.Errorf("no rate for %s", from)
+	}
+	toRate, ok := s.rates[to]
+	if !ok {
+		return Rate{}, fmt.Errorf("no rate for %s", to)
+	}
+	return Rate{From: from, To: to, Value: toRate / fromRate, Source: s.source, Date: s.date}, nil
+}
@@ -0,0 +1,42 @@
+package rates
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	err := os.WriteFile(path, []byte(`{"base": "RUB", "date": "2022-11-01", "rates": {"kzt": 8, "BYN": 0.04}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := LoadStatic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		from, to string
+		want     float64
+	}{
+		{from: "RUB", to: "KZT", want: 8},
+		{from: "KZT", to: "RUB", want: 0.125},
+		{from: "BYN", to: "KZT", want: 200},
+	}
+	for _, tc := range cases {
+		rate, err := static.Rate(context.Background(), tc.from, tc.to)
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error %v", tc.from, tc.to, err)
+			continue
+		}
+		if math.Abs(rate.Value-tc.want) > 1e-9 || rate.Date.Format("2006-01-02") != "2022-11-01" {
+			t.Errorf("%s/%s: expected %f on 2022-11-01, got %+v", tc.from, tc.to, tc.want, rate)
+		}
+	}
+	if _, err = static.Rate(context.Background(), "RUB", "USD"); err == nil {
+		t.Error("expected error for an unknown currency")
+	}
+}
@@ -0,0 +1,44 @@
+package report
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// CSV writes a header line with column names followed by one line per row.
+type CSV struct {
+	Delimiter rune
+}
+
+func (CSV) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (CSV) Extension() string {
+	return "csv"
+}
+
+func (f CSV) Encode(w io.Writer, table *Table) error {
+	csvWriter := csv.NewWriter(w)
+	if f.Delimiter != 0 {
+		csvWriter.Comma = f.Delimiter
+	}
+	line := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		line[i] = column.Name
+	}
+	if err := csvWriter.Write(line); err != nil {
+		return err
+	}
+	err := table.Each(func(row []interface{}) error {
+		for i, value := range row {
+			line[i] = formatValue(value)
+		}
+		return csvWriter.Write(line)
+	})
+	if err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,73 @@
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// JSON writes {"name": ..., "columns": [...], "rows": [{column: value}, ...]}.
+// Row objects keep the column order of the table.
+type JSON struct{}
+
+func (JSON) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+func (JSON) Extension() string {
+	return "json"
+}
+
+func (JSON) Encode(w io.Writer, table *Table) error {
+	buf := bufio.NewWriter(w)
+	names := make([]string, len(table.Columns))
+	keys := make([][]byte, len(table.Columns))
+	for i, column := range table.Columns {
+		names[i] = column.Name
+		key, err := json.Marshal(column.Name)
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+	}
+	name, err := json.Marshal(table.Name)
+	if err != nil {
+		return err
+	}
+	columns, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(`{"name":`)
+	buf.Write(name)
+	buf.WriteString(`,"columns":`)
+	buf.Write(columns)
+	buf.WriteString(`,"rows":[`)
+	first := true
+	err = table.Each(func(row []interface{}) error {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.WriteByte('{')
+		for j, value := range row {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			buf.Write(keys[j])
+			buf.WriteByte(':')
+			buf.Write(encoded)
+		}
+		buf.WriteByte('}')
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	buf.WriteString("]}\n")
+	return buf.Flush()
+}
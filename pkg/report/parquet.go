@@ -0,0 +1,86 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const parquetContentType = "application/vnd.apache.parquet"
+
+// Parquet writes the table as a flat parquet file with one required column per table column.
+type Parquet struct{}
+
+func (Parquet) ContentType() string {
+	return parquetContentType
+}
+
+func (Parquet) Extension() string {
+	return "parquet"
+}
+
+func (Parquet) Encode(w io.Writer, table *Table) error {
+	metadata := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		metadata[i] = fmt.Sprintf("name=%s, %s, repetitiontype=REQUIRED", column.Name, parquetType(column.Type))
+	}
+	pw, err := writer.NewCSVWriterFromWriter(metadata, w, 1)
+	if err != nil {
+		return err
+	}
+	err = table.Each(func(row []interface{}) error {
+		values := make([]interface{}, len(row))
+		for i, value := range row {
+			var err error
+			if values[i], err = parquetValue(table.Columns[i].Type, value); err != nil {
+				return err
+			}
+		}
+		return pw.Write(values)
+	})
+	if err != nil {
+		return err
+	}
+	return pw.WriteStop()
+}
+
+func parquetType(columnType ColumnType) string {
+	switch columnType {
+	case Int:
+		return "type=INT64"
+	case Float:
+		return "type=DOUBLE"
+	case Time:
+		return "type=INT64, convertedtype=TIMESTAMP_MICROS"
+	case String:
+	}
+	return "type=BYTE_ARRAY, convertedtype=UTF8"
+}
+
+func parquetValue(columnType ColumnType, value interface{}) (interface{}, error) {
+	switch columnType {
+	case Int:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		}
+	case Float:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		}
+	case Time:
+		if v, ok := value.(time.Time); ok {
+			return v.UnixMicro(), nil
+		}
+	case String:
+		return formatValue(value), nil
+	}
+	return nil, fmt.Errorf("value %v (%T) doesn't match column type %d", value, value, columnType)
+}
@@ -0,0 +1,78 @@
+package report
+
+import (
+	"io"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const pdfContentType = "application/pdf"
+
+// PDF prints the title and the table on landscape A4 pages, repeating the header on every page.
+// The output only depends on the table, so it is byte for byte reproducible when Date is set.
+type PDF struct{}
+
+func (PDF) ContentType() string {
+	return pdfContentType
+}
+
+func (PDF) Extension() string {
+	return "pdf"
+}
+
+func (PDF) Encode(w io.Writer, table *Table) error {
+	const (
+		margin     = 10.0
+		lineHeight = 7.0
+	)
+	doc := fpdf.New("L", "mm", "A4", "")
+	doc.SetCatalogSort(true)
+	if !table.Date.IsZero() {
+		doc.SetCreationDate(table.Date)
+		doc.SetModificationDate(table.Date)
+	}
+	doc.SetMargins(margin, margin, margin)
+	doc.SetAutoPageBreak(true, margin)
+	title := table.Title
+	if title == "" {
+		title = table.Name
+	}
+	doc.SetTitle(title, false)
+
+	pageWidth, _ := doc.GetPageSize()
+	cellWidth := (pageWidth - 2*margin) / float64(len(table.Columns))
+	header := func() {
+		doc.SetFont("Helvetica", "B", 9)
+		doc.SetFillColor(230, 230, 230)
+		for _, column := range table.Columns {
+			doc.CellFormat(cellWidth, lineHeight, column.Name, "1", 0, "C", true, 0, "")
+		}
+		doc.Ln(-1)
+		doc.SetFont("Helvetica", "", 9)
+	}
+
+	doc.AddPage()
+	doc.SetFont("Helvetica", "B", 12)
+	doc.CellFormat(0, 10, title, "", 1, "L", false, 0, "")
+	header()
+	doc.SetHeaderFunc(func() {
+		if doc.PageNo() > 1 {
+			header()
+		}
+	})
+	err := table.Each(func(row []interface{}) error {
+		for i, value := range row {
+			align := "L"
+			if table.Columns[i].Type == Int || table.Columns[i].Type == Float {
+				align = "R"
+			}
+			doc.CellFormat(cellWidth, lineHeight, formatValue(value), "1", 0, align, false, 0, "")
+		}
+		doc.Ln(-1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return doc.Output(w)
+}
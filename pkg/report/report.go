@@ -0,0 +1,198 @@
+package report
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type ColumnType int
+
+const (
+	String ColumnType = iota
+	Int
+	Float
+	Time
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Table is the tabular model shared by all reports. Every row holds one value per column:
+// string, int, int64, float64 or time.Time according to the column type.
+// Small reports keep their rows in Rows, large ones read them from Stream while they are encoded.
+type Table struct {
+	Name string
+	// Title is printed above the table by the document formats, Name is used when it is empty.
+	Title string
+	// Date is the moment the data is valid for, the document formats use it as the creation date.
+	Date    time.Time
+	Columns []Column
+	Rows    [][]interface{}
+	// Stream yields the rows after Rows, the table must be closed when it is set.
+	Stream RowIterator
+}
+
+// RowIterator yields rows one by one, Next returns io.EOF after the last one.
+type RowIterator interface {
+	Next() ([]interface{}, error)
+	Close() error
+}
+
+// Each calls fn for every row of the table in order, the streamed rows are read only once.
+func (t *Table) Each(fn func(row []interface{}) error) error {
+	for _, row := range t.Rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if t.Stream == nil {
+		return nil
+	}
+	for {
+		row, err := t.Stream.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// Close releases the stream of the table, if it has one.
+func (t *Table) Close() error {
+	if t.Stream == nil {
+		return nil
+	}
+	return t.Stream.Close()
+}
+
+// Format encodes a table into one of the supported output formats.
+type Format interface {
+	ContentType() string
+	Extension() string
+	Encode(w io.Writer, table *Table) error
+}
+
+// ErrNotAcceptable means the Accept header lists none of the supported formats.
+var ErrNotAcceptable = errors.New("none of the accepted formats is supported")
+
+// Negotiate picks the output format from the explicit format name (?format=) or, when it is empty,
+// from the Accept header, the supported type with the highest q-value wins and q=0 excludes a type.
+// The fallback is used when neither asks for anything specific, ErrNotAcceptable when Accept
+// lists only unsupported types. delimiter configures the CSV separator and may be empty, a single character or "tab".
+func Negotiate(format, accept, delimiter string, fallback Format) (Format, error) {
+	comma, err := parseDelimiter(delimiter)
+	if err != nil {
+		return nil, err
+	}
+	if csvFormat, ok := fallback.(CSV); ok && delimiter != "" {
+		csvFormat.Delimiter = comma
+		fallback = csvFormat
+	}
+	if format != "" {
+		switch strings.ToLower(format) {
+		case "csv":
+			return CSV{Delimiter: comma}, nil
+		case "json":
+			return JSON{}, nil
+		case "xlsx":
+			return XLSX{}, nil
+		case "parquet":
+			return Parquet{}, nil
+		case "pdf":
+			return PDF{}, nil
+		}
+		return nil, fmt.Errorf("unknown report format %q", format)
+	}
+	if strings.TrimSpace(accept) == "" {
+		return fallback, nil
+	}
+	for _, mediaType := range acceptedTypes(accept) {
+		switch mediaType {
+		case "text/csv", "text/*":
+			return CSV{Delimiter: comma}, nil
+		case "application/json", "application/*":
+			return JSON{}, nil
+		case xlsxContentType:
+			return XLSX{}, nil
+		case parquetContentType, "application/x-parquet":
+			return Parquet{}, nil
+		case pdfContentType:
+			return PDF{}, nil
+		case "*/*":
+			return fallback, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotAcceptable, accept)
+}
+
+// acceptedTypes lists the media types of an Accept header from the most to the least preferred,
+// types with equal q-values keep their order and the ones with q=0 or a broken q are left out.
+func acceptedTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		q         float64
+	}
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if q > 0 {
+			types = append(types, accepted{mediaType, q})
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].q > types[j].q })
+	mediaTypes := make([]string, len(types))
+	for i, t := range types {
+		mediaTypes[i] = t.mediaType
+	}
+	return mediaTypes
+}
+
+func parseDelimiter(delimiter string) (rune, error) {
+	switch delimiter {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	comma, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+		return 0, fmt.Errorf("wrong csv delimiter %q", delimiter)
+	}
+	return comma, nil
+}
+
+// formatValue renders a cell for the text based formats.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
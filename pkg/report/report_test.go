@@ -0,0 +1,209 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xuri/excelize/v2"
+)
+
+func testTable() *Table {
+	return &Table{
+		Name: "revenue",
+		Columns: []Column{
+			{Name: "service_id", Type: Int},
+			{Name: "revenue", Type: Float},
+			{Name: "segment", Type: String},
+			{Name: "date", Type: Time},
+		},
+		Rows: [][]interface{}{
+			{30, 10000.5, "b2b", time.Date(2022, 11, 3, 14, 0, 0, 0, time.UTC)},
+			{1, 10.0, "semi;colon", time.Date(2022, 11, 4, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		format, accept, delimiter string
+		want                      Format
+		wantErr                   bool
+	}{
+		{want: CSV{}},
+		{accept: "*/*", want: CSV{}},
+		{format: "json", accept: "text/csv", want: JSON{}},
+		{format: "CSV", delimiter: ";", want: CSV{Delimiter: ';'}},
+		{delimiter: "tab", want: CSV{Delimiter: '\t'}},
+		{accept: "application/x-parquet", want: Parquet{}},
+		{accept: "text/html, " + xlsxContentType + ";q=0.9", want: XLSX{}},
+		{accept: "application/json; charset=utf-8", want: JSON{}},
+		{format: "pdf", want: PDF{}},
+		{accept: "application/pdf", want: PDF{}},
+		{accept: "text/csv;q=0.5, application/json", want: JSON{}},
+		{accept: "application/json;q=0, text/csv;q=0.1", want: CSV{Delimiter: ','}},
+		{accept: "text/html, text/*;q=0.8", want: CSV{Delimiter: ','}},
+		{accept: "application/json;q=2, application/pdf;q=0.3", want: PDF{}},
+		{format: "docx", wantErr: true},
+		{accept: "text/html", wantErr: true},
+		{accept: "application/json;q=0", wantErr: true},
+		{format: "csv", delimiter: `""`, wantErr: true},
+		{format: "csv", delimiter: `"`, wantErr: true},
+	}
+	for i, tc := range cases {
+		got, err := Negotiate(tc.format, tc.accept, tc.delimiter, CSV{})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("#%d: expected error, got %#v", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error %v", i, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("#%d: expected %#v, got %#v", i, tc.want, got)
+		}
+	}
+}
+
+func TestNegotiateNotAcceptable(t *testing.T) {
+	if _, err := Negotiate("", "text/html, image/png;q=0.5", "", CSV{}); !errors.Is(err, ErrNotAcceptable) {
+		t.Errorf("expected ErrNotAcceptable, got %v", err)
+	}
+	if _, err := Negotiate("docx", "", "", CSV{}); errors.Is(err, ErrNotAcceptable) {
+		t.Error("an unknown format name isn't a negotiation failure")
+	}
+}
+
+// sliceRows streams rows from memory and remembers whether it was closed.
+type sliceRows struct {
+	rows   [][]interface{}
+	closed bool
+}
+
+func (s *sliceRows) Next() ([]interface{}, error) {
+	if len(s.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row, nil
+}
+
+func (s *sliceRows) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStreamedTable(t *testing.T) {
+	table := testTable()
+	stream := &sliceRows{rows: table.Rows[1:]}
+	table.Rows, table.Stream = table.Rows[:1], stream
+
+	var buf bytes.Buffer
+	if err := (CSV{Delimiter: ';'}).Encode(&buf, table); err != nil {
+		t.Fatal(err)
+	}
+	want := "service_id;revenue;segment;date\n" +
+		"30;10000.5;b2b;2022-11-03T14:00:00Z\n" +
+		"1;10;\"semi;colon\";2022-11-04T00:00:00Z\n"
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+	if err := table.Close(); err != nil || !stream.closed {
+		t.Errorf("stream wasn't closed: %v", err)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (CSV{Delimiter: ';'}).Encode(&buf, testTable()); err != nil {
+		t.Fatal(err)
+	}
+	want := "service_id;revenue;segment;date\n" +
+		"30;10000.5;b2b;2022-11-03T14:00:00Z\n" +
+		"1;10;\"semi;colon\";2022-11-04T00:00:00Z\n"
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (JSON{}).Encode(&buf, testTable()); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"revenue","columns":["service_id","revenue","segment","date"],"rows":[` +
+		`{"service_id":30,"revenue":10000.5,"segment":"b2b","date":"2022-11-03T14:00:00Z"},` +
+		`{"service_id":1,"revenue":10,"segment":"semi;colon","date":"2022-11-04T00:00:00Z"}]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Error("invalid json")
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (XLSX{}).Encode(&buf, testTable()); err != nil {
+		t.Fatal(err)
+	}
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows(f.GetSheetName(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[0][0] != "service_id" || rows[1][0] != "30" || rows[2][2] != "semi;colon" {
+		t.Errorf("unexpected sheet content %v", rows)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (Parquet{}).Encode(&buf, testTable()); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := buffer.NewBufferFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetReader(pf, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if pr.GetNumRows() != 2 {
+		t.Fatalf("expected 2 rows, got %d", pr.GetNumRows())
+	}
+	rows, err := pr.ReadByNumber(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`[{"Service_id":30,"Revenue":10000.5,"Segment":"b2b","Date":%d},`+
+		`{"Service_id":1,"Revenue":10,"Segment":"semi;colon","Date":%d}]`,
+		time.Date(2022, 11, 3, 14, 0, 0, 0, time.UTC).UnixMicro(),
+		time.Date(2022, 11, 4, 0, 0, 0, 0, time.UTC).UnixMicro())
+	if string(encoded) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, encoded)
+	}
+}
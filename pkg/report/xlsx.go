@@ -0,0 +1,53 @@
+package report
+
+import (
+	"io"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// XLSX writes the table into the first sheet of a workbook, column names in the first row.
+type XLSX struct{}
+
+func (XLSX) ContentType() string {
+	return xlsxContentType
+}
+
+func (XLSX) Extension() string {
+	return "xlsx"
+}
+
+func (XLSX) Encode(w io.Writer, table *Table) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	stream, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	header := make([]interface{}, len(table.Columns))
+	for i, column := range table.Columns {
+		header[i] = column.Name
+	}
+	if err = stream.SetRow("A1", header); err != nil {
+		return err
+	}
+	line := 2
+	err = table.Each(func(row []interface{}) error {
+		cell, err := excelize.CoordinatesToCellName(1, line)
+		if err != nil {
+			return err
+		}
+		line++
+		return stream.SetRow(cell, row)
+	})
+	if err != nil {
+		return err
+	}
+	if err = stream.Flush(); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
@@ -0,0 +1,230 @@
+// Package risk evaluates money movements against configured rules and decides whether they may run,
+// must be refused or have to wait for a human review.
+package risk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Decisions, from the mildest to the most severe.
+const (
+	Allow  = "allow"
+	Review = "review"
+	Deny   = "deny"
+)
+
+// Operations the rules can be applied to, named like the ledger operations.
+const (
+	OpCredit   = "credit"
+	OpReserve  = "reserve"
+	OpTransfer = "transfer"
+)
+
+// Rule types.
+const (
+	// Threshold matches operations of at least Amount.
+	Threshold = "threshold"
+	// Velocity matches when the user already made Count matching operations within Window.
+	Velocity = "velocity"
+	// Sequence matches an operation that comes within Window after an After operation of at least Amount,
+	// like spending a large credit right away.
+	Sequence = "sequence"
+	// Blocklist matches operations of the listed users, services or client IPs, transfers to the listed users too.
+	Blocklist = "blocklist"
+)
+
+var severity = map[string]int{Allow: 0, Review: 1, Deny: 2}
+
+// Rule is one check declared in the rules file. Empty Operations means every operation.
+type Rule struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Operations []string `json:"operations,omitempty"`
+	Action     string   `json:"action"`
+	Amount     float64  `json:"amount,omitempty"`
+	Count      int      `json:"count,omitempty"`
+	Window     string   `json:"window,omitempty"`
+	After      string   `json:"after,omitempty"`
+	Users      []int    `json:"users,omitempty"`
+	Services   []int    `json:"services,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+
+	window time.Duration
+}
+
+// Operation is a money movement about to happen. ToUserID is the receiver of a transfer,
+// Voucher the code a credit or reserve is paid with, Pending marks a credit that waits to be settled.
+type Operation struct {
+	Type      string  `json:"type"`
+	UserID    int     `json:"user_id"`
+	ToUserID  int     `json:"to_user_id,omitempty"`
+	ServiceID int     `json:"service_id,omitempty"`
+	OrderID   int     `json:"order_id,omitempty"`
+	Currency  string  `json:"currency"`
+	Amount    float64 `json:"amount"`
+	Voucher   string  `json:"voucher,omitempty"`
+	Pending   bool    `json:"pending,omitempty"`
+	IP        string  `json:"-"`
+}
+
+// Verdict is the decision on an operation with the rule that made it, Rule is empty for Allow.
+type Verdict struct {
+	Decision string `json:"decision"`
+	Rule     string `json:"rule,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// History answers what the user did recently: how many operations of the given types there were
+// since since, and the largest amount among them.
+type History interface {
+	RecentOperations(ctx context.Context, userID int, operations []string, since time.Time) (int, float64, error)
+}
+
+// Engine applies the rules in order and keeps the most severe verdict.
+type Engine struct {
+	rules []Rule
+}
+
+// New validates the rules.
+func New(rules []Rule) (*Engine, error) {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{rules: rules}, nil
+}
+
+// Load reads a JSON array of rules from the file at path.
+func Load(path string) (*Engine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("risk rules %s: %w", path, err)
+	}
+	return New(rules)
+}
+
+func (rule *Rule) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("risk rule without a name")
+	}
+	if rule.Action != Review && rule.Action != Deny {
+		return fmt.Errorf("risk rule %s: action must be %s or %s", rule.Name, Review, Deny)
+	}
+	if rule.Window != "" {
+		window, err := time.ParseDuration(rule.Window)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("risk rule %s: bad window %q", rule.Name, rule.Window)
+		}
+		rule.window = window
+	}
+	switch rule.Type {
+	case Threshold:
+		if rule.Amount <= 0 {
+			return fmt.Errorf("risk rule %s: threshold needs a positive amount", rule.Name)
+		}
+	case Velocity:
+		if rule.Count < 1 || rule.window == 0 {
+			return fmt.Errorf("risk rule %s: velocity needs a count and a window", rule.Name)
+		}
+	case Sequence:
+		if rule.After == "" || rule.window == 0 {
+			return fmt.Errorf("risk rule %s: sequence needs an after operation and a window", rule.Name)
+		}
+	case Blocklist:
+		if len(rule.Users) == 0 && len(rule.Services) == 0 && len(rule.IPs) == 0 {
+			return fmt.Errorf("risk rule %s: blocklist is empty", rule.Name)
+		}
+	default:
+		return fmt.Errorf("risk rule %s: unknown type %q", rule.Name, rule.Type)
+	}
+	return nil
+}
+
+// Evaluate decides on op. History is only queried by velocity and sequence rules that apply to op.
+func (e *Engine) Evaluate(ctx context.Context, op Operation, history History, now time.Time) (Verdict, error) {
+	verdict := Verdict{Decision: Allow}
+	for _, rule := range e.rules {
+		if !rule.applies(op) || severity[rule.Action] <= severity[verdict.Decision] {
+			continue
+		}
+		reason, err := rule.match(ctx, op, history, now)
+		if err != nil {
+			return Verdict{}, err
+		}
+		if reason != "" {
+			verdict = Verdict{Decision: rule.Action, Rule: rule.Name, Reason: reason}
+		}
+	}
+	return verdict, nil
+}
+
+func (rule Rule) applies(op Operation) bool {
+	if len(rule.Operations) == 0 {
+		return true
+	}
+	for _, operation := range rule.Operations {
+		if operation == op.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// match explains why the rule matches op, or returns an empty string.
+func (rule Rule) match(ctx context.Context, op Operation, history History, now time.Time) (string, error) {
+	switch rule.Type {
+	case Threshold:
+		if op.Amount >= rule.Amount {
+			return fmt.Sprintf("%s of %.2f is at least %.2f", op.Type, op.Amount, rule.Amount), nil
+		}
+	case Velocity:
+		operations := rule.Operations
+		if len(operations) == 0 {
+			operations = []string{op.Type}
+		}
+		count, _, err := history.RecentOperations(ctx, op.UserID, operations, now.Add(-rule.window))
+		if err != nil {
+			return "", err
+		}
+		if count >= rule.Count {
+			return fmt.Sprintf("%d operations within %s", count+1, rule.window), nil
+		}
+	case Sequence:
+		count, largest, err := history.RecentOperations(ctx, op.UserID, []string{rule.After}, now.Add(-rule.window))
+		if err != nil {
+			return "", err
+		}
+		if count > 0 && largest >= rule.Amount {
+			return fmt.Sprintf("%s within %s after a %s of %.2f", op.Type, rule.window, rule.After, largest), nil
+		}
+	case Blocklist:
+		for _, user := range rule.Users {
+			if user == op.UserID {
+				return fmt.Sprintf("user %d is blocklisted", op.UserID), nil
+			}
+			if user == op.ToUserID && op.ToUserID != 0 {
+				return fmt.Sprintf("receiver %d is blocklisted", op.ToUserID), nil
+			}
+		}
+		for _, service := range rule.Services {
+			if service == op.ServiceID && op.ServiceID != 0 {
+				return fmt.Sprintf("service %d is blocklisted", op.ServiceID), nil
+			}
+		}
+		for _, ip := range rule.IPs {
+			if ip == op.IP && op.IP != "" {
+				return fmt.Sprintf("IP %s is blocklisted", op.IP), nil
+			}
+		}
+	}
+	return "", nil
+}
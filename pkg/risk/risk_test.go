@@ -0,0 +1,105 @@
+package risk
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// history answers from a fixed list of past operations.
+type history []struct {
+	op     string
+	amount float64
+	at     time.Time
+}
+
+func (h history) RecentOperations(_ context.Context, _ int, operations []string, since time.Time) (int, float64, error) {
+	count, largest := 0, 0.0
+	for _, past := range h {
+		for _, op := range operations {
+			if past.op == op && !past.at.Before(since) {
+				count++
+				if past.amount > largest {
+					largest = past.amount
+				}
+			}
+		}
+	}
+	return count, largest, nil
+}
+
+func TestEvaluate(t *testing.T) {
+	engine, err := New([]Rule{
+		{Name: "large-credit", Type: Threshold, Operations: []string{OpCredit}, Amount: 100000, Action: Review},
+		{Name: "reserve-burst", Type: Velocity, Operations: []string{OpReserve}, Count: 3, Window: "10s", Action: Review},
+		{Name: "spend-after-credit", Type: Sequence, Operations: []string{OpReserve}, After: OpCredit, Amount: 50000,
+			Window: "5m", Action: Review},
+		{Name: "transfer-after-credit", Type: Sequence, Operations: []string{OpTransfer}, After: OpCredit, Amount: 50000,
+			Window: "1h", Action: Deny},
+		{Name: "blocked", Type: Blocklist, Users: []int{13}, IPs: []string{"10.0.0.66"}, Action: Deny},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	reserves := history{
+		{OpReserve, 10, now.Add(-9 * time.Second)},
+		{OpReserve, 10, now.Add(-5 * time.Second)},
+		{OpReserve, 10, now.Add(-time.Second)},
+	}
+	bigCredit := history{{OpCredit, 60000, now.Add(-time.Minute)}}
+	cases := []struct {
+		name     string
+		op       Operation
+		history  history
+		decision string
+		rule     string
+	}{
+		{"small credit", Operation{Type: OpCredit, UserID: 1, Amount: 500}, nil, Allow, ""},
+		{"large credit", Operation{Type: OpCredit, UserID: 1, Amount: 150000}, nil, Review, "large-credit"},
+		{"large reserve isn't a credit", Operation{Type: OpReserve, UserID: 1, Amount: 150000}, nil, Allow, ""},
+		{"reserve burst", Operation{Type: OpReserve, UserID: 1, Amount: 10}, reserves, Review, "reserve-burst"},
+		{"slow reserves", Operation{Type: OpReserve, UserID: 1, Amount: 10}, reserves[:2], Allow, ""},
+		{"spend right after a big credit", Operation{Type: OpReserve, UserID: 1, Amount: 55000}, bigCredit, Review, "spend-after-credit"},
+		{"blocklisted user", Operation{Type: OpCredit, UserID: 13, Amount: 150000}, nil, Deny, "blocked"},
+		{"blocklisted IP", Operation{Type: OpReserve, UserID: 1, Amount: 10, IP: "10.0.0.66"}, reserves, Deny, "blocked"},
+		{"transfer right after a big credit", Operation{Type: OpTransfer, UserID: 1, ToUserID: 2, Amount: 100}, bigCredit,
+			Deny, "transfer-after-credit"},
+		{"transfer without a big credit", Operation{Type: OpTransfer, UserID: 1, ToUserID: 2, Amount: 100}, reserves, Allow, ""},
+		{"transfer to a blocklisted user", Operation{Type: OpTransfer, UserID: 1, ToUserID: 13, Amount: 10}, nil, Deny, "blocked"},
+	}
+	for _, tc := range cases {
+		verdict, err := engine.Evaluate(context.Background(), tc.op, tc.history, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Decision != tc.decision || verdict.Rule != tc.rule {
+			t.Errorf("%s: expected %s by %q, got %+v", tc.name, tc.decision, tc.rule, verdict)
+		}
+		if tc.decision != Allow && verdict.Reason == "" {
+			t.Errorf("%s: verdict without a reason", tc.name)
+		}
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	cases := []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Type: Threshold, Amount: 1, Action: Review}, "without a name"},
+		{Rule{Name: "r", Type: Threshold, Amount: 1, Action: Allow}, "action"},
+		{Rule{Name: "r", Type: Threshold, Action: Deny}, "positive amount"},
+		{Rule{Name: "r", Type: Velocity, Count: 5, Action: Deny}, "count and a window"},
+		{Rule{Name: "r", Type: Velocity, Count: 5, Window: "soon", Action: Deny}, "bad window"},
+		{Rule{Name: "r", Type: Sequence, Window: "1m", Action: Review}, "after operation"},
+		{Rule{Name: "r", Type: Blocklist, Action: Deny}, "empty"},
+		{Rule{Name: "r", Type: "geo", Action: Deny}, "unknown type"},
+	}
+	for _, tc := range cases {
+		if _, err := New([]Rule{tc.rule}); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: expected an error about %q, got %v", tc.rule, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+)
+
+// Hold is money reserved for an order that is neither captured nor cancelled yet.
+type Hold struct {
+	OrderID   int        `json:"order_id"`
+	ServiceID int        `json:"service_id"`
+	Amount    float64    `json:"amount"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// PendingCredit is money announced for the user that is not on the balance until settled.
+type PendingCredit struct {
+	ID        int64     `json:"id"`
+	Amount    float64   `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Account struct {
+	Currency string `json:"currency"`
+	// Balance is the available amount, kept for clients of the original response.
+	Balance        float64         `json:"balance"`
+	Total          float64         `json:"total"`
+	Held           float64         `json:"held"`
+	Available      float64         `json:"available"`
+	Holds          []Hold          `json:"holds"`
+	CreditLimit    float64         `json:"credit_limit,omitempty"`
+	Debt           float64         `json:"debt,omitempty"`
+	Bonus          float64         `json:"bonus,omitempty"`
+	Pending        *float64        `json:"pending,omitempty"`
+	PendingCredits []PendingCredit `json:"pending_credits,omitempty"`
+}
+
+// CheckAccount returns the total, held and available amounts with the open holds,
+// and the pending credits when includePending is set.
+func (billDB *BillingDB) CheckAccount(ctx context.Context, userID int, currency string, includePending bool) (Account, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return Account{}, err
+	}
+	account := Account{Currency: currency}
+	err = billDB.DB.QueryRowContext(ctx, `select balance, reserved, credit_limit, debt, `+bonusBalance+` from Users
+		where id = $1 and currency = $2;`, userID, currency).
+		Scan(&account.Total, &account.Held, &account.CreditLimit, &account.Debt, &account.Bonus)
+	if err != nil {
+		return Account{}, err
+	}
+	account.Available = account.Total - account.Held
+	account.Balance = account.Available
+
+	rows, err := billDB.DB.QueryContext(ctx, `
+		select order_id, service_id, cost - bonus, date, expires_at from Transactions
+		where user_id = $1 and currency = $2 and order_status = 'reserved'
+		order by date, order_id;`, userID, currency)
+	if err != nil {
+		return Account{}, err
+	}
+	defer rows.Close()
+	account.Holds = []Hold{}
+	for rows.Next() {
+		var hold Hold
+		var expiresAt sql.NullTime
+		if err = rows.Scan(&hold.OrderID, &hold.ServiceID, &hold.Amount, &hold.CreatedAt, &expiresAt); err != nil {
+			return Account{}, err
+		}
+		if expiresAt.Valid {
+			hold.ExpiresAt = &expiresAt.Time
+		}
+		account.Holds = append(account.Holds, hold)
+	}
+	if err = rows.Err(); err != nil {
+		return Account{}, err
+	}
+	if !includePending {
+		return account, nil
+	}
+
+	pending, err := billDB.pendingCredits(ctx, userID, currency)
+	if err != nil {
+		return Account{}, err
+	}
+	var sum float64
+	for _, credit := range pending {
+		sum += credit.Amount
+	}
+	account.Pending = &sum
+	account.PendingCredits = pending
+	return account, nil
+}
+
+func (billDB *BillingDB) pendingCredits(ctx context.Context, userID int, currency string) ([]PendingCredit, error) {
+	rows, err := billDB.DB.QueryContext(ctx, `
+		select id, amount, created_at from Credits
+		where user_id = $1 and currency = $2 and status = 'pending'
+		order by created_at, id;`, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pending := []PendingCredit{}
+	for rows.Next() {
+		var credit PendingCredit
+		if err = rows.Scan(&credit.ID, &credit.Amount, &credit.CreatedAt); err != nil {
+			return nil, err
+		}
+		pending = append(pending, credit)
+	}
+	return pending, rows.Err()
+}
+
+// AddPendingCredit registers a credit that only reaches the balance when SettleCredit is called.
+// The risk rules see it here, as a credit; a held one is registered once the review is approved.
+func (billDB *BillingDB) AddPendingCredit(ctx context.Context, userID int, currency string, price float64) (int64, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpCredit)
+	defer cancel()
+
+	if err := checkPrice(price); err != nil {
+		return 0, err
+	}
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return 0, err
+	}
+	err = billDB.assess(ctx, risk.Operation{Type: risk.OpCredit, UserID: userID, Currency: currency, Amount: price, Pending: true})
+	if err != nil {
+		return 0, err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := addPendingCredit(ctx, tx, userID, currency, price)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func addPendingCredit(ctx context.Context, tx *sql.Tx, userID int, currency string, price float64) (int64, error) {
+	if err := checkStatus(ctx, tx, userID, OpCredit, false); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `insert into Credits (user_id, currency, amount, status, created_at)
+		values ($1, $2, $3, 'pending', $4) returning id;`, userID, currency, price, time.Now().UTC()).Scan(&id)
+	return id, err
+}
+
+// SettleCredit moves a pending credit onto the user's balance.
+func (billDB *BillingDB) SettleCredit(ctx context.Context, creditID int64) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpCredit)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var currency, status string
+	var amount float64
+	err = tx.QueryRowContext(ctx, `select user_id, currency, amount, status from Credits where id = $1 for update;`, creditID).
+		Scan(&userID, &currency, &amount, &status)
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return fmt.Errorf("%w. Credit %d is already %s", ErrWrongOperation, creditID, status)
+	}
+	_, err = tx.ExecContext(ctx, `update Credits set status = 'settled', settled_at = $2 where id = $1;`, creditID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if err = creditUser(ctx, tx, userID, currency, amount); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RejectCredit drops a pending credit that won't arrive, the balance is left as it is.
+// It is allowed whatever the account status, so a credit stuck in pending doesn't keep the account from closing.
+func (billDB *BillingDB) RejectCredit(ctx context.Context, creditID int64) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpCredit)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `select status from Credits where id = $1 for update;`, creditID).Scan(&status)
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return fmt.Errorf("%w. Credit %d is already %s", ErrWrongOperation, creditID, status)
+	}
+	_, err = tx.ExecContext(ctx, `update Credits set status = 'rejected', rejected_at = $2 where id = $1;`, creditID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
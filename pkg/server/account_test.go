@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectCredit(t *testing.T) {
+	cases := []struct {
+		status string
+		err    error
+	}{
+		{"pending", nil},
+		{"settled", ErrWrongOperation},
+		{"rejected", ErrWrongOperation},
+	}
+	for _, tc := range cases {
+		fake, db := newFakeDB("")
+		fake.rows = map[string][]driver.Value{
+			"select status from Credits": {tc.status},
+		}
+		billDB := BillingDB{DB: db}
+		err := billDB.RejectCredit(context.Background(), 3)
+		db.Close()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.status, tc.err, err)
+			continue
+		}
+		var rejected bool
+		for _, statement := range fake.statements() {
+			rejected = rejected || strings.Contains(statement, "set status = 'rejected'")
+			if strings.Contains(statement, "update Users") || strings.Contains(statement, "insert into Ledger") {
+				t.Errorf("%s: rejecting touched the balance: %q", tc.status, statement)
+			}
+		}
+		if rejected != (tc.err == nil) {
+			t.Errorf("%s: unexpected statements %q", tc.status, fake.statements())
+		}
+	}
+}
+
+func TestExpireReserves(t *testing.T) {
+	now := time.Date(2022, 11, 3, 14, 0, 0, 0, time.UTC)
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.results = map[string][][]driver.Value{
+		"order by expires_at limit 100": {{int64(1), int64(2), int64(5), "RUB"}},
+	}
+	fake.rows = map[string][]driver.Value{
+		"and expires_at <= $5": {40.0, 0.0, 0.0},
+	}
+	billDB := BillingDB{DB: db}
+	expired, err := billDB.ExpireReserves(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 1 {
+		t.Errorf("expected one reserve to expire, got %d", expired)
+	}
+	var released, logged bool
+	for _, statement := range fake.statements() {
+		released = released || strings.Contains(statement, "order_status = 'expired'")
+		logged = logged || strings.Contains(statement, "insert into Ledger")
+	}
+	if !released || !logged {
+		t.Errorf("reserve wasn't released: %q", fake.statements())
+	}
+	// order 5 of another service stays reserved
+	if args := fake.argsOf("order_status = 'expired'"); len(args) != 4 || args[2] != int64(2) {
+		t.Errorf("expected only the order of service 2 to expire, got %v", args)
+	}
+}
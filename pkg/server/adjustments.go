@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Adjustment types in requests, a debit is stored with a negative amount.
+const (
+	AdjustmentCredit = "credit"
+	AdjustmentDebit  = "debit"
+)
+
+// Adjustment statuses.
+const (
+	AdjustmentPending  = "pending"
+	AdjustmentPosted   = "posted"
+	AdjustmentRejected = "rejected"
+)
+
+// Adjustment is a manual correction of a balance by support. Amount is positive for a credit and
+// negative for a debit. Adjustments above BillingDB.AdjustmentThreshold wait for a second admin.
+type Adjustment struct {
+	ID        int64      `json:"id"`
+	UserID    int        `json:"user_id"`
+	Currency  string     `json:"currency"`
+	Amount    float64    `json:"amount"`
+	Reason    string     `json:"reason"`
+	Ticket    string     `json:"ticket"`
+	Status    string     `json:"status"`
+	CreatedBy string     `json:"created_by"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+}
+
+func (adj Adjustment) Validate() error {
+	if adj.Amount == 0 || math.IsNaN(adj.Amount) || math.IsInf(adj.Amount, 0) {
+		return fmt.Errorf("%w. Adjustment needs a non-zero amount", ErrInvalidAmount)
+	}
+	if strings.TrimSpace(adj.Reason) == "" || strings.TrimSpace(adj.Ticket) == "" {
+		return fmt.Errorf("%w. Adjustment needs a reason and a ticket reference", ErrWrongOperation)
+	}
+	return nil
+}
+
+const adjustmentColumns = `id, user_id, currency, amount, reason, ticket, status, created_by, coalesce(decided_by, ''), created_at, decided_at`
+
+func scanAdjustment(row interface{ Scan(...interface{}) error }) (Adjustment, error) {
+	var adj Adjustment
+	err := row.Scan(&adj.ID, &adj.UserID, &adj.Currency, &adj.Amount, &adj.Reason, &adj.Ticket, &adj.Status,
+		&adj.CreatedBy, &adj.DecidedBy, &adj.CreatedAt, &adj.DecidedAt)
+	return adj, err
+}
+
+// CreateAdjustment records an adjustment by the caller of ctx and posts it right away
+// unless it is above the approval threshold.
+func (billDB *BillingDB) CreateAdjustment(ctx context.Context, adj Adjustment) (Adjustment, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpAdjustment)
+	defer cancel()
+
+	if err := adj.Validate(); err != nil {
+		return Adjustment{}, err
+	}
+	currency, err := billDB.Currency(adj.Currency)
+	if err != nil {
+		return Adjustment{}, err
+	}
+	adj.Currency = currency
+	adj.Amount = money(adj.Amount)
+	adj.CreatedBy = auditInfo(ctx).Actor
+	adj.CreatedAt = time.Now().UTC()
+	adj.Status = AdjustmentPending
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Adjustment{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `insert into Adjustments (user_id, currency, amount, reason, ticket, status, created_by, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id;`,
+		adj.UserID, adj.Currency, adj.Amount, adj.Reason, adj.Ticket, adj.Status, adj.CreatedBy, adj.CreatedAt).Scan(&adj.ID)
+	if err != nil {
+		return Adjustment{}, err
+	}
+	if math.Abs(adj.Amount) <= billDB.AdjustmentThreshold {
+		if adj, err = decideAdjustment(ctx, tx, adj, AdjustmentPosted, adj.CreatedBy); err != nil {
+			return Adjustment{}, err
+		}
+	}
+	return adj, tx.Commit()
+}
+
+// ApproveAdjustment posts a pending adjustment, the caller of ctx must not be the admin who created it.
+func (billDB *BillingDB) ApproveAdjustment(ctx context.Context, id int64) (Adjustment, error) {
+	return billDB.decide(ctx, id, AdjustmentPosted)
+}
+
+// RejectAdjustment drops a pending adjustment without touching the balance.
+func (billDB *BillingDB) RejectAdjustment(ctx context.Context, id int64) (Adjustment, error) {
+	return billDB.decide(ctx, id, AdjustmentRejected)
+}
+
+func (billDB *BillingDB) decide(ctx context.Context, id int64, status string) (Adjustment, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpAdjustment)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Adjustment{}, err
+	}
+	defer tx.Rollback()
+
+	adj, err := scanAdjustment(tx.QueryRowContext(ctx, `select `+adjustmentColumns+` from Adjustments where id = $1 for update;`, id))
+	if err != nil {
+		return Adjustment{}, err
+	}
+	if adj.Status != AdjustmentPending {
+		return Adjustment{}, fmt.Errorf("%w. Adjustment %d is already %s", ErrWrongOperation, id, adj.Status)
+	}
+	actor := auditInfo(ctx).Actor
+	if status == AdjustmentPosted && actor == adj.CreatedBy {
+		return Adjustment{}, fmt.Errorf("%w. Adjustment %d must be approved by another admin than %s", ErrWrongOperation, id, actor)
+	}
+	if adj, err = decideAdjustment(ctx, tx, adj, status, actor); err != nil {
+		return Adjustment{}, err
+	}
+	return adj, tx.Commit()
+}
+
+// decideAdjustment stores the decision and, for a posted adjustment, changes the balance.
+func decideAdjustment(ctx context.Context, tx *sql.Tx, adj Adjustment, status, actor string) (Adjustment, error) {
+	now := time.Now().UTC()
+	adj.Status, adj.DecidedBy, adj.DecidedAt = status, actor, &now
+	_, err := tx.ExecContext(ctx, `update Adjustments set status = $2, decided_by = $3, decided_at = $4 where id = $1;`,
+		adj.ID, adj.Status, adj.DecidedBy, now)
+	if err != nil {
+		return Adjustment{}, err
+	}
+	if status == AdjustmentPosted {
+		err = postAdjustment(ctx, tx, adj, now)
+	}
+	return adj, err
+}
+
+// postAdjustment moves the balance and records the adjustment in the user's history. A debit can't take
+// money that is reserved or missing.
+func postAdjustment(ctx context.Context, tx *sql.Tx, adj Adjustment, now time.Time) error {
+	if err := checkStatus(ctx, tx, adj.UserID, OpAdjustment, adj.Amount < 0); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `insert into Users (id, currency, balance, reserved) values ($1, $2, 0, 0)
+		on conflict (id, currency) do nothing;`, adj.UserID, adj.Currency)
+	if err != nil {
+		return err
+	}
+	usersBalance, usersReserve, err := lockUser(ctx, tx, adj.UserID, adj.Currency)
+	if err != nil {
+		return err
+	}
+	if adj.Amount < 0 && usersBalance-usersReserve+adj.Amount < 0 {
+		return fmt.Errorf("%w for adjustment. Current balance: %f, reserved: %f",
+			ErrNotEnoughMoney, usersBalance, usersReserve)
+	}
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`,
+		adj.UserID, adj.Currency, usersBalance+adj.Amount)
+	if err != nil {
+		return err
+	}
+	// the adjustment id stands in for the order id, service 0 keeps it out of service reports
+	_, err = tx.ExecContext(ctx, `insert into Transactions (order_id, service_id, user_id, currency, cost, order_status, date)
+		values ($1, 0, $2, $3, $4, 'adjustment', $5);`, adj.ID, adj.UserID, adj.Currency, adj.Amount, now)
+	if err != nil {
+		return err
+	}
+	return addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: adj.UserID, Currency: adj.Currency, Operation: OpAdjustment, OrderID: int(adj.ID),
+		Amount: adj.Amount, Balance: usersBalance + adj.Amount, Reserved: usersReserve, CreatedAt: now,
+	})
+}
+
+// Adjustments lists adjustments newest first, empty status and 0 user match all.
+func (billDB *BillingDB) Adjustments(ctx context.Context, status string, userID, limit, offset int) ([]Adjustment, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+adjustmentColumns+` from Adjustments
+		where ($1 = '' or status = $1) and ($2 = 0 or user_id = $2)
+		order by id desc limit $3 offset $4;`, status, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	adjustments := []Adjustment{}
+	for rows.Next() {
+		adj, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, adj)
+	}
+	return adjustments, rows.Err()
+}
+
+func (billDB *BillingDB) Adjustment(ctx context.Context, id int64) (Adjustment, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return scanAdjustment(billDB.DB.QueryRowContext(ctx, `select `+adjustmentColumns+` from Adjustments where id = $1;`, id))
+}
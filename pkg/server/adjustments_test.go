@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdjustmentValidate(t *testing.T) {
+	cases := []struct {
+		adj  Adjustment
+		want error
+	}{
+		{Adjustment{Amount: -50, Reason: "double charge", Ticket: "SUP-1"}, nil},
+		{Adjustment{Reason: "double charge", Ticket: "SUP-1"}, ErrInvalidAmount},
+		{Adjustment{Amount: 50, Ticket: "SUP-1"}, ErrWrongOperation},
+		{Adjustment{Amount: 50, Reason: "double charge", Ticket: " "}, ErrWrongOperation},
+	}
+	for _, tc := range cases {
+		if err := tc.adj.Validate(); !errors.Is(err, tc.want) {
+			t.Errorf("%+v: expected %v, got %v", tc.adj, tc.want, err)
+		}
+	}
+}
+
+// pendingAdjustment makes the fake database hold adjustment 9 for 500 RUB created by key:1.
+func pendingAdjustment(t *testing.T) (*fakeDB, BillingDB) {
+	fake, db := newFakeDB("")
+	t.Cleanup(func() { db.Close() })
+	fake.rows = map[string][]driver.Value{
+		"from Adjustments": {int64(9), int64(1), "RUB", 500.0, "double charge", "SUP-1", AdjustmentPending,
+			"key:1", "", time.Now(), nil},
+	}
+	return fake, BillingDB{DB: db}
+}
+
+func TestApproveAdjustment(t *testing.T) {
+	fake, billDB := pendingAdjustment(t)
+	ctx := WithAudit(context.Background(), AuditInfo{Actor: "key:1"})
+	if _, err := billDB.ApproveAdjustment(ctx, 9); !errors.Is(err, ErrWrongOperation) {
+		t.Fatalf("expected the creator's approval to be refused, got %v", err)
+	}
+	for _, statement := range fake.statements() {
+		if statement == "commit" || strings.Contains(statement, "update Users") {
+			t.Errorf("unexpected %q for a refused approval", statement)
+		}
+	}
+
+	fake, billDB = pendingAdjustment(t)
+	ctx = WithAudit(context.Background(), AuditInfo{Actor: "key:2"})
+	adj, err := billDB.ApproveAdjustment(ctx, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adj.Status != AdjustmentPosted || adj.DecidedBy != "key:2" || adj.DecidedAt == nil {
+		t.Errorf("unexpected adjustment %+v", adj)
+	}
+	var posted, history, committed bool
+	for _, statement := range fake.statements() {
+		posted = posted || strings.Contains(statement, "update Users set balance")
+		history = history || strings.Contains(statement, "'adjustment'")
+		committed = committed || statement == "commit"
+	}
+	if !posted || !history || !committed {
+		t.Errorf("expected the balance change and history entry to be committed: %q", fake.statements())
+	}
+}
+
+func TestRejectAdjustment(t *testing.T) {
+	fake, billDB := pendingAdjustment(t)
+	ctx := WithAudit(context.Background(), AuditInfo{Actor: "key:1"})
+	adj, err := billDB.RejectAdjustment(ctx, 9)
+	if err != nil || adj.Status != AdjustmentRejected {
+		t.Fatalf("expected the creator to be able to reject, got %+v, %v", adj, err)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "update Users") {
+			t.Errorf("rejected adjustment changed the balance: %q", statement)
+		}
+	}
+}
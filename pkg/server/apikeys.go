@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIKey lets a client call the API with the given scopes. Only the hash of the key is stored,
+// Secret is filled once when the key is created. Empty ServiceIDs means any service.
+// UserID is set for end-user tokens, which only see the data of that user.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ServiceIDs []int64    `json:"service_ids"`
+	Secret     string     `json:"secret,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	UserID     int        `json:"-"`
+}
+
+// KeyUsage is the audit record of one request made with a key. KeyID is 0 for the bootstrap admin key.
+type KeyUsage struct {
+	ID        int64     `json:"id"`
+	KeyID     int64     `json:"key_id"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Status    int       `json:"status"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const apiKeyColumns = `id, name, prefix, scopes, service_ids, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), pq.Array(&key.ServiceIDs),
+		&key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+	if key.ServiceIDs == nil {
+		key.ServiceIDs = []int64{}
+	}
+	return key, err
+}
+
+// CreateAPIKey stores the key under hash, the secret itself never reaches the database.
+func (billDB *BillingDB) CreateAPIKey(ctx context.Context, key APIKey, hash string) (APIKey, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if key.ServiceIDs == nil {
+		key.ServiceIDs = []int64{}
+	}
+	key.CreatedAt = time.Now().UTC()
+	err := billDB.DB.QueryRowContext(ctx, `insert into ApiKeys (name, prefix, key_hash, scopes, service_ids, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id;`,
+		key.Name, key.Prefix, hash, pq.Array(key.Scopes), pq.Array(key.ServiceIDs), key.CreatedAt).Scan(&key.ID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// APIKeys lists every key, revoked ones included.
+func (billDB *BillingDB) APIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+apiKeyColumns+` from ApiKeys order by id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// APIKeyByHash finds an active key, sql.ErrNoRows means the key is unknown or revoked.
+func (billDB *BillingDB) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return scanAPIKey(billDB.DB.QueryRowContext(ctx, `select `+apiKeyColumns+` from ApiKeys
+		where key_hash = $1 and revoked_at is null;`, hash))
+}
+
+// RevokeAPIKey disables a key for good, sql.ErrNoRows means there is no such active key.
+func (billDB *BillingDB) RevokeAPIKey(ctx context.Context, id int64) (APIKey, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return scanAPIKey(billDB.DB.QueryRowContext(ctx, `update ApiKeys set revoked_at = $2
+		where id = $1 and revoked_at is null returning `+apiKeyColumns+`;`, id, time.Now().UTC()))
+}
+
+// RecordKeyUsage appends to the usage audit and bumps the key's last_used_at.
+func (billDB *BillingDB) RecordKeyUsage(ctx context.Context, usage KeyUsage) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if usage.CreatedAt.IsZero() {
+		usage.CreatedAt = time.Now().UTC()
+	}
+	_, err := billDB.DB.ExecContext(ctx, `with used as (update ApiKeys set last_used_at = $6 where id = $1)
+		insert into ApiKeyUsage (key_id, method, route, status, ip, created_at)
+		values (nullif($1, 0), $2, $3, $4, $5, $6);`,
+		usage.KeyID, usage.Method, usage.Route, usage.Status, usage.IP, usage.CreatedAt)
+	return err
+}
+
+// KeyUsages pages through the audit of a key, newest first.
+func (billDB *BillingDB) KeyUsages(ctx context.Context, keyID int64, limit, offset int) ([]KeyUsage, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, coalesce(key_id, 0), method, route, status, ip, created_at
+		from ApiKeyUsage where coalesce(key_id, 0) = $1 order by id desc limit $2 offset $3;`, keyID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usages := []KeyUsage{}
+	for rows.Next() {
+		var usage KeyUsage
+		err = rows.Scan(&usage.ID, &usage.KeyID, &usage.Method, &usage.Route, &usage.Status, &usage.IP, &usage.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
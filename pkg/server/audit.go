@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actors of changes made without an API key: background jobs and commands from the message queue.
+const (
+	ActorSystem  = "system"
+	ActorCommand = "command"
+)
+
+// AuditInfo is who asked for a change and how, the API puts it into the request context with WithAudit.
+type AuditInfo struct {
+	Actor     string
+	RequestID string
+	IP        string
+	// Request is the raw request as received, the body included.
+	Request string
+}
+
+type auditKey struct{}
+
+// NewRequestID names a request that came without an id of its own.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithAudit attaches the caller to ctx, every mutation made with ctx is audited under its name.
+func WithAudit(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditKey{}, info)
+}
+
+func auditInfo(ctx context.Context) AuditInfo {
+	info, _ := ctx.Value(auditKey{}).(AuditInfo)
+	if info.Actor == "" {
+		info.Actor = ActorSystem
+	}
+	return info
+}
+
+// AuditEntry is an append-only record of a balance change. Every user has a chain of their own: Hash covers
+// the entry and the hash of the user's entry before it, so changing or removing an entry breaks the chain from there on.
+type AuditEntry struct {
+	ID             int64     `json:"id"`
+	Actor          string    `json:"actor"`
+	RequestID      string    `json:"request_id"`
+	IP             string    `json:"ip"`
+	Operation      string    `json:"operation"`
+	UserID         int       `json:"user_id"`
+	Currency       string    `json:"currency"`
+	OrderID        int       `json:"order_id,omitempty"`
+	ServiceID      int       `json:"service_id,omitempty"`
+	Amount         float64   `json:"amount"`
+	BalanceBefore  float64   `json:"balance_before"`
+	ReservedBefore float64   `json:"reserved_before"`
+	BalanceAfter   float64   `json:"balance_after"`
+	ReservedAfter  float64   `json:"reserved_after"`
+	Request        string    `json:"request"`
+	CreatedAt      time.Time `json:"created_at"`
+	PrevHash       string    `json:"prev_hash"`
+	Hash           string    `json:"hash"`
+}
+
+// ledgerEffects is how each operation moves the balance and the reserve by its amount,
+// it gives the state before an entry from the state after it.
+var ledgerEffects = map[string][2]float64{
+	OpCredit:     {1, 0},
+	OpReserve:    {0, 1},
+	OpCapture:    {-1, -1},
+	OpCancel:     {0, -1},
+	OpExpire:     {0, -1},
+	OpRefund:     {1, 0},
+	OpConvertOut: {-1, 0},
+	OpConvertIn:  {1, 0},
+	OpTransfer:   {-1, 0},
+	OpTransferIn: {1, 0},
+	OpAdjustment: {1, 0},
+}
+
+// ComputeHash is the chain hash of the entry, everything but ID and Hash itself is covered.
+func (entry AuditEntry) ComputeHash() string {
+	num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	fields := []string{
+		entry.PrevHash, entry.Actor, entry.RequestID, entry.IP, entry.Operation,
+		strconv.Itoa(entry.UserID), entry.Currency, strconv.Itoa(entry.OrderID), strconv.Itoa(entry.ServiceID),
+		num(entry.Amount), num(entry.BalanceBefore), num(entry.ReservedBefore), num(entry.BalanceAfter), num(entry.ReservedAfter),
+		entry.Request, entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	sum := sha256.New()
+	for _, field := range fields {
+		// length prefixes keep "a|b" and "a" "|b" apart
+		fmt.Fprintf(sum, "%d:%s|", len(field), field)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// addAuditEntry appends the ledger entry to the audit chain of its user under the caller of ctx.
+// Appending is serialized per user by an advisory lock held until tx ends, like the outbox,
+// so changes of different users don't wait for each other.
+func addAuditEntry(ctx context.Context, tx *sql.Tx, ledger LedgerEntry) error {
+	effect, ok := ledgerEffects[ledger.Operation]
+	if !ok {
+		return fmt.Errorf("no audit effect for operation %q", ledger.Operation)
+	}
+	info := auditInfo(ctx)
+	entry := AuditEntry{
+		Actor: info.Actor, RequestID: info.RequestID, IP: info.IP, Request: info.Request,
+		Operation: ledger.Operation, UserID: ledger.UserID, Currency: ledger.Currency,
+		OrderID: ledger.OrderID, ServiceID: ledger.ServiceID, Amount: ledger.Amount,
+		BalanceBefore:  money(ledger.Balance - effect[0]*ledger.Amount),
+		ReservedBefore: money(ledger.Reserved - effect[1]*ledger.Amount),
+		BalanceAfter:   ledger.Balance,
+		ReservedAfter:  ledger.Reserved,
+		// the column keeps microseconds, the hash must match what is read back
+		CreatedAt: ledger.CreatedAt.UTC().Truncate(time.Microsecond),
+	}
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext('audit'), $1);`, entry.UserID); err != nil {
+		return err
+	}
+	err := tx.QueryRowContext(ctx, `select hash from Audit where user_id = $1 order by id desc limit 1;`,
+		entry.UserID).Scan(&entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	entry.Hash = entry.ComputeHash()
+	_, err = tx.ExecContext(ctx, `insert into Audit (actor, request_id, ip, operation, user_id, currency, order_id, service_id,
+		amount, balance_before, reserved_before, balance_after, reserved_after, request, created_at, prev_hash, hash)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17);`,
+		entry.Actor, entry.RequestID, entry.IP, entry.Operation, entry.UserID, entry.Currency, entry.OrderID, entry.ServiceID,
+		entry.Amount, entry.BalanceBefore, entry.ReservedBefore, entry.BalanceAfter, entry.ReservedAfter,
+		entry.Request, entry.CreatedAt, entry.PrevHash, entry.Hash)
+	return err
+}
+
+// AuditQuery filters the audit log, zero values match everything.
+type AuditQuery struct {
+	UserID    int
+	Actor     string
+	Operation string
+	RequestID string
+	From, To  time.Time
+	Limit     int
+	Offset    int
+}
+
+const auditColumns = `id, actor, request_id, ip, operation, user_id, currency, order_id, service_id, amount,
+	balance_before, reserved_before, balance_after, reserved_after, request, created_at, prev_hash, hash`
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }) (AuditEntry, error) {
+	var entry AuditEntry
+	err := row.Scan(&entry.ID, &entry.Actor, &entry.RequestID, &entry.IP, &entry.Operation, &entry.UserID, &entry.Currency,
+		&entry.OrderID, &entry.ServiceID, &entry.Amount, &entry.BalanceBefore, &entry.ReservedBefore,
+		&entry.BalanceAfter, &entry.ReservedAfter, &entry.Request, &entry.CreatedAt, &entry.PrevHash, &entry.Hash)
+	return entry, err
+}
+
+// AuditLog pages through the audit log, newest first.
+func (billDB *BillingDB) AuditLog(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if query.UserID != 0 {
+		add("user_id = $%d", query.UserID)
+	}
+	if query.Actor != "" {
+		add("actor = $%d", query.Actor)
+	}
+	if query.Operation != "" {
+		add("operation = $%d", query.Operation)
+	}
+	if query.RequestID != "" {
+		add("request_id = $%d", query.RequestID)
+	}
+	if !query.From.IsZero() {
+		add("created_at >= $%d", query.From.UTC())
+	}
+	if !query.To.IsZero() {
+		add("created_at < $%d", query.To.UTC())
+	}
+	sqlQuery := `select ` + auditColumns + ` from Audit`
+	if len(where) > 0 {
+		sqlQuery += ` where ` + strings.Join(where, " and ")
+	}
+	args = append(args, query.Limit, query.Offset)
+	sqlQuery += fmt.Sprintf(` order by id desc limit $%d offset $%d;`, len(args)-1, len(args))
+
+	rows, err := billDB.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// AuditVerification is the outcome of walking the chain, BrokenID is the first entry that doesn't fit.
+type AuditVerification struct {
+	Checked  int    `json:"checked"`
+	OK       bool   `json:"ok"`
+	BrokenID int64  `json:"broken_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAudit recomputes the hash of every entry and checks that each one links to the user's entry before it.
+func (billDB *BillingDB) VerifyAudit(ctx context.Context) (AuditVerification, error) {
+	// without the mark of the migration every entry must be chained per user
+	var perUserFrom int64
+	err := billDB.DB.QueryRowContext(ctx, `select coalesce(max(first_id), 0) from AuditPerUser;`).Scan(&perUserFrom)
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	rows, err := billDB.DB.QueryContext(ctx, `select `+auditColumns+` from Audit order by id;`)
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	defer rows.Close()
+	chain := auditChain{prev: map[int]string{}, perUserFrom: perUserFrom}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		if result, ok := chain.add(entry); !ok {
+			return result, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return AuditVerification{}, err
+	}
+	return AuditVerification{Checked: chain.checked, OK: true}, nil
+}
+
+// VerifyChain checks entries in id order, those before perUserFrom were written as a single chain.
+func VerifyChain(entries []AuditEntry, perUserFrom int64) AuditVerification {
+	chain := auditChain{prev: map[int]string{}, perUserFrom: perUserFrom}
+	for _, entry := range entries {
+		if result, ok := chain.add(entry); !ok {
+			return result
+		}
+	}
+	return AuditVerification{Checked: chain.checked, OK: true}
+}
+
+// auditChain follows the chains of all users at once, prev is the last hash seen for each user.
+// Entries before perUserFrom were written while the log had a single chain, they link to last,
+// the entry before them in the whole log. The migration that moved to per-user chains records perUserFrom.
+type auditChain struct {
+	prev        map[int]string
+	last        string
+	perUserFrom int64
+	checked     int
+}
+
+// add checks the next entry of its user's chain.
+func (chain *auditChain) add(entry AuditEntry) (AuditVerification, bool) {
+	broken := AuditVerification{Checked: chain.checked, BrokenID: entry.ID}
+	want := chain.prev[entry.UserID]
+	if entry.ID < chain.perUserFrom {
+		want = chain.last
+	}
+	if entry.PrevHash != want {
+		broken.Reason = "doesn't link to the previous entry, an entry was removed or reordered"
+		return broken, false
+	}
+	if entry.ComputeHash() != entry.Hash {
+		broken.Reason = "hash doesn't match the contents, the entry was modified"
+		return broken, false
+	}
+	chain.prev[entry.UserID] = entry.Hash
+	chain.last = entry.Hash
+	chain.checked++
+	return AuditVerification{}, true
+}
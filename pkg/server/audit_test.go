@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditChainOf(entries ...AuditEntry) []AuditEntry {
+	prev := map[int]string{}
+	for i := range entries {
+		entries[i].ID = int64(i + 1)
+		entries[i].PrevHash = prev[entries[i].UserID]
+		entries[i].Hash = entries[i].ComputeHash()
+		prev[entries[i].UserID] = entries[i].Hash
+	}
+	return entries
+}
+
+func TestVerifyChain(t *testing.T) {
+	at := time.Date(2022, 11, 1, 10, 0, 0, 123456000, time.UTC)
+	entries := func() []AuditEntry {
+		return auditChainOf(
+			AuditEntry{Actor: "key:1", Operation: OpCredit, UserID: 1, Currency: "RUB", Amount: 100, BalanceAfter: 100, CreatedAt: at},
+			AuditEntry{Actor: "key:2", Operation: OpReserve, UserID: 1, Currency: "RUB", OrderID: 5, ServiceID: 2, Amount: 40,
+				BalanceBefore: 100, BalanceAfter: 100, ReservedAfter: 40, Request: "POST /reserve\n\n{}", CreatedAt: at},
+			AuditEntry{Actor: ActorSystem, Operation: OpExpire, UserID: 1, Currency: "RUB", OrderID: 5, Amount: 40,
+				BalanceBefore: 100, ReservedBefore: 40, BalanceAfter: 100, CreatedAt: at},
+		)
+	}
+	if result := VerifyChain(entries(), 0); !result.OK || result.Checked != 3 {
+		t.Errorf("expected an intact chain, got %+v", result)
+	}
+
+	modified := entries()
+	modified[1].Amount = 4
+	if result := VerifyChain(modified, 0); result.OK || result.BrokenID != 2 || result.Checked != 1 {
+		t.Errorf("expected the modified entry 2 to be found, got %+v", result)
+	}
+
+	removed := entries()
+	removed = append(removed[:1], removed[2:]...)
+	if result := VerifyChain(removed, 0); result.OK || result.BrokenID != 3 {
+		t.Errorf("expected the gap before entry 3 to be found, got %+v", result)
+	}
+
+	// rehashing a modified entry doesn't help, the next one still links to the old hash
+	rehashed := entries()
+	rehashed[0].BalanceAfter = 1000
+	rehashed[0].Hash = rehashed[0].ComputeHash()
+	if result := VerifyChain(rehashed, 0); result.OK || result.BrokenID != 2 {
+		t.Errorf("expected entry 2 to stop linking, got %+v", result)
+	}
+}
+
+func TestVerifyChainPerUser(t *testing.T) {
+	at := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+	entries := func() []AuditEntry {
+		return auditChainOf(
+			AuditEntry{Operation: OpCredit, UserID: 1, Currency: "RUB", Amount: 100, BalanceAfter: 100, CreatedAt: at},
+			AuditEntry{Operation: OpCredit, UserID: 2, Currency: "RUB", Amount: 50, BalanceAfter: 50, CreatedAt: at},
+			AuditEntry{Operation: OpReserve, UserID: 1, Currency: "RUB", OrderID: 5, Amount: 40,
+				BalanceBefore: 100, BalanceAfter: 100, ReservedAfter: 40, CreatedAt: at},
+			AuditEntry{Operation: OpReserve, UserID: 2, Currency: "RUB", OrderID: 6, Amount: 10,
+				BalanceBefore: 50, BalanceAfter: 50, ReservedAfter: 10, CreatedAt: at},
+		)
+	}
+	chained := entries()
+	if chained[1].PrevHash != "" || chained[2].PrevHash != chained[0].Hash {
+		t.Fatalf("expected every user to have a chain of their own: %+v", chained)
+	}
+	if result := VerifyChain(chained, 0); !result.OK || result.Checked != 4 {
+		t.Errorf("expected intact chains, got %+v", result)
+	}
+
+	removed := entries()
+	removed = append(removed[:1], removed[2:]...)
+	if result := VerifyChain(removed, 0); result.OK || result.BrokenID != 4 {
+		t.Errorf("expected the gap in the chain of user 2 to be found, got %+v", result)
+	}
+
+	// entries from the time of a single chain link to the entry before them in the whole log
+	legacy := entries()
+	for i := 1; i < len(legacy); i++ {
+		legacy[i].PrevHash = legacy[i-1].Hash
+		legacy[i].Hash = legacy[i].ComputeHash()
+	}
+	if result := VerifyChain(legacy, 5); !result.OK {
+		t.Errorf("expected a single chain to verify too, got %+v", result)
+	}
+	if result := VerifyChain(legacy, 1); result.OK || result.BrokenID != 2 {
+		t.Errorf("expected a single chain after the cutover to be refused, got %+v", result)
+	}
+
+	// per-user entries after legacy ones continue from the user's last entry
+	mixed := entries()
+	mixed[1].PrevHash = mixed[0].Hash
+	mixed[1].Hash = mixed[1].ComputeHash()
+	mixed[3].PrevHash = mixed[1].Hash
+	mixed[3].Hash = mixed[3].ComputeHash()
+	if result := VerifyChain(mixed, 3); !result.OK {
+		t.Errorf("expected chains to continue after the cutover, got %+v", result)
+	}
+
+	// an entry spliced in after the cutover that links to the entry before it in the whole log
+	spliced := entries()
+	spliced[3].PrevHash = spliced[2].Hash
+	spliced[3].Hash = spliced[3].ComputeHash()
+	if result := VerifyChain(spliced, 1); result.OK || result.BrokenID != 4 {
+		t.Errorf("expected the spliced entry 4 to be found, got %+v", result)
+	}
+}
+
+func TestAuditLocksPerUser(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	billDB := BillingDB{DB: db}
+	if err := billDB.CreditUser(context.Background(), 7, "", 100); err != nil {
+		t.Fatal(err)
+	}
+	var locked bool
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "hashtext('audit')") {
+			locked = strings.Contains(statement, "hashtext('audit'), $1")
+		}
+		if strings.Contains(statement, "select hash from Audit") && !strings.Contains(statement, "where user_id = $1") {
+			t.Errorf("previous hash isn't looked up by user: %q", statement)
+		}
+	}
+	if !locked {
+		t.Errorf("audit chain isn't locked per user: %q", fake.statements())
+	}
+}
+
+func TestComputeHashSeparatesFields(t *testing.T) {
+	a := AuditEntry{Actor: "key:1", RequestID: "2"}
+	b := AuditEntry{Actor: "key:", RequestID: "12"}
+	if a.ComputeHash() == b.ComputeHash() {
+		t.Error("moving text between fields must change the hash")
+	}
+}
+
+func TestLedgerEffects(t *testing.T) {
+	for operation := range ledgerEvents {
+		if _, ok := ledgerEffects[operation]; !ok {
+			t.Errorf("operation %s has no audit effect", operation)
+		}
+	}
+	if info := auditInfo(context.Background()); info.Actor != ActorSystem {
+		t.Errorf("expected changes without a caller to be made by %s, got %+v", ActorSystem, info)
+	}
+	ctx := WithAudit(context.Background(), AuditInfo{Actor: "key:3", RequestID: "r1"})
+	if info := auditInfo(ctx); info.Actor != "key:3" || info.RequestID != "r1" {
+		t.Errorf("unexpected audit info %+v", info)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Balance history intervals.
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+)
+
+// maxHistoryPoints keeps a single history request from producing an unbounded response.
+const maxHistoryPoints = 5000
+
+// shortestInterval is the shortest an interval gets around daylight saving changes and in February,
+// a period divided by it bounds the number of points.
+var shortestInterval = map[string]time.Duration{
+	IntervalHour:  time.Hour,
+	IntervalDay:   23 * time.Hour,
+	IntervalWeek:  7*24*time.Hour - time.Hour,
+	IntervalMonth: 28*24*time.Hour - time.Hour,
+}
+
+// BalancePoint is the state of a user's account at a moment, replayed from the ledger.
+type BalancePoint struct {
+	At        time.Time `json:"at"`
+	Balance   float64   `json:"balance"`
+	Held      float64   `json:"held"`
+	Available float64   `json:"available"`
+}
+
+// ParseMoment accepts RFC 3339 or a local "YYYY-MM-DD HH:MM[:SS]" / "YYYY-MM-DD" time in loc.
+func ParseMoment(value string, loc *time.Location) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", dateLayout} {
+		if at, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("wrong time %q", value)
+}
+
+// BalanceAt returns the user's balance right after the last operation made at or before at.
+func (billDB *BillingDB) BalanceAt(ctx context.Context, userID int, currency string, at time.Time) (BalancePoint, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return BalancePoint{}, err
+	}
+	var id int
+	err = billDB.DB.QueryRowContext(ctx, "select id from Users where id = $1 and currency = $2", userID, currency).Scan(&id)
+	if err != nil {
+		return BalancePoint{}, err
+	}
+	point := BalancePoint{At: at}
+	err = billDB.DB.QueryRowContext(ctx, `
+		select balance, reserved from Ledger
+		where user_id = $1 and currency = $2 and created_at <= $3
+		order by created_at desc, id desc
+		limit 1;`, userID, currency, at.UTC()).Scan(&point.Balance, &point.Held)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return BalancePoint{}, err
+	}
+	point.Available = point.Balance - point.Held
+	return point, nil
+}
+
+// BalanceHistory returns the balance at the end of every interval between from and to.
+func (billDB *BillingDB) BalanceHistory(ctx context.Context, userID int, currency string, from, to time.Time, interval string) ([]BalancePoint, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	if err := checkHistoryPoints(from, to, interval); err != nil {
+		return nil, err
+	}
+	statement, err := billDB.UserStatement(ctx, userID, currency, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return balanceSeries(statement, interval)
+}
+
+// balanceSeries replays the statement entries and samples the balance at every interval end.
+func balanceSeries(statement Statement, interval string) ([]BalancePoint, error) {
+	series := []BalancePoint{}
+	balance, held := statement.OpeningBalance, statement.OpeningReserved
+	entries := statement.Entries
+	for start := statement.From; start.Before(statement.To); {
+		end, err := nextBoundary(start, interval)
+		if err != nil {
+			return nil, err
+		}
+		if end.After(statement.To) {
+			end = statement.To
+		}
+		for len(entries) > 0 && entries[0].CreatedAt.Before(end) {
+			balance, held = entries[0].Balance, entries[0].Reserved
+			entries = entries[1:]
+		}
+		series = append(series, BalancePoint{At: end, Balance: balance, Held: held, Available: balance - held})
+		start = end
+	}
+	return series, nil
+}
+
+// checkHistoryPoints refuses a history longer than maxHistoryPoints before anything is read.
+func checkHistoryPoints(from, to time.Time, interval string) error {
+	shortest, ok := shortestInterval[interval]
+	if !ok {
+		return fmt.Errorf("%w. Unknown interval %q", ErrWrongOperation, interval)
+	}
+	if points := (to.Sub(from) + shortest - 1) / shortest; points > maxHistoryPoints {
+		return fmt.Errorf("%w. %d points is more than %d, use a longer interval or a shorter period",
+			ErrWrongOperation, points, maxHistoryPoints)
+	}
+	return nil
+}
+
+func nextBoundary(start time.Time, interval string) (time.Time, error) {
+	switch interval {
+	case IntervalHour:
+		return start.Add(time.Hour), nil
+	case IntervalDay:
+		return start.AddDate(0, 0, 1), nil
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7), nil
+	case IntervalMonth:
+		return start.AddDate(0, 1, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("%w. Unknown interval %q", ErrWrongOperation, interval)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBalanceSeries(t *testing.T) {
+	series, err := balanceSeries(testStatement(), IntervalDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BalancePoint{
+		{At: time.Date(2022, 11, 2, 0, 0, 0, 0, moscow), Balance: 20500, Held: 10000, Available: 10500},
+		{At: time.Date(2022, 11, 3, 0, 0, 0, 0, moscow), Balance: 10500, Held: 10.5, Available: 10489.5},
+		{At: time.Date(2022, 11, 4, 0, 0, 0, 0, moscow), Balance: 20500, Held: 0, Available: 20500},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("expected %d points, got %v", len(want), series)
+	}
+	for i := range want {
+		if !series[i].At.Equal(want[i].At) || series[i].Balance != want[i].Balance ||
+			series[i].Held != want[i].Held || series[i].Available != want[i].Available {
+			t.Errorf("#%d: expected %+v, got %+v", i, want[i], series[i])
+		}
+	}
+
+	empty := Statement{From: want[0].At, To: want[0].At.AddDate(0, 0, 2), OpeningBalance: 7}
+	series, err = balanceSeries(empty, IntervalDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[1].Balance != 7 || series[1].Available != 7 {
+		t.Errorf("expected the opening balance to carry over, got %+v", series)
+	}
+
+	if _, err = balanceSeries(testStatement(), "minute"); err == nil {
+		t.Error("expected error for an unknown interval")
+	}
+}
+
+func TestCheckHistoryPoints(t *testing.T) {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, moscow)
+	cases := []struct {
+		to       time.Time
+		interval string
+		err      bool
+	}{
+		{from.AddDate(1, 0, 0), IntervalDay, false},
+		{from.AddDate(0, 0, 200), IntervalHour, false},
+		{from.AddDate(0, 0, 209), IntervalHour, true},
+		{from.AddDate(100, 0, 0), IntervalMonth, false},
+		{from.AddDate(0, 0, 1), "minute", true},
+	}
+	for _, tc := range cases {
+		err := checkHistoryPoints(from, tc.to, tc.interval)
+		if tc.err && !errors.Is(err, ErrWrongOperation) || !tc.err && err != nil {
+			t.Errorf("%s by %s: unexpected %v", tc.to, tc.interval, err)
+		}
+	}
+}
+
+func TestParseMoment(t *testing.T) {
+	want := time.Date(2022, 11, 3, 14, 0, 0, 0, moscow)
+	for _, value := range []string{"2022-11-03T14:00:00+03:00", "2022-11-03T11:00:00Z", "2022-11-03 14:00", "2022-11-03T14:00:00"} {
+		got, err := ParseMoment(value, moscow)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", value, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: expected %v, got %v", value, want, got)
+		}
+	}
+	if _, err := ParseMoment("03.11.2022 14:00", moscow); err == nil {
+		t.Error("expected error for an unknown layout")
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Bonus spending priorities, the first one decides and the next ones break ties.
+const (
+	// BonusRestricted spends grants limited to some services before the ones valid everywhere.
+	BonusRestricted = "restricted"
+	// BonusExpiring spends the grants that expire first.
+	BonusExpiring = "expiring"
+	// BonusOldest spends the grants that were given first.
+	BonusOldest = "oldest"
+	// BonusSmallest spends the grants with the least left on them.
+	BonusSmallest = "smallest"
+)
+
+// bonusPriorities maps a priority to the SQL sort key of the grants.
+var bonusPriorities = map[string]string{
+	BonusRestricted: `cardinality(service_ids) = 0`,
+	BonusExpiring:   `expires_at`,
+	BonusOldest:     `created_at`,
+	BonusSmallest:   `remaining`,
+}
+
+// bonusBalance sums the unexpired bonus of the wallet in a query on Users.
+const bonusBalance = `coalesce((select sum(b.remaining) from Bonuses b where b.user_id = Users.id
+	and b.currency = Users.currency and b.expires_at > now() at time zone 'UTC'), 0)`
+
+// DefaultBonusPriority keeps the universal bonus for later and spends what would expire first.
+var DefaultBonusPriority = []string{BonusRestricted, BonusExpiring}
+
+// Bonus is promotional money granted to a user. It can't be withdrawn or converted, only spent on reserves
+// of the listed services (all of them when ServiceIDs is empty) until it expires.
+type Bonus struct {
+	ID         int64     `json:"id"`
+	UserID     int       `json:"user_id"`
+	Currency   string    `json:"currency"`
+	Amount     float64   `json:"amount"`
+	Remaining  float64   `json:"remaining"`
+	ServiceIDs []int64   `json:"service_ids"`
+	Reason     string    `json:"reason"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (bonus Bonus) Validate() error {
+	if bonus.Amount <= 0 || math.IsNaN(bonus.Amount) || math.IsInf(bonus.Amount, 0) {
+		return fmt.Errorf("%w. Bonus must be a positive number", ErrInvalidAmount)
+	}
+	if strings.TrimSpace(bonus.Reason) == "" {
+		return fmt.Errorf("%w. Bonus needs a reason", ErrWrongOperation)
+	}
+	if bonus.ExpiresAt.IsZero() {
+		return fmt.Errorf("%w. Bonus needs an expiry date", ErrWrongOperation)
+	}
+	for _, serviceID := range bonus.ServiceIDs {
+		if serviceID <= 0 {
+			return fmt.Errorf("%w. Service ids must be positive", ErrWrongOperation)
+		}
+	}
+	return nil
+}
+
+// CheckBonusPriority makes sure every priority is known.
+func CheckBonusPriority(priority []string) error {
+	_, err := bonusOrder(priority)
+	return err
+}
+
+// bonusOrder builds the order by clause spending grants in the given priority, DefaultBonusPriority when empty.
+func bonusOrder(priority []string) (string, error) {
+	if len(priority) == 0 {
+		priority = DefaultBonusPriority
+	}
+	keys := make([]string, 0, len(priority)+1)
+	for _, name := range priority {
+		key, ok := bonusPriorities[name]
+		if !ok {
+			return "", fmt.Errorf("unknown bonus priority %q", name)
+		}
+		keys = append(keys, key)
+	}
+	return "order by " + strings.Join(append(keys, "id"), ", "), nil
+}
+
+type bonusGrant struct {
+	id        int64
+	remaining float64
+}
+
+type bonusSpend struct {
+	bonusID int64
+	amount  float64
+}
+
+// allocateBonus takes up to amount from the grants in order.
+func allocateBonus(grants []bonusGrant, amount float64) []bonusSpend {
+	var spends []bonusSpend
+	for _, grant := range grants {
+		if amount <= 0 {
+			break
+		}
+		spend := money(math.Min(grant.remaining, amount))
+		if spend <= 0 {
+			continue
+		}
+		spends = append(spends, bonusSpend{bonusID: grant.id, amount: spend})
+		amount = money(amount - spend)
+	}
+	return spends
+}
+
+// bonusCap is the part of price bonus may pay, BonusMaxShare outside (0, 1] lets it pay everything.
+func (billDB *BillingDB) bonusCap(price float64) float64 {
+	share := billDB.BonusMaxShare
+	if share <= 0 || share > 1 {
+		share = 1
+	}
+	return money(price * share)
+}
+
+// spendBonus pays as much of the order as the user's bonus and BonusMaxShare allow and returns the amount paid.
+// The grants stay locked until tx ends.
+func (billDB *BillingDB) spendBonus(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int, currency string,
+	price float64, now time.Time) (float64, error) {
+	order, err := bonusOrder(billDB.BonusPriority)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, `select id, remaining from Bonuses
+		where user_id = $1 and currency = $2 and remaining > 0 and expires_at > $3
+		and (cardinality(service_ids) = 0 or $4 = any(service_ids)) `+order+` for update;`,
+		userID, currency, now.UTC(), serviceID)
+	if err != nil {
+		return 0, err
+	}
+	var grants []bonusGrant
+	for rows.Next() {
+		var grant bonusGrant
+		if err = rows.Scan(&grant.id, &grant.remaining); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		grants = append(grants, grant)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var spent float64
+	for _, spend := range allocateBonus(grants, billDB.bonusCap(price)) {
+		_, err = tx.ExecContext(ctx, `update Bonuses set remaining = remaining - $2 where id = $1;`, spend.bonusID, spend.amount)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `insert into BonusSpends (bonus_id, user_id, service_id, order_id, amount, created_at)
+			values ($1, $2, $3, $4, $5, $6);`, spend.bonusID, userID, serviceID, orderID, spend.amount, now.UTC())
+		if err != nil {
+			return 0, err
+		}
+		spent = money(spent + spend.amount)
+	}
+	if spent > 0 {
+		log.Printf("Bonus pays %f of order %d of user %d", spent, orderID, userID)
+	}
+	return spent, nil
+}
+
+// returnBonus puts the bonus spent on a cancelled, expired or refunded order back on its grants.
+// A grant that expired in the meantime gets it back too but can't be spent anymore.
+func returnBonus(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int) error {
+	_, err := tx.ExecContext(ctx, `update Bonuses b set remaining = b.remaining + s.amount from BonusSpends s
+		where s.bonus_id = b.id and s.user_id = $1 and s.service_id = $2 and s.order_id = $3 and not s.returned;`,
+		userID, serviceID, orderID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update BonusSpends set returned = true
+		where user_id = $1 and service_id = $2 and order_id = $3 and not returned;`, userID, serviceID, orderID)
+	return err
+}
+
+// GrantBonus gives the user promotional money, creating the wallet if needed.
+func (billDB *BillingDB) GrantBonus(ctx context.Context, bonus Bonus) (Bonus, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if err := bonus.Validate(); err != nil {
+		return Bonus{}, err
+	}
+	currency, err := billDB.Currency(bonus.Currency)
+	if err != nil {
+		return Bonus{}, err
+	}
+	now := time.Now().UTC()
+	if !bonus.ExpiresAt.After(now) {
+		return Bonus{}, fmt.Errorf("%w. Bonus expires in the past", ErrWrongOperation)
+	}
+	bonus.Currency = currency
+	bonus.Amount = money(bonus.Amount)
+	bonus.Remaining = bonus.Amount
+	bonus.ExpiresAt = bonus.ExpiresAt.UTC()
+	bonus.CreatedBy = auditInfo(ctx).Actor
+	bonus.CreatedAt = now
+	if bonus.ServiceIDs == nil {
+		bonus.ServiceIDs = []int64{}
+	}
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Bonus{}, err
+	}
+	defer tx.Rollback()
+
+	if err = checkStatus(ctx, tx, bonus.UserID, "bonus", false); err != nil {
+		return Bonus{}, err
+	}
+	_, err = tx.ExecContext(ctx, `insert into Users (id, currency, balance, reserved) values ($1, $2, 0, 0)
+		on conflict (id, currency) do nothing;`, bonus.UserID, bonus.Currency)
+	if err != nil {
+		return Bonus{}, err
+	}
+	err = tx.QueryRowContext(ctx, `insert into Bonuses
+		(user_id, currency, amount, remaining, service_ids, reason, expires_at, created_by, created_at)
+		values ($1, $2, $3, $3, $4, $5, $6, $7, $8) returning id;`,
+		bonus.UserID, bonus.Currency, bonus.Amount, pq.Array(bonus.ServiceIDs), bonus.Reason, bonus.ExpiresAt,
+		bonus.CreatedBy, bonus.CreatedAt).Scan(&bonus.ID)
+	if err != nil {
+		return Bonus{}, err
+	}
+	return bonus, tx.Commit()
+}
+
+// Bonuses lists the user's grants, the latest first. Spent and expired ones are only listed with all set.
+func (billDB *BillingDB) Bonuses(ctx context.Context, userID int, all bool, now time.Time) ([]Bonus, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, user_id, currency, amount, remaining, service_ids, reason,
+		expires_at, created_by, created_at from Bonuses
+		where user_id = $1 and ($2 or (remaining > 0 and expires_at > $3))
+		order by id desc;`, userID, all, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bonuses := []Bonus{}
+	for rows.Next() {
+		var bonus Bonus
+		err = rows.Scan(&bonus.ID, &bonus.UserID, &bonus.Currency, &bonus.Amount, &bonus.Remaining,
+			pq.Array(&bonus.ServiceIDs), &bonus.Reason, &bonus.ExpiresAt, &bonus.CreatedBy, &bonus.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bonuses = append(bonuses, bonus)
+	}
+	return bonuses, rows.Err()
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBonusOrder(t *testing.T) {
+	order, err := bonusOrder(nil)
+	if err != nil || order != "order by cardinality(service_ids) = 0, expires_at, id" {
+		t.Errorf("unexpected default order %q, %v", order, err)
+	}
+	order, err = bonusOrder([]string{BonusSmallest, BonusOldest})
+	if err != nil || order != "order by remaining, created_at, id" {
+		t.Errorf("unexpected order %q, %v", order, err)
+	}
+	if _, err = bonusOrder([]string{"largest"}); err == nil {
+		t.Error("expected an error for an unknown priority")
+	}
+}
+
+func TestAllocateBonus(t *testing.T) {
+	grants := []bonusGrant{{id: 1, remaining: 10}, {id: 2, remaining: 0}, {id: 3, remaining: 25.5}, {id: 4, remaining: 5}}
+	cases := []struct {
+		amount float64
+		want   []bonusSpend
+	}{
+		{0, nil},
+		{7, []bonusSpend{{1, 7}}},
+		{20, []bonusSpend{{1, 10}, {3, 10}}},
+		{100, []bonusSpend{{1, 10}, {3, 25.5}, {4, 5}}},
+	}
+	for _, tc := range cases {
+		if got := allocateBonus(grants, tc.amount); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%f: expected %v, got %v", tc.amount, tc.want, got)
+		}
+	}
+}
+
+func TestBonusValidate(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	cases := []struct {
+		bonus Bonus
+		err   error
+	}{
+		{Bonus{Amount: 100, Reason: "promo", ExpiresAt: expires, ServiceIDs: []int64{1, 2}}, nil},
+		{Bonus{Amount: 0, Reason: "promo", ExpiresAt: expires}, ErrInvalidAmount},
+		{Bonus{Amount: 100, ExpiresAt: expires}, ErrWrongOperation},
+		{Bonus{Amount: 100, Reason: "promo"}, ErrWrongOperation},
+		{Bonus{Amount: 100, Reason: "promo", ExpiresAt: expires, ServiceIDs: []int64{0}}, ErrWrongOperation},
+	}
+	for i, tc := range cases {
+		if err := tc.bonus.Validate(); !errors.Is(err, tc.err) {
+			t.Errorf("#%d: expected %v, got %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestReserveSpendsBonus(t *testing.T) {
+	cases := []struct {
+		name  string
+		share float64
+		err   error
+	}{
+		{name: "bonus pays everything"},
+		{name: "bonus pays half of an empty wallet", share: 0.5, err: ErrNotEnoughMoney},
+	}
+	for _, tc := range cases {
+		fake, db := newFakeDB("")
+		fake.rows = map[string][]driver.Value{
+			"select balance, reserved from Users": {0.0, 0.0},
+			"from Bonuses":                        {int64(7), 40.0},
+		}
+		billDB := BillingDB{DB: db, BonusMaxShare: tc.share}
+		err := billDB.ReserveMoney(context.Background(), 1, 2, 3, "", 40)
+		db.Close()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		var spent bool
+		for _, statement := range fake.statements() {
+			spent = spent || strings.Contains(statement, "insert into BonusSpends")
+		}
+		if !spent {
+			t.Errorf("%s: bonus wasn't spent: %q", tc.name, fake.statements())
+		}
+	}
+}
+
+func TestReserveWithoutBonus(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	billDB := BillingDB{DB: db}
+	if err := billDB.ReserveMoney(context.Background(), 1, 2, 3, "", 40); err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "BonusSpends") || strings.Contains(statement, "update Bonuses") {
+			t.Errorf("reserve without bonus touched the grants: %q", statement)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+)
+
+// Commands accepted from the message queue.
+const (
+	CommandCredit  = "credit"
+	CommandReserve = "reserve"
+	CommandCapture = "capture"
+	CommandCancel  = "cancel"
+)
+
+// Command statuses in replies.
+const (
+	CommandOK    = "ok"
+	CommandError = "error"
+)
+
+// Command is a billing operation requested through the message queue, the fields mirror the HTTP API.
+type Command struct {
+	Type      string  `json:"type"`
+	UserID    int     `json:"user_id"`
+	ServiceID int     `json:"service_id,omitempty"`
+	OrderID   int     `json:"order_id,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+	Price     float64 `json:"price,omitempty"`
+}
+
+// CommandReply tells the sender how a command ended, Error explains a rejected command.
+type CommandReply struct {
+	MessageID string `json:"message_id"`
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (cmd Command) Validate() error {
+	switch cmd.Type {
+	case CommandCredit, CommandReserve, CommandCapture, CommandCancel:
+	default:
+		return fmt.Errorf("%w. Unknown command %q", ErrWrongOperation, cmd.Type)
+	}
+	return checkPrice(cmd.Price)
+}
+
+// ApplyCommand runs the command once per message id. The command, its effect and the reply are
+// committed together, so a redelivered message only gets the stored reply back.
+// A rejected command is a reply with CommandError, the returned error means the message should be retried:
+// nothing is stored for it, so the next delivery runs the command again.
+func (billDB *BillingDB) ApplyCommand(ctx context.Context, messageID string, cmd Command) (CommandReply, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opCommand)
+	defer cancel()
+
+	encoded, err := json.Marshal(cmd)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	defer tx.Rollback()
+
+	// a concurrent duplicate waits here until the first one commits and then sees the conflict
+	res, err := tx.ExecContext(ctx, `insert into ProcessedCommands (message_id, command, reply, processed_at)
+		values ($1, $2, '{}', $3) on conflict (message_id) do nothing;`, messageID, encoded, time.Now().UTC())
+	if err != nil {
+		return CommandReply{}, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return CommandReply{}, err
+	}
+	if rows == 0 {
+		var stored []byte
+		err = tx.QueryRowContext(ctx, `select reply from ProcessedCommands where message_id = $1;`, messageID).Scan(&stored)
+		if err != nil {
+			return CommandReply{}, err
+		}
+		var reply CommandReply
+		return reply, json.Unmarshal(stored, &reply)
+	}
+
+	reply := CommandReply{MessageID: messageID, Type: cmd.Type, Status: CommandOK}
+	// the savepoint keeps the dedup record when the command itself fails
+	if _, err = tx.ExecContext(ctx, `savepoint command;`); err != nil {
+		return CommandReply{}, err
+	}
+	if cmdErr := billDB.applyCommand(ctx, tx, cmd); cmdErr != nil {
+		if !rejected(cmdErr) {
+			return CommandReply{}, cmdErr
+		}
+		if _, err = tx.ExecContext(ctx, `rollback to savepoint command;`); err != nil {
+			return CommandReply{}, err
+		}
+		reply.Status, reply.Error = CommandError, cmdErr.Error()
+	}
+	encoded, err = json.Marshal(reply)
+	if err != nil {
+		return CommandReply{}, err
+	}
+	if _, err = tx.ExecContext(ctx, `update ProcessedCommands set reply = $2 where message_id = $1;`, messageID, encoded); err != nil {
+		return CommandReply{}, err
+	}
+	return reply, tx.Commit()
+}
+
+// rejected tells a refusal that the same command gets however often it's delivered from a failure
+// like a lost connection or a timeout that a later delivery may not run into.
+// A held command counts as refused, its review is already queued and runs the operation once approved.
+func rejected(err error) bool {
+	for _, refusal := range []error{
+		ErrInvalidAmount, ErrUnsupportedCurrency, ErrNotEnoughMoney, ErrWrongOperation, ErrAccountStatus,
+		ErrLimitExceeded, ErrRiskDenied, ErrHeldForReview, sql.ErrNoRows,
+	} {
+		if errors.Is(err, refusal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (billDB *BillingDB) applyCommand(ctx context.Context, tx *sql.Tx, cmd Command) error {
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+	if cmd.Type == CommandCancel {
+		if err := checkService(cmd.ServiceID); err != nil {
+			return err
+		}
+		return cancellation(ctx, tx, cmd.UserID, cmd.ServiceID, cmd.OrderID)
+	}
+	currency, err := billDB.Currency(cmd.Currency)
+	if err != nil {
+		return err
+	}
+	switch cmd.Type {
+	case CommandCredit:
+		err = billDB.assess(ctx, risk.Operation{Type: risk.OpCredit, UserID: cmd.UserID, Currency: currency, Amount: cmd.Price})
+		if err != nil {
+			return err
+		}
+		return creditUser(ctx, tx, cmd.UserID, currency, cmd.Price)
+	case CommandReserve:
+		err = billDB.assess(ctx, risk.Operation{
+			Type: risk.OpReserve, UserID: cmd.UserID, ServiceID: cmd.ServiceID, OrderID: cmd.OrderID, Currency: currency, Amount: cmd.Price,
+		})
+		if err != nil {
+			return err
+		}
+		return billDB.reserveMoney(ctx, tx, cmd.UserID, cmd.ServiceID, cmd.OrderID, currency, cmd.Price)
+	default:
+		return confirmation(ctx, tx, cmd.UserID, cmd.ServiceID, cmd.OrderID, currency, cmd.Price)
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver standing in for Postgres. It logs statements with their
+// arguments and transaction outcomes, answers the queries of a reserve or credit, and blocks on the statement containing
+// block until the context is done, like a slow query would. The statement containing fail gets errFakeDB, like a lost connection.
+type fakeDB struct {
+	mu      sync.Mutex
+	log     []string
+	args    [][]driver.Value
+	block   string
+	blocked chan struct{}
+	fail    string
+	// rows answers queries containing the key before the built-in answers, results does it with several rows
+	rows    map[string][]driver.Value
+	results map[string][][]driver.Value
+}
+
+var errFakeDB = errors.New("connection reset by peer")
+
+func newFakeDB(block string) (*fakeDB, *sql.DB) {
+	fake := &fakeDB{block: block, blocked: make(chan struct{})}
+	return fake, sql.OpenDB(fake)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (f *fakeDB) record(entry string, args ...driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, entry)
+	f.args = append(f.args, args)
+}
+
+func (f *fakeDB) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.log...)
+}
+
+// argsOf gives the arguments of the last statement containing part.
+func (f *fakeDB) argsOf(part string) []driver.Value {
+	calls := f.callsOf(part)
+	if len(calls) == 0 {
+		return nil
+	}
+	return calls[len(calls)-1]
+}
+
+// callsOf gives the arguments of every statement containing part, in the order they ran.
+func (f *fakeDB) callsOf(part string) [][]driver.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls [][]driver.Value
+	for i, entry := range f.log {
+		if strings.Contains(entry, part) {
+			calls = append(calls, f.args[i])
+		}
+	}
+	return calls
+}
+
+func (f *fakeDB) run(ctx context.Context, query string, args []driver.NamedValue) error {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	f.record(query, values...)
+	if f.block != "" && strings.Contains(query, f.block) {
+		close(f.blocked)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.fail != "" && strings.Contains(query, f.fail) {
+		return errFakeDB
+	}
+	return nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.db.record("begin")
+	return fakeTx{c.db}, nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.db.run(ctx, query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.db.run(ctx, query, args); err != nil {
+		return nil, err
+	}
+	for key, rows := range c.db.results {
+		if strings.Contains(query, key) {
+			if len(rows) == 0 {
+				return &fakeRows{}, nil
+			}
+			columns := make([]string, len(rows[0]))
+			return &fakeRows{columns: columns, values: append([][]driver.Value(nil), rows...)}, nil
+		}
+	}
+	for key, row := range c.db.rows {
+		if strings.Contains(query, key) {
+			columns := make([]string, len(row))
+			return &fakeRows{columns: columns, values: [][]driver.Value{row}}, nil
+		}
+	}
+	switch {
+	case strings.Contains(query, "select credit_limit"):
+		return &fakeRows{columns: []string{"credit_limit"}, values: [][]driver.Value{{0.0}}}, nil
+	case strings.Contains(query, "from Accounts"):
+		return &fakeRows{columns: []string{"status"}, values: [][]driver.Value{{AccountActive}}}, nil
+	case strings.Contains(query, "from Bonuses"):
+		return &fakeRows{}, nil
+	case strings.Contains(query, "returning bonus"):
+		return &fakeRows{columns: []string{"bonus"}, values: [][]driver.Value{{0.0}}}, nil
+	case strings.Contains(query, "for update"), strings.Contains(query, "returning balance, reserved"):
+		return &fakeRows{columns: []string{"balance", "reserved"}, values: [][]driver.Value{{100.0, 0.0}}}, nil
+	case strings.Contains(query, "returning id"):
+		return &fakeRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}}}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (t fakeTx) Commit() error   { t.db.record("commit"); return nil }
+func (t fakeTx) Rollback() error { t.db.record("rollback"); return nil }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// checkRolledBack waits for the rollback database/sql issues when the context ends
+// and makes sure nothing after the blocked statement ran.
+func checkRolledBack(t *testing.T, fake *fakeDB, after string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		statements := fake.statements()
+		last := statements[len(statements)-1]
+		if last == "rollback" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transaction wasn't rolled back: %q", statements)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, statement := range fake.statements() {
+		if statement == "commit" || strings.Contains(statement, after) {
+			t.Errorf("unexpected %q after the cancelled statement", statement)
+		}
+	}
+}
+
+func TestReserveTimeoutRollsBack(t *testing.T) {
+	fake, db := newFakeDB("insert into Transactions")
+	defer db.Close()
+	billDB := BillingDB{DB: db, Timeouts: map[string]time.Duration{OpReserve: 50 * time.Millisecond}}
+
+	err := billDB.ReserveMoney(context.Background(), 1, 2, 3, "", 40)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	checkRolledBack(t, fake, "update Users")
+}
+
+func TestCreditCancelRollsBack(t *testing.T) {
+	fake, db := newFakeDB("insert into Ledger")
+	defer db.Close()
+	billDB := BillingDB{DB: db}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// the client goes away once the balance is updated but before the ledger entry is written
+		<-fake.blocked
+		cancel()
+	}()
+	err := billDB.CreditUser(ctx, 1, "", 100)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	checkRolledBack(t, fake, "insert into Outbox")
+}
+
+// Capture, cancel and refund used to update the order and the wallet in separate statements outside a transaction,
+// a failure between them left an order cancelled with its reserve still held or the balance credited twice.
+func TestOrderChangesRollBack(t *testing.T) {
+	cases := []struct {
+		name   string
+		status string
+		run    func(context.Context, BillingDB) error
+	}{
+		{name: "capture", run: func(ctx context.Context, db BillingDB) error {
+			return db.Confirmation(ctx, 1, 2, 3, "", 40)
+		}},
+		{name: "cancel", status: "reserved", run: func(ctx context.Context, db BillingDB) error {
+			return db.Cancellation(ctx, 1, 2, 3)
+		}},
+		{name: "refund", status: "done", run: func(ctx context.Context, db BillingDB) error {
+			return db.Refund(ctx, 1, 2, 3)
+		}},
+	}
+	for _, tc := range cases {
+		fake, billDB := orderDB()
+		fake.block = "insert into Ledger"
+		fake.rows["select currency, coalesce(order_status"] = []driver.Value{"RUB", tc.status}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if err := tc.run(ctx, billDB); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected context.DeadlineExceeded, got %v", tc.name, err)
+		}
+		cancel()
+		checkRolledBack(t, fake, "insert into Outbox")
+		statements := strings.Join(fake.statements(), "\n")
+		if !strings.Contains(statements, "update Transactions") || !strings.Contains(statements, "update Users") {
+			t.Errorf("%s: expected the order and the wallet to be changed in the rolled back transaction: %s", tc.name, statements)
+		}
+		billDB.Close()
+	}
+}
+
+// A command that failed on a database error used to be stored with an error reply, the redelivered message
+// got that reply instead of running again.
+func TestCommandRetriedAfterFailure(t *testing.T) {
+	fake, db := newFakeDB("insert into Transactions")
+	billDB := BillingDB{DB: db, Timeouts: map[string]time.Duration{opCommand: 50 * time.Millisecond}}
+	cmd := Command{Type: CommandReserve, UserID: 1, ServiceID: 2, OrderID: 3, Price: 40}
+	if _, err := billDB.ApplyCommand(context.Background(), "m-1", cmd); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	checkRolledBack(t, fake, "update ProcessedCommands")
+	db.Close()
+
+	fake, db = newFakeDB("")
+	fake.fail = "insert into Transactions"
+	billDB = BillingDB{DB: db}
+	if _, err := billDB.ApplyCommand(context.Background(), "m-1", cmd); !errors.Is(err, errFakeDB) {
+		t.Fatalf("expected the database error, got %v", err)
+	}
+	for _, statement := range fake.statements() {
+		if statement == "commit" || strings.Contains(statement, "update ProcessedCommands") {
+			t.Errorf("failed command was stored: %q", statement)
+		}
+	}
+	db.Close()
+
+	// not enough money stays so on every delivery, the reply is stored with the dedup record
+	fake, db = newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{"for update": {10.0, 0.0}}
+	billDB = BillingDB{DB: db}
+	reply, err := billDB.ApplyCommand(context.Background(), "m-2", cmd)
+	if err != nil || reply.Status != CommandError || !strings.Contains(reply.Error, ErrNotEnoughMoney.Error()) {
+		t.Fatalf("expected a stored refusal, got %+v, %v", reply, err)
+	}
+	statements := fake.statements()
+	if fake.argsOf("update ProcessedCommands") == nil || statements[len(statements)-1] != "commit" {
+		t.Errorf("refusal wasn't stored: %q", statements)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	billDB := BillingDB{
+		Timeouts:       map[string]time.Duration{opReport: time.Minute},
+		DefaultTimeout: time.Second,
+	}
+	cases := []struct {
+		operation string
+		want      time.Duration
+	}{
+		{opReport, time.Minute},
+		{OpReserve, time.Second},
+	}
+	for _, tc := range cases {
+		ctx, cancel := billDB.withTimeout(context.Background(), tc.operation)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok || time.Until(deadline) > tc.want || time.Until(deadline) < tc.want-time.Second/2 {
+			t.Errorf("%s: expected a deadline in %s, got %v", tc.operation, tc.want, deadline)
+		}
+	}
+
+	ctx, cancel := (&BillingDB{}).withTimeout(context.Background(), OpReserve)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without configured timeouts")
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCurrency is used when a request doesn't name a currency, all balances before wallets were RUB.
+const DefaultCurrency = "RUB"
+
+// Currency normalizes a currency code and checks that wallets in it are allowed.
+func (billDB *BillingDB) Currency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultCurrency, nil
+	}
+	currencies := billDB.Currencies
+	if len(currencies) == 0 {
+		currencies = []string{DefaultCurrency}
+	}
+	for _, currency := range currencies {
+		if strings.ToUpper(currency) == code {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q", ErrUnsupportedCurrency, code)
+}
+
+// Wallet is the balance of a user in one currency.
+// Wallet amounts go below zero only within CreditLimit, Debt is the part of Total below zero.
+type Wallet struct {
+	Currency    string  `json:"currency"`
+	Total       float64 `json:"total"`
+	Held        float64 `json:"held"`
+	Available   float64 `json:"available"`
+	CreditLimit float64 `json:"credit_limit,omitempty"`
+	Debt        float64 `json:"debt,omitempty"`
+	// Bonus is the unexpired promotional money, it isn't part of Total.
+	Bonus float64 `json:"bonus,omitempty"`
+}
+
+func (billDB *BillingDB) Wallets(ctx context.Context, userID int) ([]Wallet, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select currency, balance, reserved, credit_limit, debt, `+bonusBalance+` from Users
+		where id = $1 order by currency;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	wallets := []Wallet{}
+	for rows.Next() {
+		var wallet Wallet
+		if err = rows.Scan(&wallet.Currency, &wallet.Total, &wallet.Held, &wallet.CreditLimit, &wallet.Debt, &wallet.Bonus); err != nil {
+			return nil, err
+		}
+		wallet.Available = wallet.Total - wallet.Held
+		wallets = append(wallets, wallet)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(wallets) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return wallets, nil
+}
+
+// Conversion is the audit record of money moved between two wallets of a user.
+type Conversion struct {
+	ID           int64     `json:"id"`
+	UserID       int       `json:"user_id"`
+	FromCurrency string    `json:"from_currency"`
+	ToCurrency   string    `json:"to_currency"`
+	Amount       float64   `json:"amount"`
+	Rate         float64   `json:"rate"`
+	Converted    float64   `json:"converted"`
+	RateSource   string    `json:"rate_source"`
+	RateDate     time.Time `json:"rate_date"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Convert moves amount from the user's fromCurrency wallet to the toCurrency wallet at the given rate
+// (units of toCurrency for one unit of fromCurrency) and stores the rate used.
+func (billDB *BillingDB) Convert(ctx context.Context, conversion Conversion) (Conversion, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opConvert)
+	defer cancel()
+
+	var err error
+	if conversion.FromCurrency, err = billDB.Currency(conversion.FromCurrency); err != nil {
+		return Conversion{}, err
+	}
+	if conversion.ToCurrency, err = billDB.Currency(conversion.ToCurrency); err != nil {
+		return Conversion{}, err
+	}
+	if conversion.FromCurrency == conversion.ToCurrency {
+		return Conversion{}, fmt.Errorf("%w. Nothing to convert from %s to %s",
+			ErrWrongOperation, conversion.FromCurrency, conversion.ToCurrency)
+	}
+	if conversion.Amount <= 0 || conversion.Rate <= 0 {
+		return Conversion{}, fmt.Errorf("%w. Amount (%f) and rate (%f) must be positive",
+			ErrWrongOperation, conversion.Amount, conversion.Rate)
+	}
+	conversion.Converted = money(conversion.Amount * conversion.Rate)
+	conversion.CreatedAt = time.Now().UTC()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Conversion{}, err
+	}
+	defer tx.Rollback()
+
+	if err = checkStatus(ctx, tx, conversion.UserID, opConvert, true); err != nil {
+		return Conversion{}, err
+	}
+	// wallets are always locked in the same order, so two opposite conversions can't deadlock
+	currencies := []string{conversion.FromCurrency, conversion.ToCurrency}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		_, err = tx.ExecContext(ctx, `insert into Users (id, currency, balance, reserved) values ($1, $2, 0, 0)
+			on conflict (id, currency) do nothing;`, conversion.UserID, currency)
+		if err != nil {
+			return Conversion{}, err
+		}
+	}
+	balances := map[string][2]float64{}
+	for _, currency := range currencies {
+		balance, reserved, err := lockUser(ctx, tx, conversion.UserID, currency)
+		if err != nil {
+			return Conversion{}, err
+		}
+		balances[currency] = [2]float64{balance, reserved}
+	}
+
+	from, to := balances[conversion.FromCurrency], balances[conversion.ToCurrency]
+	if from[0]-from[1]-conversion.Amount < 0 {
+		return Conversion{}, fmt.Errorf("%w for conversion. Your current balance: %f %s, reserved: %f",
+			ErrNotEnoughMoney, from[0], conversion.FromCurrency, from[1])
+	}
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`,
+		conversion.UserID, conversion.FromCurrency, from[0]-conversion.Amount)
+	if err != nil {
+		return Conversion{}, err
+	}
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`,
+		conversion.UserID, conversion.ToCurrency, to[0]+conversion.Converted)
+	if err != nil {
+		return Conversion{}, err
+	}
+	err = tx.QueryRowContext(ctx, `insert into Conversions
+		(user_id, from_currency, to_currency, amount, rate, converted, rate_source, rate_date, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id;`,
+		conversion.UserID, conversion.FromCurrency, conversion.ToCurrency, conversion.Amount, conversion.Rate,
+		conversion.Converted, conversion.RateSource, conversion.RateDate.UTC(), conversion.CreatedAt).Scan(&conversion.ID)
+	if err != nil {
+		return Conversion{}, err
+	}
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: conversion.UserID, Currency: conversion.FromCurrency, Operation: OpConvertOut,
+		Amount: conversion.Amount, Balance: from[0] - conversion.Amount, Reserved: from[1], CreatedAt: conversion.CreatedAt,
+	})
+	if err != nil {
+		return Conversion{}, err
+	}
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: conversion.UserID, Currency: conversion.ToCurrency, Operation: OpConvertIn,
+		Amount: conversion.Converted, Balance: to[0] + conversion.Converted, Reserved: to[1], CreatedAt: conversion.CreatedAt,
+	})
+	if err != nil {
+		return Conversion{}, err
+	}
+	return conversion, tx.Commit()
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Domain errors. Operations wrap them with details, callers tell them apart with errors.Is;
+// sql.ErrNoRows still means that the user, order or credit doesn't exist.
+var (
+	ErrInvalidAmount       = errors.New("price can't be lower than 0")
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrNotEnoughMoney      = errors.New("not enough money")
+	ErrWrongOperation      = errors.New("wrong operation")
+	ErrAccountStatus       = errors.New("account status doesn't allow the operation")
+	ErrLimitExceeded       = errors.New("spending limit exceeded")
+	ErrRiskDenied          = errors.New("operation denied by risk rules")
+	ErrHeldForReview       = errors.New("operation held for review")
+	ErrInvalidVoucher      = errors.New("voucher can't be used")
+)
+
+func checkPrice(price float64) error {
+	if price < 0 {
+		return ErrInvalidAmount
+	}
+	return nil
+}
+
+// checkService refuses a missing service id: an order is only identified by its user, service and order ids.
+func checkService(serviceID int) error {
+	if serviceID <= 0 {
+		return fmt.Errorf("%w. Service id is required", ErrWrongOperation)
+	}
+	return nil
+}
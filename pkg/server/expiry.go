@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// ExpireReserves releases the reserves whose expires_at passed before now and returns how many were released.
+// Reserves of blocked accounts stay held until the account is unblocked.
+func (billDB *BillingDB) ExpireReserves(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpExpire)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select user_id, service_id, order_id, currency from Transactions
+		where order_status = 'reserved' and expires_at <= $1
+		and user_id not in (select user_id from Accounts where status = 'blocked')
+		order by expires_at limit 100;`, now)
+	if err != nil {
+		return 0, err
+	}
+	type order struct {
+		userID, serviceID, orderID int
+		currency                   string
+	}
+	var orders []order
+	for rows.Next() {
+		var o order
+		if err = rows.Scan(&o.userID, &o.serviceID, &o.orderID, &o.currency); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, o := range orders {
+		err = billDB.expireReserve(ctx, o.userID, o.serviceID, o.orderID, o.currency, now)
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrAccountStatus) {
+			// captured or cancelled in the meantime, or the account got blocked
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+func (billDB *BillingDB) expireReserve(ctx context.Context, userID, serviceID, orderID int, currency string, now time.Time) error {
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkStatus(ctx, tx, userID, OpExpire, false); err != nil {
+		return err
+	}
+	usersBalance, usersReserve, err := lockUser(ctx, tx, userID, currency)
+	if err != nil {
+		return err
+	}
+	var cost, bonus, discount float64
+	err = tx.QueryRowContext(ctx, `select cost - bonus, bonus, discount from Transactions
+		where order_id = $1 and user_id = $2 and service_id = $3 and currency = $4 and order_status = 'reserved'
+		and expires_at <= $5 for update;`, orderID, userID, serviceID, currency, now).Scan(&cost, &bonus, &discount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update Transactions set order_status = 'expired', date = $4
+		where order_id = $1 and user_id = $2 and service_id = $3 and order_status = 'reserved';`,
+		orderID, userID, serviceID, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update Users set reserved = $3 where id = $1 and currency = $2;`, userID, currency, usersReserve-cost)
+	if err != nil {
+		return err
+	}
+	if bonus > 0 {
+		if err = returnBonus(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+	if discount > 0 {
+		if err = releaseVoucher(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+	log.Printf("Reserve of order %d of user %d expired", orderID, userID)
+
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpExpire, OrderID: orderID, ServiceID: serviceID,
+		Amount: cost, Balance: usersBalance, Reserved: usersReserve - cost,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
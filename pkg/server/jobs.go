@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Report job statuses.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// MaxJobAttempts is how many times a job is claimed before a job whose worker keeps dying is failed.
+const MaxJobAttempts = 3
+
+type ReportJob struct {
+	ID         string       `json:"id"`
+	Params     ReportParams `json:"params"`
+	Status     string       `json:"status"`
+	Error      string       `json:"error,omitempty"`
+	Attempts   int          `json:"attempts"`
+	BlobKey    string       `json:"-"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+}
+
+// CreateReportJob stores a new queued job for the given report.
+func (billDB *BillingDB) CreateReportJob(ctx context.Context, params ReportParams) (ReportJob, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ReportJob{}, err
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return ReportJob{}, err
+	}
+	job := ReportJob{
+		ID:        hex.EncodeToString(id),
+		Params:    params,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = billDB.DB.ExecContext(ctx, `insert into ReportJobs (id, params, status, created_at) values ($1, $2, $3, $4);`,
+		job.ID, encoded, job.Status, job.CreatedAt)
+	if err != nil {
+		return ReportJob{}, err
+	}
+	return job, nil
+}
+
+// ClaimReportJob marks the oldest queued job as running and returns it. The claim is a lease: a running job
+// that wasn't renewed by HeartbeatReportJob for lease belongs to a dead worker and is claimed again,
+// or failed once it was claimed MaxJobAttempts times.
+// sql.ErrNoRows is returned when the queue is empty. Concurrent workers never get the same job.
+func (billDB *BillingDB) ClaimReportJob(ctx context.Context, lease time.Duration) (ReportJob, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := time.Now().UTC()
+	stale := now.Add(-lease)
+	_, err := billDB.DB.ExecContext(ctx, `update ReportJobs set status = $1, error = $2, finished_at = $3
+		where status = $4 and claimed_at < $5 and attempts >= $6;`,
+		JobFailed, "report worker stopped responding", now, JobRunning, stale, MaxJobAttempts)
+	if err != nil {
+		return ReportJob{}, err
+	}
+	var job ReportJob
+	var params []byte
+	err = billDB.DB.QueryRowContext(ctx, `
+		update ReportJobs set status = $1, claimed_at = $3, attempts = attempts + 1
+		where id = (
+			select id from ReportJobs where status = $2 or status = $1 and claimed_at < $4
+			order by created_at
+			limit 1
+			for update skip locked
+		)
+		returning id, params, status, attempts, created_at;`, JobRunning, JobQueued, now, stale).
+		Scan(&job.ID, &params, &job.Status, &job.Attempts, &job.CreatedAt)
+	if err != nil {
+		return ReportJob{}, err
+	}
+	if err = json.Unmarshal(params, &job.Params); err != nil {
+		return ReportJob{}, err
+	}
+	return job, nil
+}
+
+// HeartbeatReportJob renews the lease of a running job.
+func (billDB *BillingDB) HeartbeatReportJob(ctx context.Context, id string) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := billDB.DB.ExecContext(ctx, `update ReportJobs set claimed_at = $3 where id = $1 and status = $2;`,
+		id, JobRunning, time.Now().UTC())
+	return err
+}
+
+// FinishReportJob records the outcome of a job, jobErr is nil on success.
+func (billDB *BillingDB) FinishReportJob(ctx context.Context, id, blobKey string, jobErr error) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	status, message := JobDone, ""
+	if jobErr != nil {
+		status, message = JobFailed, jobErr.Error()
+	}
+	_, err := billDB.DB.ExecContext(ctx, `update ReportJobs set status = $2, error = $3, blob_key = $4, finished_at = $5 where id = $1;`,
+		id, status, message, blobKey, time.Now().UTC())
+	return err
+}
+
+func (billDB *BillingDB) GetReportJob(ctx context.Context, id string) (ReportJob, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var job ReportJob
+	var params []byte
+	var finishedAt sql.NullTime
+	err := billDB.DB.QueryRowContext(ctx, `
+		select id, params, status, error, attempts, blob_key, created_at, finished_at
+		from ReportJobs where id = $1;`, id).
+		Scan(&job.ID, &params, &job.Status, &job.Error, &job.Attempts, &job.BlobKey, &job.CreatedAt, &finishedAt)
+	if err != nil {
+		return ReportJob{}, err
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	if err = json.Unmarshal(params, &job.Params); err != nil {
+		return ReportJob{}, err
+	}
+	return job, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimReportJob(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"returning id, params, status, attempts": {"abc", []byte(`{"type": "monthly", "date": "2022-11"}`), JobRunning,
+			int64(2), time.Now()},
+	}
+	billDB := BillingDB{DB: db}
+	job, err := billDB.ClaimReportJob(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "abc" || job.Attempts != 2 || job.Params.Date != "2022-11" {
+		t.Errorf("unexpected job %+v", job)
+	}
+	statements := fake.statements()
+	if len(statements) != 2 || !strings.Contains(statements[0], "attempts >= $6") ||
+		!strings.Contains(statements[1], "status = $1 and claimed_at < $4") {
+		t.Errorf("stale jobs weren't failed or claimed again: %q", statements)
+	}
+}
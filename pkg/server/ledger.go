@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Ledger operations, one entry is written for every balance affecting action.
+const (
+	OpCredit  = "credit"
+	OpReserve = "reserve"
+	OpCapture = "capture"
+	OpCancel  = "cancel"
+	OpRefund  = "refund"
+	OpExpire  = "expire"
+
+	OpConvertOut = "convert_out"
+	OpConvertIn  = "convert_in"
+
+	// OpTransfer takes money from the sender of a transfer, OpTransferIn gives it to the receiver.
+	OpTransfer   = "transfer"
+	OpTransferIn = "transfer_in"
+
+	// OpAdjustment is a manual correction by support, its amount is negative for a debit.
+	OpAdjustment = "adjustment"
+
+	// OpOpening is the balance a wallet had before the ledger, written once by the schema migration.
+	OpOpening = "opening"
+)
+
+// LedgerEntry records an operation together with the user's balance and reserve right after it.
+// OrderID and ServiceID are 0 for operations without an order.
+type LedgerEntry struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	Currency  string    `json:"currency"`
+	Operation string    `json:"operation"`
+	OrderID   int       `json:"order_id,omitempty"`
+	ServiceID int       `json:"service_id,omitempty"`
+	Amount    float64   `json:"amount"`
+	Balance   float64   `json:"balance"`
+	Reserved  float64   `json:"reserved"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// addLedgerEntry writes the entry, its audit record and, for operations other services care about,
+// its event to the outbox.
+func addLedgerEntry(ctx context.Context, tx *sql.Tx, entry LedgerEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	if err := addAuditEntry(ctx, tx, entry); err != nil {
+		return err
+	}
+	err := tx.QueryRowContext(ctx, `insert into Ledger (user_id, currency, operation, order_id, service_id, amount, balance, reserved, created_at)
+		values ($1, $2, $3, nullif($4, 0), nullif($5, 0), $6, $7, $8, $9) returning id;`,
+		entry.UserID, entry.Currency, entry.Operation, entry.OrderID, entry.ServiceID,
+		entry.Amount, entry.Balance, entry.Reserved, entry.CreatedAt).Scan(&entry.ID)
+	if err != nil {
+		return err
+	}
+	if eventType, ok := ledgerEvents[entry.Operation]; ok {
+		return addEvent(ctx, tx, eventType, entry)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Spending limit windows.
+const (
+	LimitTransaction = "transaction"
+	LimitDay         = "day"
+	LimitMonth       = "month"
+)
+
+// SpendingLimit caps what a user may spend from a wallet: per transaction, per calendar day and per
+// calendar month in the user's timezone. Spending is the full price of reserves, bonus included, and transfers
+// to other users. ServiceID 0 applies to all services and transfers, 0 means no cap.
+type SpendingLimit struct {
+	UserID         int       `json:"user_id"`
+	Currency       string    `json:"currency"`
+	ServiceID      int       `json:"service_id"`
+	PerTransaction float64   `json:"per_transaction"`
+	PerDay         float64   `json:"per_day"`
+	PerMonth       float64   `json:"per_month"`
+	UpdatedBy      string    `json:"updated_by"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (limit SpendingLimit) Validate() error {
+	for _, value := range []float64{limit.PerTransaction, limit.PerDay, limit.PerMonth} {
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%w. Spending limits must be non-negative numbers", ErrInvalidAmount)
+		}
+	}
+	if limit.PerTransaction == 0 && limit.PerDay == 0 && limit.PerMonth == 0 {
+		return fmt.Errorf("%w. Spending limit needs at least one cap", ErrWrongOperation)
+	}
+	if limit.ServiceID < 0 {
+		return fmt.Errorf("%w. Service id can't be negative", ErrWrongOperation)
+	}
+	return nil
+}
+
+// LimitUsage is how much of a spending limit the user has used in the current day and month.
+// Remaining amounts are nil for windows without a cap.
+type LimitUsage struct {
+	SpendingLimit
+	Timezone           string    `json:"timezone"`
+	DayStart           time.Time `json:"day_start"`
+	MonthStart         time.Time `json:"month_start"`
+	SpentToday         float64   `json:"spent_today"`
+	SpentThisMonth     float64   `json:"spent_this_month"`
+	RemainingToday     *float64  `json:"remaining_today,omitempty"`
+	RemainingThisMonth *float64  `json:"remaining_this_month,omitempty"`
+}
+
+// LimitError tells which spending limit a reserve or transfer would break and how much of it is left.
+type LimitError struct {
+	Window    string  `json:"window"`
+	ServiceID int     `json:"service_id"`
+	Currency  string  `json:"currency"`
+	Limit     float64 `json:"limit"`
+	Remaining float64 `json:"remaining"`
+}
+
+func (e *LimitError) Error() string {
+	scope := "all services"
+	if e.ServiceID != 0 {
+		scope = fmt.Sprintf("service %d", e.ServiceID)
+	}
+	return fmt.Sprintf("%s. Limit per %s for %s is %.2f %s, remaining %.2f %s",
+		ErrLimitExceeded, e.Window, scope, e.Limit, e.Currency, e.Remaining, e.Currency)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// querier is what limits need from either the database or a transaction.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+const spendingLimitColumns = `user_id, currency, service_id, per_transaction, per_day, per_month, updated_by, updated_at`
+
+func scanSpendingLimit(row interface{ Scan(...interface{}) error }) (SpendingLimit, error) {
+	var limit SpendingLimit
+	err := row.Scan(&limit.UserID, &limit.Currency, &limit.ServiceID, &limit.PerTransaction, &limit.PerDay, &limit.PerMonth,
+		&limit.UpdatedBy, &limit.UpdatedAt)
+	return limit, err
+}
+
+// spendingLimits lists the user's limits on the wallet, only those applying to serviceID unless it is -1.
+func spendingLimits(ctx context.Context, q querier, userID int, currency string, serviceID int) ([]SpendingLimit, error) {
+	rows, err := q.QueryContext(ctx, `select `+spendingLimitColumns+` from SpendingLimits
+		where user_id = $1 and ($2 = '' or currency = $2) and ($3 = -1 or service_id in (0, $3))
+		order by currency, service_id;`, userID, currency, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	limits := []SpendingLimit{}
+	for rows.Next() {
+		limit, err := scanSpendingLimit(rows)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+	return limits, rows.Err()
+}
+
+// SetSpendingLimit creates or replaces the user's limit on the wallet and service.
+func (billDB *BillingDB) SetSpendingLimit(ctx context.Context, limit SpendingLimit) (SpendingLimit, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if err := limit.Validate(); err != nil {
+		return SpendingLimit{}, err
+	}
+	currency, err := billDB.Currency(limit.Currency)
+	if err != nil {
+		return SpendingLimit{}, err
+	}
+	limit.Currency = currency
+	limit.UpdatedBy = auditInfo(ctx).Actor
+	limit.UpdatedAt = time.Now().UTC()
+	_, err = billDB.DB.ExecContext(ctx, `insert into SpendingLimits (`+spendingLimitColumns+`)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (user_id, currency, service_id) do update set per_transaction = excluded.per_transaction,
+		per_day = excluded.per_day, per_month = excluded.per_month,
+		updated_by = excluded.updated_by, updated_at = excluded.updated_at;`,
+		limit.UserID, limit.Currency, limit.ServiceID, money(limit.PerTransaction), money(limit.PerDay), money(limit.PerMonth),
+		limit.UpdatedBy, limit.UpdatedAt)
+	if err != nil {
+		return SpendingLimit{}, err
+	}
+	return limit, nil
+}
+
+// DeleteSpendingLimit removes the user's limit on the wallet and service.
+func (billDB *BillingDB) DeleteSpendingLimit(ctx context.Context, userID int, currency string, serviceID int) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return err
+	}
+	res, err := billDB.DB.ExecContext(ctx, `delete from SpendingLimits where user_id = $1 and currency = $2 and service_id = $3;`,
+		userID, currency, serviceID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SpendingLimits lists all limits of the user.
+func (billDB *BillingDB) SpendingLimits(ctx context.Context, userID int) ([]SpendingLimit, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return spendingLimits(ctx, billDB.DB, userID, "", -1)
+}
+
+// SetTimezone sets the IANA timezone in which the user's limit days and months start.
+func (billDB *BillingDB) SetTimezone(ctx context.Context, userID int, timezone string) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "" {
+		return fmt.Errorf("%w. Unknown timezone %q", ErrWrongOperation, timezone)
+	}
+	_, err := billDB.DB.ExecContext(ctx, `insert into Accounts (user_id, status, timezone, updated_at) values ($1, $2, $3, $4)
+		on conflict (user_id) do update set timezone = excluded.timezone;`, userID, AccountActive, timezone, time.Now().UTC())
+	return err
+}
+
+// userLocation loads the user's timezone, UTC when it isn't set.
+func userLocation(ctx context.Context, q querier, userID int) (*time.Location, error) {
+	var timezone string
+	err := q.QueryRowContext(ctx, `select timezone from Accounts where user_id = $1;`, userID).Scan(&timezone)
+	if err == sql.ErrNoRows {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(timezone)
+}
+
+// limitWindows returns the UTC start of the day and of the month now falls in, both taken in loc.
+func limitWindows(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := now.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+	return day.UTC(), month.UTC()
+}
+
+// limitUsage sums the reserves and transfers the limit covers since the starts of the day and the month.
+// A reserve counts with the bonus part of its price, reserves that were later cancelled, expired or refunded
+// don't count; order ids are per service, so the reversal must be of the same service's order.
+// Transfers have no service, only limits for all services cover them.
+func limitUsage(ctx context.Context, q querier, limit SpendingLimit, loc *time.Location, now time.Time) (LimitUsage, error) {
+	usage := LimitUsage{SpendingLimit: limit, Timezone: loc.String()}
+	usage.DayStart, usage.MonthStart = limitWindows(now, loc)
+	err := q.QueryRowContext(ctx, `select coalesce(sum(l.amount + coalesce(t.bonus, 0)) filter (where l.created_at >= $3), 0),
+			coalesce(sum(l.amount + coalesce(t.bonus, 0)), 0)
+		from Ledger l
+		left join Transactions t on l.operation = 'reserve' and t.user_id = l.user_id and t.order_id = l.order_id
+			and t.service_id = l.service_id and t.order_status in ('reserved', 'done')
+		where l.user_id = $1 and l.currency = $2 and l.operation in ('reserve', 'transfer') and l.created_at >= $4
+		and ($5 = 0 or l.service_id = $5)
+		and not exists (select 1 from Ledger r where r.user_id = l.user_id and r.order_id = l.order_id
+			and r.service_id = l.service_id and r.operation in ('cancel', 'expire', 'refund') and r.id > l.id);`,
+		limit.UserID, limit.Currency, usage.DayStart, usage.MonthStart, limit.ServiceID).
+		Scan(&usage.SpentToday, &usage.SpentThisMonth)
+	if err != nil {
+		return LimitUsage{}, err
+	}
+	if limit.PerDay > 0 {
+		remaining := math.Max(money(limit.PerDay-usage.SpentToday), 0)
+		usage.RemainingToday = &remaining
+	}
+	if limit.PerMonth > 0 {
+		remaining := math.Max(money(limit.PerMonth-usage.SpentThisMonth), 0)
+		usage.RemainingThisMonth = &remaining
+	}
+	return usage, nil
+}
+
+// check returns a LimitError when price doesn't fit into the usage.
+func (usage LimitUsage) check(price float64) error {
+	limitErr := &LimitError{ServiceID: usage.ServiceID, Currency: usage.Currency}
+	switch {
+	case usage.PerTransaction > 0 && price > usage.PerTransaction:
+		limitErr.Window, limitErr.Limit, limitErr.Remaining = LimitTransaction, usage.PerTransaction, usage.PerTransaction
+	case usage.RemainingToday != nil && price > *usage.RemainingToday:
+		limitErr.Window, limitErr.Limit, limitErr.Remaining = LimitDay, usage.PerDay, *usage.RemainingToday
+	case usage.RemainingThisMonth != nil && price > *usage.RemainingThisMonth:
+		limitErr.Window, limitErr.Limit, limitErr.Remaining = LimitMonth, usage.PerMonth, *usage.RemainingThisMonth
+	default:
+		return nil
+	}
+	return limitErr
+}
+
+// checkLimits refuses a reserve or transfer of price that breaks one of the user's limits for the wallet
+// and service, transfers pass service 0. Callers hold the wallet lock, so concurrent spending is counted
+// one after another.
+func checkLimits(ctx context.Context, tx *sql.Tx, userID, serviceID int, currency string, price float64) error {
+	limits, err := spendingLimits(ctx, tx, userID, currency, serviceID)
+	if err != nil || len(limits) == 0 {
+		return err
+	}
+	loc, err := userLocation(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, limit := range limits {
+		usage, err := limitUsage(ctx, tx, limit, loc, now)
+		if err != nil {
+			return err
+		}
+		if err = usage.check(price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LimitUsage reports every limit of the user with what is used and left in the current windows.
+func (billDB *BillingDB) LimitUsage(ctx context.Context, userID int, now time.Time) ([]LimitUsage, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	limits, err := spendingLimits(ctx, billDB.DB, userID, "", -1)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := userLocation(ctx, billDB.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	usages := make([]LimitUsage, 0, len(limits))
+	for _, limit := range limits {
+		usage, err := limitUsage(ctx, billDB.DB, limit, loc, now)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitWindows(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		now        string
+		loc        *time.Location
+		day, month string
+	}{
+		{"2022-11-15T10:00:00Z", time.UTC, "2022-11-15T00:00:00Z", "2022-11-01T00:00:00Z"},
+		// already December 1st in Moscow
+		{"2022-11-30T22:30:00Z", moscow, "2022-11-30T21:00:00Z", "2022-11-30T21:00:00Z"},
+		// still October 31st in New York
+		{"2022-11-01T02:00:00Z", newYork, "2022-10-31T04:00:00Z", "2022-10-01T04:00:00Z"},
+	}
+	for _, tc := range cases {
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		day, month := limitWindows(now, tc.loc)
+		if got := day.Format(time.RFC3339); got != tc.day {
+			t.Errorf("%s in %s: expected the day to start at %s, got %s", tc.now, tc.loc, tc.day, got)
+		}
+		if got := month.Format(time.RFC3339); got != tc.month {
+			t.Errorf("%s in %s: expected the month to start at %s, got %s", tc.now, tc.loc, tc.month, got)
+		}
+	}
+}
+
+func TestSpendingLimitValidate(t *testing.T) {
+	cases := []struct {
+		limit SpendingLimit
+		want  error
+	}{
+		{SpendingLimit{PerDay: 100}, nil},
+		{SpendingLimit{ServiceID: 3, PerTransaction: 10, PerMonth: 1000}, nil},
+		{SpendingLimit{}, ErrWrongOperation},
+		{SpendingLimit{PerDay: -1}, ErrInvalidAmount},
+		{SpendingLimit{ServiceID: -1, PerDay: 100}, ErrWrongOperation},
+	}
+	for _, tc := range cases {
+		if err := tc.limit.Validate(); !errors.Is(err, tc.want) {
+			t.Errorf("%+v: expected %v, got %v", tc.limit, tc.want, err)
+		}
+	}
+}
+
+func TestLimitUsageCheck(t *testing.T) {
+	remaining := func(value float64) *float64 { return &value }
+	usage := LimitUsage{
+		SpendingLimit:      SpendingLimit{Currency: "RUB", PerTransaction: 50, PerDay: 100, PerMonth: 1000},
+		RemainingToday:     remaining(30),
+		RemainingThisMonth: remaining(20),
+	}
+	cases := []struct {
+		price     float64
+		window    string
+		remaining float64
+	}{
+		{10, "", 0},
+		{20, "", 0},
+		{60, LimitTransaction, 50},
+		{40, LimitDay, 30},
+		{25, LimitMonth, 20},
+	}
+	for _, tc := range cases {
+		err := usage.check(tc.price)
+		var limitErr *LimitError
+		if tc.window == "" {
+			if err != nil {
+				t.Errorf("%f: unexpected %v", tc.price, err)
+			}
+			continue
+		}
+		if !errors.As(err, &limitErr) || !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%f: expected a LimitError, got %v", tc.price, err)
+		}
+		if limitErr.Window != tc.window || limitErr.Remaining != tc.remaining {
+			t.Errorf("%f: expected %s with %f remaining, got %+v", tc.price, tc.window, tc.remaining, limitErr)
+		}
+	}
+}
+
+func TestReserveChecksLimits(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from SpendingLimits": {int64(1), "RUB", int64(2), 0.0, 100.0, 0.0, "admin", time.Now()},
+		"select timezone":     {"Europe/Moscow"},
+		"from Ledger l":       {70.0, 70.0},
+		// bonus paying the whole price doesn't get the reserve past the limit
+		"from Bonuses": {int64(7), 40.0},
+	}
+	billDB := BillingDB{DB: db}
+	err := billDB.ReserveMoney(context.Background(), 1, 2, 3, "", 40)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Window != LimitDay || limitErr.Remaining != 30 {
+		t.Fatalf("expected the daily limit with 30 remaining, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "remaining 30.00 RUB") {
+		t.Errorf("error doesn't show the allowance: %v", err)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "insert into Transactions") {
+			t.Errorf("refused reserve still wrote %q", statement)
+		}
+		// a cancel of the same order id at another service doesn't give the allowance back
+		if strings.Contains(statement, "from Ledger l") && !strings.Contains(statement, "r.service_id = l.service_id") {
+			t.Errorf("usage doesn't match reversals by service: %q", statement)
+		}
+	}
+	if err = billDB.ReserveMoney(context.Background(), 1, 2, 3, "", 30); err != nil {
+		t.Errorf("reserve within the limit failed: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Domain events published through the outbox.
+const (
+	EventUserCredited     = "UserCredited"
+	EventFundsReserved    = "FundsReserved"
+	EventReserveCaptured  = "ReserveCaptured"
+	EventReserveCancelled = "ReserveCancelled"
+	EventReserveExpired   = "ReserveExpired"
+	EventRefunded         = "Refunded"
+)
+
+// EventTypes lists every event the outbox can hold.
+var EventTypes = []string{
+	EventUserCredited, EventFundsReserved, EventReserveCaptured, EventReserveCancelled, EventReserveExpired, EventRefunded,
+}
+
+// ledgerEvents maps ledger operations to the events they raise, conversions and transfers raise none.
+var ledgerEvents = map[string]string{
+	OpCredit:  EventUserCredited,
+	OpReserve: EventFundsReserved,
+	OpCapture: EventReserveCaptured,
+	OpCancel:  EventReserveCancelled,
+	OpExpire:  EventReserveExpired,
+	OpRefund:  EventRefunded,
+}
+
+// Event is a domain event waiting in the outbox, Data holds the ledger entry that raised it.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	UserID    int             `json:"user_id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// addEvent writes an event to the outbox in the transaction of the change it describes.
+// The per-user transaction lock makes outbox ids of one user follow commit order,
+// so a relay reading by id never sees a later event of the user before an earlier one.
+func addEvent(ctx context.Context, tx *sql.Tx, eventType string, entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext('outbox'), $1);`, entry.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `insert into Outbox (event_type, user_id, payload, created_at) values ($1, $2, $3, $4);`,
+		eventType, entry.UserID, data, entry.CreatedAt)
+	return err
+}
+
+// PendingEvents returns up to limit unpublished events in the order they were committed.
+func (billDB *BillingDB) PendingEvents(ctx context.Context, limit int) ([]Event, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, event_type, user_id, payload, created_at
+		from Outbox where published_at is null order by id limit $1;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err = rows.Scan(&event.ID, &event.Type, &event.UserID, &event.Data, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// MarkEventsPublished records that the events reached the sink.
+func (billDB *BillingDB) MarkEventsPublished(ctx context.Context, ids []int64) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := billDB.DB.ExecContext(ctx, `update Outbox set published_at = $2 where id = any($1);`,
+		pq.Array(ids), time.Now().UTC())
+	return err
+}
+
+// LockOutbox makes the caller the only relay of the outbox while ok is true.
+// The lock lives as long as the returned connection, release closes it.
+func (billDB *BillingDB) LockOutbox(ctx context.Context) (release func(), ok bool, err error) {
+	conn, err := billDB.DB.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock(hashtext('outbox_relay'));`).Scan(&ok)
+	if err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+	return func() { conn.Close() }, true, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+)
+
+// creditLimit reads how far below zero the available balance of the wallet may go.
+func creditLimit(ctx context.Context, tx *sql.Tx, userID int, currency string) (float64, error) {
+	var limit float64
+	err := tx.QueryRowContext(ctx, `select credit_limit from Users where id = $1 and currency = $2;`, userID, currency).Scan(&limit)
+	return limit, err
+}
+
+// SetCreditLimit lets the user's wallet go below zero by up to limit, creating the wallet if needed.
+// Lowering the limit doesn't touch existing debt, it only stops new reserves and captures.
+func (billDB *BillingDB) SetCreditLimit(ctx context.Context, userID int, currency string, limit float64) (Wallet, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if limit < 0 || math.IsNaN(limit) || math.IsInf(limit, 0) {
+		return Wallet{}, fmt.Errorf("%w. Credit limit must be a non-negative number", ErrInvalidAmount)
+	}
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return Wallet{}, err
+	}
+	wallet := Wallet{Currency: currency}
+	err = billDB.DB.QueryRowContext(ctx, `insert into Users (id, currency, balance, reserved, credit_limit) values ($1, $2, 0, 0, $3)
+		on conflict (id, currency) do update set credit_limit = excluded.credit_limit
+		returning balance, reserved, credit_limit, debt;`, userID, currency, money(limit)).
+		Scan(&wallet.Total, &wallet.Held, &wallet.CreditLimit, &wallet.Debt)
+	if err != nil {
+		return Wallet{}, err
+	}
+	wallet.Available = wallet.Total - wallet.Held
+	return wallet, nil
+}
+
+// Debtor is an overdrawn wallet. The debt is due DebtTerm after it started.
+type Debtor struct {
+	UserID      int       `json:"user_id"`
+	Currency    string    `json:"currency"`
+	Debt        float64   `json:"debt"`
+	CreditLimit float64   `json:"credit_limit"`
+	DebtSince   time.Time `json:"debt_since"`
+	DueAt       time.Time `json:"due_at"`
+	DaysPastDue int       `json:"days_past_due"`
+}
+
+type DebtorsReport struct {
+	Date    time.Time `json:"date"`
+	Debtors []Debtor  `json:"debtors"`
+}
+
+// daysPastDue counts the whole days between due and now, 0 while the debt isn't due yet.
+func daysPastDue(due, now time.Time) int {
+	if !now.After(due) {
+		return 0
+	}
+	return int(now.Sub(due) / (24 * time.Hour))
+}
+
+// DebtorsReport lists the wallets in debt at now, the longest overdue first.
+func (billDB *BillingDB) DebtorsReport(ctx context.Context, now time.Time) (DebtorsReport, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, currency, debt, credit_limit, debt_since from Users
+		where debt > 0 order by debt_since, id, currency;`)
+	if err != nil {
+		return DebtorsReport{}, err
+	}
+	defer rows.Close()
+	debtors := DebtorsReport{Date: now.UTC(), Debtors: []Debtor{}}
+	for rows.Next() {
+		var debtor Debtor
+		if err = rows.Scan(&debtor.UserID, &debtor.Currency, &debtor.Debt, &debtor.CreditLimit, &debtor.DebtSince); err != nil {
+			return DebtorsReport{}, err
+		}
+		debtor.DueAt = debtor.DebtSince.Add(billDB.DebtTerm)
+		debtor.DaysPastDue = daysPastDue(debtor.DueAt, debtors.Date)
+		debtors.Debtors = append(debtors.Debtors, debtor)
+	}
+	return debtors, rows.Err()
+}
+
+// Table converts the report into the shared tabular model.
+func (r DebtorsReport) Table() *report.Table {
+	table := &report.Table{
+		Name: fmt.Sprintf("debtors_%s", r.Date.Format(dateLayout)),
+		Columns: []report.Column{
+			{Name: "user_id", Type: report.Int},
+			{Name: "currency", Type: report.String},
+			{Name: "debt", Type: report.Float},
+			{Name: "credit_limit", Type: report.Float},
+			{Name: "debt_since", Type: report.Time},
+			{Name: "due_at", Type: report.Time},
+			{Name: "days_past_due", Type: report.Int},
+		},
+		Rows: make([][]interface{}, 0, len(r.Debtors)),
+	}
+	for _, debtor := range r.Debtors {
+		table.Rows = append(table.Rows, []interface{}{
+			debtor.UserID, debtor.Currency, debtor.Debt, debtor.CreditLimit,
+			debtor.DebtSince, debtor.DueAt, debtor.DaysPastDue,
+		})
+	}
+	return table
+}
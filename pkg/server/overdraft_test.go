@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+// withCredit makes the fake database hold a wallet with balance, reserved and a credit limit.
+func withCredit(t *testing.T, balance, reserved, limit float64) BillingDB {
+	fake, db := newFakeDB("")
+	t.Cleanup(func() { db.Close() })
+	fake.rows = map[string][]driver.Value{
+		"select balance, reserved from Users": {balance, reserved},
+		"select credit_limit":                 {limit},
+	}
+	return BillingDB{DB: db}
+}
+
+func TestOverdraft(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name                     string
+		balance, reserved, limit float64
+		reserve, capture         float64
+		err                      error
+	}{
+		{name: "reserve within balance", balance: 100, reserve: 100},
+		{name: "reserve without limit", balance: 100, reserve: 101, err: ErrNotEnoughMoney},
+		{name: "reserve within limit", balance: 100, reserved: 30, limit: 50, reserve: 120},
+		{name: "reserve above limit", balance: 100, reserved: 30, limit: 50, reserve: 121, err: ErrNotEnoughMoney},
+		{name: "capture into debt", reserved: 80, limit: 100, capture: 80},
+		{name: "capture after limit lowered", reserved: 80, limit: 50, capture: 80, err: ErrNotEnoughMoney},
+	}
+	for _, tc := range cases {
+		billDB := withCredit(t, tc.balance, tc.reserved, tc.limit)
+		var err error
+		if tc.reserve > 0 {
+			err = billDB.ReserveMoney(ctx, 1, 2, 3, "", tc.reserve)
+		} else {
+			err = billDB.Confirmation(ctx, 1, 2, 3, "", tc.capture)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestDaysPastDue(t *testing.T) {
+	due := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		now  time.Time
+		want int
+	}{
+		{due.Add(-time.Hour), 0},
+		{due, 0},
+		{due.Add(23 * time.Hour), 0},
+		{due.Add(24 * time.Hour), 1},
+		{due.AddDate(0, 0, 45).Add(time.Minute), 45},
+	}
+	for _, tc := range cases {
+		if got := daysPastDue(due, tc.now); got != tc.want {
+			t.Errorf("%s: expected %d days past due, got %d", tc.now, tc.want, got)
+		}
+	}
+}
+
+func TestDebtorsTable(t *testing.T) {
+	since := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	debtors := DebtorsReport{
+		Date: time.Date(2022, 11, 15, 0, 0, 0, 0, time.UTC),
+		Debtors: []Debtor{{UserID: 7, Currency: "RUB", Debt: 250, CreditLimit: 1000, DebtSince: since,
+			DueAt: since.AddDate(0, 0, 30), DaysPastDue: 15}},
+	}
+	table := debtors.Table()
+	if table.Name != "debtors_2022-11-15" || len(table.Rows) != 1 || len(table.Rows[0]) != len(table.Columns) {
+		t.Fatalf("unexpected table %+v", table)
+	}
+	if table.Rows[0][0] != 7 || table.Rows[0][2] != 250.0 || table.Rows[0][6] != 15 {
+		t.Errorf("unexpected row %v", table.Rows[0])
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+)
+
+// Groupings supported by the revenue report.
+const (
+	GroupByService = "service"
+	GroupByDay     = "day"
+	GroupBySegment = "segment"
+)
+
+// Periods that can be resolved around an anchor date.
+const (
+	PeriodDay     = "day"
+	PeriodWeek    = "week"
+	PeriodMonth   = "month"
+	PeriodQuarter = "quarter"
+)
+
+const dateLayout = "2006-01-02"
+
+// revenueGroups maps a grouping to the SQL expression used as the group key.
+// The day grouping truncates the UTC timestamp in the requested timezone ($3).
+var revenueGroups = map[string]string{
+	GroupByService: `t.service_id::text`,
+	GroupByDay:     `to_char(date_trunc('day', (t.date at time zone 'UTC') at time zone $3), 'YYYY-MM-DD')`,
+	GroupBySegment: `coalesce(u.segment, '')`,
+}
+
+// Report types that can be built by BuildReport.
+const (
+	ReportMonthly  = "monthly"
+	ReportRevenue  = "revenue"
+	ReportDebtors  = "debtors"
+	ReportVouchers = "vouchers"
+)
+
+// ReportParams describes a report independently of how it was requested.
+type ReportParams struct {
+	Type      string `json:"type" form:"type"`
+	Date      string `json:"date,omitempty" form:"date"`
+	Period    string `json:"period,omitempty" form:"period"`
+	From      string `json:"from,omitempty" form:"from"`
+	To        string `json:"to,omitempty" form:"to"`
+	Timezone  string `json:"tz,omitempty" form:"tz"`
+	GroupBy   string `json:"group_by,omitempty" form:"group_by"`
+	Format    string `json:"format,omitempty" form:"format"`
+	Delimiter string `json:"delimiter,omitempty" form:"delimiter"`
+}
+
+type RevenueQuery struct {
+	From     time.Time
+	To       time.Time
+	GroupBy  string
+	Location *time.Location
+}
+
+// RevenueRow splits the revenue into what users paid from their wallets and what bonus grants paid.
+type RevenueRow struct {
+	Group        string  `json:"group"`
+	Currency     string  `json:"currency"`
+	Orders       int     `json:"orders"`
+	Revenue      float64 `json:"revenue"`
+	RealRevenue  float64 `json:"real_revenue"`
+	BonusRevenue float64 `json:"bonus_revenue"`
+	AverageCheck float64 `json:"average_check"`
+	Cancelled    float64 `json:"cancelled"`
+	Refunded     float64 `json:"refunded"`
+}
+
+type RevenueReport struct {
+	From     time.Time    `json:"from"`
+	To       time.Time    `json:"to"`
+	Timezone string       `json:"timezone"`
+	GroupBy  string       `json:"group_by"`
+	Rows     []RevenueRow `json:"rows"`
+	// Totals has one row per currency, amounts in different currencies are never added up.
+	Totals []RevenueRow `json:"totals"`
+}
+
+// NewRevenueQuery validates the revenue report parameters, by default the report is grouped by service in UTC.
+func NewRevenueQuery(params ReportParams) (RevenueQuery, error) {
+	loc := time.UTC
+	if params.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(params.Timezone); err != nil {
+			return RevenueQuery{}, err
+		}
+	}
+	from, to, err := ReportPeriod(params.Period, params.Date, params.From, params.To, loc)
+	if err != nil {
+		return RevenueQuery{}, err
+	}
+	query := RevenueQuery{
+		From:     from,
+		To:       to,
+		GroupBy:  params.GroupBy,
+		Location: loc,
+	}
+	if query.GroupBy == "" {
+		query.GroupBy = GroupByService
+	}
+	if _, ok := revenueGroups[query.GroupBy]; !ok {
+		return RevenueQuery{}, fmt.Errorf("unknown grouping %q", query.GroupBy)
+	}
+	return query, nil
+}
+
+// BuildReport builds the table of a monthly, revenue, debtors or vouchers report, the caller closes it.
+// Every report applies the report timeout itself, the monthly one keeps it until its rows are streamed.
+func (billDB *BillingDB) BuildReport(ctx context.Context, params ReportParams) (*report.Table, error) {
+	switch params.Type {
+	case ReportMonthly:
+		return billDB.CheckMonthlyReport(ctx, params.Date)
+	case ReportRevenue:
+		query, err := NewRevenueQuery(params)
+		if err != nil {
+			return nil, err
+		}
+		revenue, err := billDB.RevenueReport(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return revenue.Table(), nil
+	case ReportDebtors:
+		debtors, err := billDB.DebtorsReport(ctx, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return debtors.Table(), nil
+	case ReportVouchers:
+		vouchers, err := billDB.VoucherReport(ctx, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return vouchers.Table(), nil
+	}
+	return nil, fmt.Errorf("unknown report type %q", params.Type)
+}
+
+// ReportPeriod resolves the [from, to) interval of a report in loc.
+// Either period with an anchor date or an explicit from/to pair (both inclusive dates) must be given.
+func ReportPeriod(period, date, from, to string, loc *time.Location) (time.Time, time.Time, error) {
+	if period == "" {
+		if from == "" || to == "" {
+			return time.Time{}, time.Time{}, fmt.Errorf("either period or from and to must be set")
+		}
+		start, err := time.ParseInLocation(dateLayout, from, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("wrong from date %q: %w", from, err)
+		}
+		end, err := time.ParseInLocation(dateLayout, to, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("wrong to date %q: %w", to, err)
+		}
+		if end.Before(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("from (%s) is after to (%s)", from, to)
+		}
+		return start, end.AddDate(0, 0, 1), nil
+	}
+
+	anchor, err := time.ParseInLocation(dateLayout, date, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("wrong date %q: %w", date, err)
+	}
+	switch period {
+	case PeriodDay:
+		return anchor, anchor.AddDate(0, 0, 1), nil
+	case PeriodWeek:
+		// weeks start on Monday
+		start := anchor.AddDate(0, 0, -(int(anchor.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7), nil
+	case PeriodMonth:
+		start := time.Date(anchor.Year(), anchor.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), nil
+	case PeriodQuarter:
+		month := time.Month((int(anchor.Month())-1)/3*3 + 1)
+		start := time.Date(anchor.Year(), month, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 3, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q", period)
+}
+
+// RevenueReport aggregates recognized revenue together with cancelled and refunded amounts
+// for the [From, To) interval, grouped as requested.
+func (billDB *BillingDB) RevenueReport(ctx context.Context, query RevenueQuery) (RevenueReport, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	groupExpr, ok := revenueGroups[query.GroupBy]
+	if !ok {
+		return RevenueReport{}, fmt.Errorf("unknown grouping %q", query.GroupBy)
+	}
+	if query.Location == nil {
+		query.Location = time.UTC
+	}
+	args := []interface{}{query.From.UTC(), query.To.UTC()}
+	if query.GroupBy == GroupByDay {
+		args = append(args, query.Location.String())
+	}
+	rows, err := billDB.DB.QueryContext(ctx, fmt.Sprintf(`
+		select %s as grp, t.currency,
+			count(*) filter (where t.order_status='done'),
+			coalesce(sum(t.cost) filter (where t.order_status='done'), 0),
+			coalesce(sum(t.bonus) filter (where t.order_status='done'), 0),
+			coalesce(sum(t.cost) filter (where t.order_status='cancelled'), 0),
+			coalesce(sum(t.cost) filter (where t.order_status='refunded'), 0)
+		from transactions t left join (select id, max(segment) as segment from users group by id) u on u.id = t.user_id
+		where t.date>=$1 and t.date<$2 and t.order_status<>'adjustment'
+		group by grp, t.currency
+		order by grp, t.currency;`, groupExpr), args...)
+	if err != nil {
+		return RevenueReport{}, err
+	}
+	defer rows.Close()
+
+	revenue := RevenueReport{
+		From:     query.From,
+		To:       query.To,
+		Timezone: query.Location.String(),
+		GroupBy:  query.GroupBy,
+		Rows:     []RevenueRow{},
+		Totals:   []RevenueRow{},
+	}
+	totals := map[string]*RevenueRow{}
+	for rows.Next() {
+		var row RevenueRow
+		err = rows.Scan(&row.Group, &row.Currency, &row.Orders, &row.Revenue, &row.BonusRevenue, &row.Cancelled, &row.Refunded)
+		if err != nil {
+			return RevenueReport{}, err
+		}
+		row.RealRevenue = money(row.Revenue - row.BonusRevenue)
+		row.AverageCheck = averageCheck(row.Revenue, row.Orders)
+		revenue.Rows = append(revenue.Rows, row)
+
+		total, ok := totals[row.Currency]
+		if !ok {
+			total = &RevenueRow{Group: "total", Currency: row.Currency}
+			totals[row.Currency] = total
+		}
+		total.Orders += row.Orders
+		total.Revenue += row.Revenue
+		total.RealRevenue += row.RealRevenue
+		total.BonusRevenue += row.BonusRevenue
+		total.Cancelled += row.Cancelled
+		total.Refunded += row.Refunded
+	}
+	if err = rows.Err(); err != nil {
+		return RevenueReport{}, err
+	}
+	for _, total := range totals {
+		total.AverageCheck = averageCheck(total.Revenue, total.Orders)
+		revenue.Totals = append(revenue.Totals, *total)
+	}
+	sort.Slice(revenue.Totals, func(i, j int) bool {
+		return revenue.Totals[i].Currency < revenue.Totals[j].Currency
+	})
+	return revenue, nil
+}
+
+// Table converts the report into the shared tabular model, the totals go last.
+func (r RevenueReport) Table() *report.Table {
+	table := &report.Table{
+		Name: fmt.Sprintf("revenue_%s_%s", r.From.Format(dateLayout), r.To.Format(dateLayout)),
+		Columns: []report.Column{
+			{Name: r.GroupBy, Type: report.String},
+			{Name: "currency", Type: report.String},
+			{Name: "orders", Type: report.Int},
+			{Name: "revenue", Type: report.Float},
+			{Name: "real_revenue", Type: report.Float},
+			{Name: "bonus_revenue", Type: report.Float},
+			{Name: "average_check", Type: report.Float},
+			{Name: "cancelled", Type: report.Float},
+			{Name: "refunded", Type: report.Float},
+		},
+		Rows: make([][]interface{}, 0, len(r.Rows)+len(r.Totals)),
+	}
+	for _, row := range r.Rows {
+		table.Rows = append(table.Rows, row.values())
+	}
+	for _, total := range r.Totals {
+		table.Rows = append(table.Rows, total.values())
+	}
+	return table
+}
+
+func (row RevenueRow) values() []interface{} {
+	return []interface{}{row.Group, row.Currency, row.Orders, row.Revenue, row.RealRevenue, row.BonusRevenue, row.AverageCheck,
+		row.Cancelled, row.Refunded}
+}
+
+func averageCheck(revenue float64, orders int) float64 {
+	if orders == 0 {
+		return 0
+	}
+	return revenue / float64(orders)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportPeriod(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	cases := []struct {
+		period, date, from, to string
+		loc                    *time.Location
+		wantFrom, wantTo       time.Time
+		wantErr                bool
+	}{
+		{
+			period: PeriodDay, date: "2022-11-03", loc: time.UTC,
+			wantFrom: time.Date(2022, 11, 3, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 11, 4, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			period: PeriodWeek, date: "2022-11-06", loc: time.UTC,
+			wantFrom: time.Date(2022, 10, 31, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 11, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			period: PeriodWeek, date: "2022-10-31", loc: time.UTC,
+			wantFrom: time.Date(2022, 10, 31, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 11, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			period: PeriodMonth, date: "2022-12-15", loc: moscow,
+			wantFrom: time.Date(2022, 12, 1, 0, 0, 0, 0, moscow),
+			wantTo:   time.Date(2023, 1, 1, 0, 0, 0, 0, moscow),
+		},
+		{
+			period: PeriodQuarter, date: "2022-08-20", loc: time.UTC,
+			wantFrom: time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			from: "2022-01-01", to: "2022-01-31", loc: moscow,
+			wantFrom: time.Date(2022, 1, 1, 0, 0, 0, 0, moscow),
+			wantTo:   time.Date(2022, 2, 1, 0, 0, 0, 0, moscow),
+		},
+		{from: "2022-02-01", to: "2022-01-01", loc: time.UTC, wantErr: true},
+		{from: "2022-02-01", loc: time.UTC, wantErr: true},
+		{period: "year", date: "2022-01-01", loc: time.UTC, wantErr: true},
+		{period: PeriodDay, date: "2022-1-1", loc: time.UTC, wantErr: true},
+	}
+	for i, tc := range cases {
+		from, to, err := ReportPeriod(tc.period, tc.date, tc.from, tc.to, tc.loc)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("#%d: expected error, got [%v, %v)", i, from, to)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error %v", i, err)
+			continue
+		}
+		if !from.Equal(tc.wantFrom) || !to.Equal(tc.wantTo) {
+			t.Errorf("#%d: expected [%v, %v), got [%v, %v)", i, tc.wantFrom, tc.wantTo, from, to)
+		}
+	}
+}
+
+func TestRevenueReportRefunds(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.results = map[string][][]driver.Value{
+		"as grp": {
+			{"1", "RUB", int64(2), 100.0, 10.0, 20.0, 30.0},
+			{"2", "RUB", int64(1), 50.0, 0.0, 0.0, 15.5},
+		},
+	}
+	billDB := BillingDB{DB: db}
+	revenue, err := billDB.RevenueReport(context.Background(), RevenueQuery{
+		From: time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC),
+		GroupBy: GroupByService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fake.statements()[0], "filter (where t.order_status='refunded')") {
+		t.Errorf("refunded isn't summed over refunded orders: %s", fake.statements()[0])
+	}
+	if len(revenue.Rows) != 2 || revenue.Rows[0].Refunded != 30 || revenue.Rows[1].Refunded != 15.5 {
+		t.Errorf("unexpected rows %+v", revenue.Rows)
+	}
+	if len(revenue.Totals) != 1 || revenue.Totals[0].Refunded != 45.5 || revenue.Totals[0].Cancelled != 20 {
+		t.Errorf("unexpected totals %+v", revenue.Totals)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+	"github.com/lib/pq"
+)
+
+// Review statuses.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// Review is an operation a risk rule held back until an admin approves or rejects it.
+type Review struct {
+	ID        int64          `json:"id"`
+	Operation risk.Operation `json:"operation"`
+	Rule      string         `json:"rule"`
+	Reason    string         `json:"reason"`
+	Status    string         `json:"status"`
+	CreatedBy string         `json:"created_by"`
+	DecidedBy string         `json:"decided_by,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	DecidedAt *time.Time     `json:"decided_at,omitempty"`
+}
+
+// ReviewError is returned for an operation that was queued for review instead of running.
+type ReviewError struct {
+	Review Review
+}
+
+func (e *ReviewError) Error() string {
+	return fmt.Sprintf("%s. Review %d by rule %s: %s", ErrHeldForReview, e.Review.ID, e.Review.Rule, e.Review.Reason)
+}
+
+func (e *ReviewError) Unwrap() error {
+	return ErrHeldForReview
+}
+
+// assess runs the risk rules for op. A denied operation is an error wrapping ErrRiskDenied,
+// one that needs a review is queued and reported with a ReviewError.
+func (billDB *BillingDB) assess(ctx context.Context, op risk.Operation) error {
+	if billDB.Risk == nil {
+		return nil
+	}
+	op.IP = auditInfo(ctx).IP
+	verdict, err := billDB.Risk.Evaluate(ctx, op, billDB, time.Now())
+	if err != nil {
+		return err
+	}
+	switch verdict.Decision {
+	case risk.Deny:
+		return fmt.Errorf("%w. Rule %s: %s", ErrRiskDenied, verdict.Rule, verdict.Reason)
+	case risk.Review:
+		review, err := billDB.holdForReview(ctx, op, verdict)
+		if err != nil {
+			return err
+		}
+		return &ReviewError{Review: review}
+	}
+	return nil
+}
+
+// RecentOperations counts the user's ledger operations of the given types since since
+// and returns the largest amount among them.
+func (billDB *BillingDB) RecentOperations(ctx context.Context, userID int, operations []string, since time.Time) (int, float64, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var count int
+	var largest float64
+	err := billDB.DB.QueryRowContext(ctx, `select count(*), coalesce(max(amount), 0) from Ledger
+		where user_id = $1 and operation = any($2) and created_at >= $3;`, userID, pq.Array(operations), since.UTC()).
+		Scan(&count, &largest)
+	return count, largest, err
+}
+
+const reviewColumns = `id, operation, user_id, to_user_id, service_id, order_id, currency, amount, voucher, pending,
+	rule, reason, status, created_by, coalesce(decided_by, ''), created_at, decided_at`
+
+func scanReview(row interface{ Scan(...interface{}) error }) (Review, error) {
+	var review Review
+	err := row.Scan(&review.ID, &review.Operation.Type, &review.Operation.UserID, &review.Operation.ToUserID,
+		&review.Operation.ServiceID, &review.Operation.OrderID, &review.Operation.Currency, &review.Operation.Amount,
+		&review.Operation.Voucher, &review.Operation.Pending, &review.Rule, &review.Reason, &review.Status, &review.CreatedBy,
+		&review.DecidedBy, &review.CreatedAt, &review.DecidedAt)
+	return review, err
+}
+
+func (billDB *BillingDB) holdForReview(ctx context.Context, op risk.Operation, verdict risk.Verdict) (Review, error) {
+	review := Review{
+		Operation: op,
+		Rule:      verdict.Rule,
+		Reason:    verdict.Reason,
+		Status:    ReviewPending,
+		CreatedBy: auditInfo(ctx).Actor,
+		CreatedAt: time.Now().UTC(),
+	}
+	err := billDB.DB.QueryRowContext(ctx, `insert into Reviews
+		(operation, user_id, to_user_id, service_id, order_id, currency, amount, voucher, pending, rule, reason, status,
+		created_by, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning id;`,
+		op.Type, op.UserID, op.ToUserID, op.ServiceID, op.OrderID, op.Currency, op.Amount, op.Voucher, op.Pending,
+		review.Rule, review.Reason,
+		review.Status, review.CreatedBy, review.CreatedAt).Scan(&review.ID)
+	return review, err
+}
+
+// ApproveReview runs a held operation on behalf of the caller of ctx. The operation still has to pass
+// the account status, spending limits and balance checks; if it fails the review stays pending.
+func (billDB *BillingDB) ApproveReview(ctx context.Context, id int64) (Review, error) {
+	return billDB.decideReview(ctx, id, ReviewApproved)
+}
+
+// RejectReview drops a held operation.
+func (billDB *BillingDB) RejectReview(ctx context.Context, id int64) (Review, error) {
+	return billDB.decideReview(ctx, id, ReviewRejected)
+}
+
+func (billDB *BillingDB) decideReview(ctx context.Context, id int64, status string) (Review, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Review{}, err
+	}
+	defer tx.Rollback()
+
+	review, err := scanReview(tx.QueryRowContext(ctx, `select `+reviewColumns+` from Reviews where id = $1 for update;`, id))
+	if err != nil {
+		return Review{}, err
+	}
+	if review.Status != ReviewPending {
+		return Review{}, fmt.Errorf("%w. Review %d is already %s", ErrWrongOperation, id, review.Status)
+	}
+	if status == ReviewApproved {
+		if err = billDB.runReviewed(ctx, tx, review.Operation); err != nil {
+			return Review{}, err
+		}
+	}
+	now := time.Now().UTC()
+	review.Status, review.DecidedBy, review.DecidedAt = status, auditInfo(ctx).Actor, &now
+	_, err = tx.ExecContext(ctx, `update Reviews set status = $2, decided_by = $3, decided_at = $4 where id = $1;`,
+		review.ID, review.Status, review.DecidedBy, now)
+	if err != nil {
+		return Review{}, err
+	}
+	return review, tx.Commit()
+}
+
+func (billDB *BillingDB) runReviewed(ctx context.Context, tx *sql.Tx, op risk.Operation) error {
+	// a held voucher operation goes through the voucher path again, so the code is used up,
+	// a held pending credit is only registered and still waits to be settled
+	switch op.Type {
+	case risk.OpCredit:
+		if op.Voucher != "" {
+			_, err := billDB.redeemVoucher(ctx, tx, op.UserID, op.Voucher, false)
+			return err
+		}
+		if op.Pending {
+			_, err := addPendingCredit(ctx, tx, op.UserID, op.Currency, op.Amount)
+			return err
+		}
+		return creditUser(ctx, tx, op.UserID, op.Currency, op.Amount)
+	case risk.OpReserve:
+		if op.Voucher != "" {
+			_, err := billDB.reserveWithVoucher(ctx, tx, op.UserID, op.ServiceID, op.OrderID, op.Currency, op.Amount, op.Voucher)
+			return err
+		}
+		return billDB.reserveMoney(ctx, tx, op.UserID, op.ServiceID, op.OrderID, op.Currency, op.Amount)
+	case risk.OpTransfer:
+		_, err := transferMoney(ctx, tx, Transfer{FromUserID: op.UserID, ToUserID: op.ToUserID, Currency: op.Currency, Amount: op.Amount})
+		return err
+	}
+	return fmt.Errorf("%w. Unknown operation %q", ErrWrongOperation, op.Type)
+}
+
+// Reviews lists reviews newest first, empty status and 0 user match all.
+func (billDB *BillingDB) Reviews(ctx context.Context, status string, userID, limit, offset int) ([]Review, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+reviewColumns+` from Reviews
+		where ($1 = '' or status = $1) and ($2 = 0 or user_id = $2)
+		order by id desc limit $3 offset $4;`, status, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reviews := []Review{}
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+func (billDB *BillingDB) Review(ctx context.Context, id int64) (Review, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return scanReview(billDB.DB.QueryRowContext(ctx, `select `+reviewColumns+` from Reviews where id = $1;`, id))
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+)
+
+func TestAssess(t *testing.T) {
+	engine, err := risk.New([]risk.Rule{
+		{Name: "large-credit", Type: risk.Threshold, Operations: []string{risk.OpCredit}, Amount: 1000, Action: risk.Review},
+		{Name: "blocked", Type: risk.Blocklist, Users: []int{13}, Action: risk.Deny},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fake, db := newFakeDB("")
+	defer db.Close()
+	billDB := BillingDB{DB: db, Risk: engine}
+	if err = billDB.CreditUser(ctx, 13, "", 10); !errors.Is(err, ErrRiskDenied) {
+		t.Errorf("expected the blocklisted user to be denied, got %v", err)
+	}
+	if err = billDB.ReserveMoney(ctx, 13, 1, 1, "", 10); !errors.Is(err, ErrRiskDenied) {
+		t.Errorf("expected the blocklisted user to be denied, got %v", err)
+	}
+	_, err = billDB.Transfer(ctx, Transfer{FromUserID: 1, ToUserID: 13, Amount: 10})
+	if !errors.Is(err, ErrRiskDenied) {
+		t.Errorf("expected the transfer to the blocklisted user to be denied, got %v", err)
+	}
+	err = billDB.CreditUser(ctx, 1, "", 5000)
+	var reviewErr *ReviewError
+	if !errors.As(err, &reviewErr) || !errors.Is(err, ErrHeldForReview) {
+		t.Fatalf("expected the large credit to be held, got %v", err)
+	}
+	if reviewErr.Review.Rule != "large-credit" || reviewErr.Review.Status != ReviewPending || reviewErr.Review.ID == 0 {
+		t.Errorf("unexpected review %+v", reviewErr.Review)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "Users") || strings.Contains(statement, "Transactions") {
+			t.Errorf("held or denied operation still ran %q", statement)
+		}
+	}
+	if err = billDB.CreditUser(ctx, 1, "", 500); err != nil {
+		t.Errorf("small credit failed: %v", err)
+	}
+}
+
+func TestApproveReview(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Reviews": {int64(4), risk.OpCredit, int64(1), int64(0), int64(0), int64(0), "RUB", 5000.0, "", false, "large-credit",
+			"credit of 5000.00 is at least 1000.00", ReviewPending, "key:1", "", time.Now(), nil},
+	}
+	billDB := BillingDB{DB: db}
+	ctx := WithAudit(context.Background(), AuditInfo{Actor: "key:2"})
+	review, err := billDB.ApproveReview(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.Status != ReviewApproved || review.DecidedBy != "key:2" {
+		t.Errorf("unexpected review %+v", review)
+	}
+	var credited, committed bool
+	for _, statement := range fake.statements() {
+		credited = credited || strings.Contains(statement, "insert into Users")
+		committed = committed || statement == "commit"
+	}
+	if !credited || !committed {
+		t.Errorf("expected the held credit to be committed: %q", fake.statements())
+	}
+}
+
+func TestApproveTransferReview(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Reviews": {int64(5), risk.OpTransfer, int64(1), int64(2), int64(0), int64(0), "RUB", 60.0, "", false, "transfer-after-credit",
+			"transfer within 1h0m0s after a credit of 60000.00", ReviewPending, "key:1", "", time.Now(), nil},
+	}
+	billDB := BillingDB{DB: db}
+	review, err := billDB.ApproveReview(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.Operation.ToUserID != 2 || review.Status != ReviewApproved {
+		t.Errorf("unexpected review %+v", review)
+	}
+	if args := fake.argsOf("insert into Transfers"); len(args) == 0 || args[0] != int64(1) || args[1] != int64(2) || args[3] != 60.0 {
+		t.Errorf("expected the held transfer from 1 to 2 to run, got %v", args)
+	}
+}
+
+func TestPendingCreditAssessed(t *testing.T) {
+	engine, err := risk.New([]risk.Rule{
+		{Name: "large-credit", Type: risk.Threshold, Operations: []string{risk.OpCredit}, Amount: 1000, Action: risk.Review},
+		{Name: "blocked", Type: risk.Blocklist, Users: []int{13}, Action: risk.Deny},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	fake, db := newFakeDB("")
+	defer db.Close()
+	billDB := BillingDB{DB: db, Risk: engine}
+	if _, err = billDB.AddPendingCredit(ctx, 1, "", -10); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected a negative credit to be refused, got %v", err)
+	}
+	if _, err = billDB.AddPendingCredit(ctx, 13, "", 10); !errors.Is(err, ErrRiskDenied) {
+		t.Errorf("expected the blocklisted user to be denied, got %v", err)
+	}
+	_, err = billDB.AddPendingCredit(ctx, 1, "", 5000)
+	var reviewErr *ReviewError
+	if !errors.As(err, &reviewErr) || !reviewErr.Review.Operation.Pending {
+		t.Fatalf("expected the large pending credit to be held as pending, got %v", err)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "insert into Credits") {
+			t.Errorf("held or denied pending credit was still registered: %q", statement)
+		}
+	}
+
+	// approving it registers the credit, the balance waits for the settlement
+	fake, db = newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Reviews": {int64(7), risk.OpCredit, int64(1), int64(0), int64(0), int64(0), "RUB", 5000.0, "", true, "large-credit",
+			"credit of 5000.00 is at least 1000.00", ReviewPending, "key:1", "", time.Now(), nil},
+	}
+	billDB = BillingDB{DB: db}
+	if _, err = billDB.ApproveReview(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if args := fake.argsOf("insert into Credits"); len(args) < 3 || args[2] != 5000.0 {
+		t.Errorf("expected the pending credit to be registered, got %v", args)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "insert into Users") {
+			t.Errorf("approved pending credit reached the balance: %q", statement)
+		}
+	}
+}
@@ -1,26 +1,45 @@
 package server
 
 import (
+	"context"
 	"database/sql"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/risk"
 	_ "github.com/lib/pq"
 )
 
 type BillingDB struct {
 	DB *sql.DB
+	// ReserveTTL is how long a reserve is held before it expires, 0 means forever.
+	ReserveTTL time.Duration
+	// Currencies users can hold wallets in, DefaultCurrency only when empty.
+	Currencies []string
+	// Timeouts bound the SQL work of each operation ("reserve", "report"...),
+	// DefaultTimeout applies to operations without their own. 0 means no limit.
+	Timeouts       map[string]time.Duration
+	DefaultTimeout time.Duration
+	// AdjustmentThreshold is the largest manual adjustment posted without a second admin's approval.
+	AdjustmentThreshold float64
+	// DebtTerm is how long a wallet may stay overdrawn before its debt is past due.
+	DebtTerm time.Duration
+	// Risk rules run before credits and reserves, nil allows everything.
+	Risk *risk.Engine
+	// BonusPriority orders the bonus grants a reserve spends first, DefaultBonusPriority when empty.
+	// BonusMaxShare is the largest part of a price bonus may pay, outside (0, 1] it may pay all of it.
+	BonusPriority []string
+	BonusMaxShare float64
 }
 
 type ClientReport struct {
 	OrderID     int       `json:"order_id"`
 	ServiceID   int       `json:"service_id"`
+	Currency    string    `json:"currency"`
 	Cost        float64   `json:"cost"`
 	OrderStatus string    `json:"order_status"`
 	Date        time.Time `json:"date"`
@@ -45,157 +64,392 @@ func (billDB *BillingDB) Close() error {
 	return billDB.DB.Close()
 }
 
-func (billDB *BillingDB) CreditUser(userID int, price float64) error {
-	res, err := billDB.DB.Exec(`update Users set balance = balance + $2 where id = $1;`, userID, price)
+func (billDB *BillingDB) CreditUser(ctx context.Context, userID int, currency string, price float64) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpCredit)
+	defer cancel()
+
+	if err := checkPrice(price); err != nil {
+		return err
+	}
+	currency, err := billDB.Currency(currency)
 	if err != nil {
 		return err
 	}
-	rows, err := res.RowsAffected()
+	err = billDB.assess(ctx, risk.Operation{Type: risk.OpCredit, UserID: userID, Currency: currency, Amount: price})
 	if err != nil {
 		return err
 	}
-	if rows == 0 {
-		_, err = billDB.DB.Exec(`insert into Users (id, balance, reserved) values ($1, $2, 0);`, userID, price)
-		if err != nil {
-			return err
-		}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = creditUser(ctx, tx, userID, currency, price); err != nil {
+		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-func (billDB *BillingDB) ReserveMoney(userID int, serviceID int, orderID int, price float64) error {
-	var usersBalance float64
-	err := billDB.DB.QueryRow("select balance from Users where id = $1", userID).Scan(&usersBalance)
+// creditUser adds money to the user's wallet, creating the wallet on the first credit.
+func creditUser(ctx context.Context, tx *sql.Tx, userID int, currency string, price float64) error {
+	if err := checkStatus(ctx, tx, userID, OpCredit, false); err != nil {
+		return err
+	}
+	var usersBalance, usersReserve float64
+	err := tx.QueryRowContext(ctx, `insert into Users (id, currency, balance, reserved) values ($1, $2, $3, 0)
+		on conflict (id, currency) do update set balance = Users.balance + excluded.balance
+		returning balance, reserved;`, userID, currency, price).Scan(&usersBalance, &usersReserve)
 	if err != nil {
 		return err
 	}
-	var usersReserve float64
-	err = billDB.DB.QueryRow("select reserved from Users where id = $1", userID).Scan(&usersReserve)
+	return addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpCredit, Amount: price, Balance: usersBalance, Reserved: usersReserve,
+	})
+}
+
+func (billDB *BillingDB) ReserveMoney(ctx context.Context, userID int, serviceID int, orderID int, currency string, price float64) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpReserve)
+	defer cancel()
+
+	if err := checkPrice(price); err != nil {
+		return err
+	}
+	currency, err := billDB.Currency(currency)
 	if err != nil {
 		return err
 	}
-	log.Printf("User's ID: %d, balance: %f, reserve: %f", userID, usersBalance, usersReserve)
+	err = billDB.assess(ctx, risk.Operation{
+		Type: risk.OpReserve, UserID: userID, ServiceID: serviceID, OrderID: orderID, Currency: currency, Amount: price,
+	})
+	if err != nil {
+		return err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = billDB.reserveMoney(ctx, tx, userID, serviceID, orderID, currency, price); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	if usersBalance-usersReserve-price < 0 {
-		return fmt.Errorf("not enough money for reserve. Your current balance: %f, reserved: %f",
-			usersBalance, usersReserve)
+func (billDB *BillingDB) reserveMoney(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int, currency string, price float64) error {
+	if err := checkStatus(ctx, tx, userID, OpReserve, true); err != nil {
+		return err
+	}
+	usersBalance, usersReserve, err := lockUser(ctx, tx, userID, currency)
+	if err != nil {
+		return err
+	}
+	log.Printf("User's ID: %d, balance: %f %s, reserve: %f", userID, usersBalance, currency, usersReserve)
+
+	// limits cap the whole price, whatever pays for it
+	if err = checkLimits(ctx, tx, userID, serviceID, currency, price); err != nil {
+		return err
+	}
+	// bonus goes first, only the rest of the price is held from the wallet
+	now := time.Now()
+	bonus, err := billDB.spendBonus(ctx, tx, userID, serviceID, orderID, currency, price, now)
+	if err != nil {
+		return err
+	}
+	charged := money(price - bonus)
+	limit, err := creditLimit(ctx, tx, userID, currency)
+	if err != nil {
+		return err
+	}
+	if usersBalance-usersReserve-charged < -limit {
+		return fmt.Errorf("%w for reserve. Your current balance: %f, reserved: %f, credit limit: %f",
+			ErrNotEnoughMoney, usersBalance, usersReserve, limit)
 	}
 	log.Print("Reserve is possible")
 
-	_, err = billDB.DB.Exec(`insert into Transactions (order_id, service_id, user_id, cost, order_status, date)
-		values ($1, $2, $3, $4, 'reserved', $5);`, orderID, serviceID, userID, price, time.Now())
+	var expiresAt *time.Time
+	if billDB.ReserveTTL > 0 {
+		expires := now.Add(billDB.ReserveTTL)
+		expiresAt = &expires
+	}
+	_, err = tx.ExecContext(ctx, `insert into Transactions (order_id, service_id, user_id, currency, cost, bonus, order_status, date, expires_at)
+		values ($1, $2, $3, $4, $5, $6, 'reserved', $7, $8);`, orderID, serviceID, userID, currency, price, bonus, now, expiresAt)
 	if err != nil {
 		return err
 	}
 	log.Print("Added new transaction")
 
-	res, err := billDB.DB.Exec(`update Users set reserved = $2 where id = $1;`, userID, usersReserve+price)
+	_, err = tx.ExecContext(ctx, `update Users set reserved = $3 where id = $1 and currency = $2;`, userID, currency, usersReserve+charged)
 	if err != nil {
 		return err
 	}
 	log.Print("User's reserve updated")
 
-	rows, err := res.RowsAffected()
-	if err != nil || rows == 0 {
+	return addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpReserve, OrderID: orderID, ServiceID: serviceID,
+		Amount: charged, Balance: usersBalance, Reserved: usersReserve + charged,
+	})
+}
+
+func (billDB *BillingDB) Confirmation(ctx context.Context, userID int, serviceID int, orderID int, currency string, price float64) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpCapture)
+	defer cancel()
+
+	if err := checkPrice(price); err != nil {
+		return err
+	}
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = confirmation(ctx, tx, userID, serviceID, orderID, currency, price); err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-func (billDB *BillingDB) Confirmation(userID int, serviceID int, orderID int, price float64) error {
-	var usersBalance float64
-	err := billDB.DB.QueryRow("select balance from Users where id = $1", userID).Scan(&usersBalance)
-	if err != nil {
+func confirmation(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int, currency string, price float64) error {
+	if err := checkStatus(ctx, tx, userID, OpCapture, true); err != nil {
 		return err
 	}
-	var usersReserve float64
-	err = billDB.DB.QueryRow("select reserved from Users where id = $1", userID).Scan(&usersReserve)
+	usersBalance, usersReserve, err := lockUser(ctx, tx, userID, currency)
 	if err != nil {
 		return err
 	}
-	log.Printf("User's ID: %d, balance: %f, reserve: %f", userID, usersBalance, usersReserve)
+	log.Printf("User's ID: %d, balance: %f %s, reserve: %f", userID, usersBalance, currency, usersReserve)
 
-	if usersBalance-usersReserve-price < 0 {
-		return fmt.Errorf("not enough money for reserve. Your current balance: %f, reserved: %f",
-			usersBalance, usersReserve)
+	// the price is already held, capturing it may take the balance below zero as far as the credit limit allows
+	limit, err := creditLimit(ctx, tx, userID, currency)
+	if err != nil {
+		return err
 	}
-	log.Print("Reserve is possible")
-	if usersReserve-price < 0 {
-		return fmt.Errorf("wrong operation. Reserved balance (%f) is lower than price (%f)",
-			usersReserve, price)
+	if usersBalance-usersReserve < -limit {
+		return fmt.Errorf("%w for reserve. Your current balance: %f, reserved: %f, credit limit: %f",
+			ErrNotEnoughMoney, usersBalance, usersReserve, limit)
 	}
-	log.Print("Confirmation is possible")
+	log.Print("Reserve is possible")
 
-	res, err := billDB.DB.Exec(`update Transactions set order_status = 'done', date = $5
-		where order_id = $1 and service_id = $2 and user_id = $3 and cost = $4;`,
-		orderID, serviceID, userID, price, time.Now())
+	// the bonus part was taken from the grants on reserve, only the rest leaves the wallet
+	var bonus float64
+	err = tx.QueryRowContext(ctx, `update Transactions set order_status = 'done', date = $6
+		where order_id = $1 and service_id = $2 and user_id = $3 and currency = $4 and cost = $5
+		and order_status = 'reserved' returning bonus;`,
+		orderID, serviceID, userID, currency, price, time.Now()).Scan(&bonus)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w. Order %d of user %d isn't reserved", ErrWrongOperation, orderID, userID)
+	}
 	if err != nil {
 		return err
 	}
 	log.Print("Added new transaction")
 
-	rows, err := res.RowsAffected()
-	if err != nil || rows == 0 {
-		return err
+	charged := money(price - bonus)
+	if usersReserve-charged < 0 {
+		return fmt.Errorf("%w. Reserved balance (%f) is lower than price (%f)",
+			ErrWrongOperation, usersReserve, charged)
 	}
+	log.Print("Confirmation is possible")
 
-	_, err = billDB.DB.Exec(`update Users set balance = $2, reserved = $3 where id = $1;`, userID, usersBalance-price, usersReserve-price)
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3, reserved = $4 where id = $1 and currency = $2;`,
+		userID, currency, usersBalance-charged, usersReserve-charged)
 	if err != nil {
 		return err
 	}
 	log.Print("User's reserve updated")
-	return nil
+
+	return addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpCapture, OrderID: orderID, ServiceID: serviceID,
+		Amount: charged, Balance: usersBalance - charged, Reserved: usersReserve - charged,
+	})
 }
 
-func (billDB *BillingDB) Cancellation(userID int, orderID int) error {
-	var usersBalance float64
-	err := billDB.DB.QueryRow("select balance from Users where id = $1", userID).Scan(&usersBalance)
+// Cancellation releases the reserve of an order, the held money becomes available again.
+// The balance stays as it is: a reserve only holds money, it never takes it from the balance.
+func (billDB *BillingDB) Cancellation(ctx context.Context, userID int, serviceID int, orderID int) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpCancel)
+	defer cancel()
+
+	if err := checkService(serviceID); err != nil {
+		return err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = cancellation(ctx, tx, userID, serviceID, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func cancellation(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int) error {
+	if err := checkStatus(ctx, tx, userID, OpCancel, false); err != nil {
+		return err
+	}
+	currency, err := orderCurrency(ctx, tx, userID, serviceID, orderID, "reserved")
 	if err != nil {
 		return err
 	}
-	var usersReserve float64
-	err = billDB.DB.QueryRow("select reserved from Users where id = $1", userID).Scan(&usersReserve)
+
+	usersBalance, usersReserve, err := lockUser(ctx, tx, userID, currency)
 	if err != nil {
 		return err
 	}
-	log.Printf("User's ID: %d, balance: %f, reserve: %f", userID, usersBalance, usersReserve)
-	var cost float64
-	err = billDB.DB.QueryRow("select cost from Transactions where order_id = $1", orderID).Scan(&cost)
+	log.Printf("User's ID: %d, balance: %f %s, reserve: %f", userID, usersBalance, currency, usersReserve)
+	var cost, bonus, discount float64
+	err = tx.QueryRowContext(ctx, `select cost - bonus, bonus, discount from Transactions
+		where order_id = $1 and user_id = $2 and service_id = $3 and currency = $4 and order_status = 'reserved' for update;`,
+		orderID, userID, serviceID, currency).Scan(&cost, &bonus, &discount)
 	if err != nil {
 		return err
 	}
-	res, err := billDB.DB.Exec(`update Transactions set order_status = 'cancelled', date = $3
-		where order_id = $1 and user_id = $2;`,
-		orderID, userID, time.Now())
+	if usersReserve-cost < 0 {
+		return fmt.Errorf("%w. Reserved balance (%f) is lower than cost (%f)",
+			ErrWrongOperation, usersReserve, cost)
+	}
+	_, err = tx.ExecContext(ctx, `update Transactions set order_status = 'cancelled', date = $4
+		where order_id = $1 and user_id = $2 and service_id = $3 and order_status = 'reserved';`,
+		orderID, userID, serviceID, time.Now())
 	if err != nil {
 		return err
 	}
 	log.Print("Updated transaction")
 
-	rows, err := res.RowsAffected()
-	if err != nil || rows == 0 {
+	_, err = tx.ExecContext(ctx, `update Users set reserved = $3 where id = $1 and currency = $2;`, userID, currency, usersReserve-cost)
+	if err != nil {
 		return err
 	}
-	if usersReserve-cost < 0 {
-		return fmt.Errorf("wrong operation. Reserved balance (%f) is lower than cost (%f)",
-			usersReserve, cost)
+	log.Print("User's balance updated")
+	if bonus > 0 {
+		if err = returnBonus(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+	if discount > 0 {
+		if err = releaseVoucher(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+
+	return addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpCancel, OrderID: orderID, ServiceID: serviceID,
+		Amount: cost, Balance: usersBalance, Reserved: usersReserve - cost,
+	})
+}
+
+// Refund returns the money of a captured order to the user.
+func (billDB *BillingDB) Refund(ctx context.Context, userID int, serviceID int, orderID int) error {
+	ctx, cancel := billDB.withTimeout(ctx, OpRefund)
+	defer cancel()
+
+	if err := checkService(serviceID); err != nil {
+		return err
 	}
-	_, err = billDB.DB.Exec(`update Users set balance = $2, reserved = $3 where id = $1;`, userID, usersBalance+cost, usersReserve-cost)
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkStatus(ctx, tx, userID, OpRefund, false); err != nil {
+		return err
+	}
+	currency, err := orderCurrency(ctx, tx, userID, serviceID, orderID, "done")
+	if err != nil {
+		return err
+	}
+
+	usersBalance, usersReserve, err := lockUser(ctx, tx, userID, currency)
+	if err != nil {
+		return err
+	}
+	log.Printf("User's ID: %d, balance: %f %s, reserve: %f", userID, usersBalance, currency, usersReserve)
+	var cost, bonus, discount float64
+	err = tx.QueryRowContext(ctx, `select cost - bonus, bonus, discount from Transactions
+		where order_id = $1 and user_id = $2 and service_id = $3 and currency = $4 and order_status = 'done' for update;`,
+		orderID, userID, serviceID, currency).Scan(&cost, &bonus, &discount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update Transactions set order_status = 'refunded', date = $4
+		where order_id = $1 and user_id = $2 and service_id = $3 and order_status = 'done';`,
+		orderID, userID, serviceID, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Print("Updated transaction")
+
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`, userID, currency, usersBalance+cost)
 	if err != nil {
 		return err
 	}
 	log.Print("User's balance updated")
-	return nil
+	if bonus > 0 {
+		if err = returnBonus(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+	if discount > 0 {
+		if err = releaseVoucher(ctx, tx, userID, serviceID, orderID); err != nil {
+			return err
+		}
+	}
+
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: userID, Currency: currency, Operation: OpRefund, OrderID: orderID, ServiceID: serviceID,
+		Amount: cost, Balance: usersBalance + cost, Reserved: usersReserve,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// orderCurrency finds the wallet an order of the service in the given status was paid from.
+// An order in another status is refused with ErrWrongOperation, a missing one is sql.ErrNoRows.
+func orderCurrency(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int, status string) (string, error) {
+	var currency, orderStatus string
+	err := tx.QueryRowContext(ctx, `select currency, coalesce(order_status, '') from Transactions
+		where order_id = $1 and user_id = $2 and service_id = $3
+		order by order_status = $4 desc
+		limit 1;`, orderID, userID, serviceID, status).Scan(&currency, &orderStatus)
+	if err != nil {
+		return "", err
+	}
+	if orderStatus != status {
+		return "", fmt.Errorf("%w. Order %d of user %d is %s, not %s", ErrWrongOperation, orderID, userID, orderStatus, status)
+	}
+	return currency, nil
+}
+
+// lockUser reads the balance and reserve of the user's wallet and locks the row until tx ends.
+func lockUser(ctx context.Context, tx *sql.Tx, userID int, currency string) (float64, float64, error) {
+	var usersBalance, usersReserve float64
+	err := tx.QueryRowContext(ctx, "select balance, reserved from Users where id = $1 and currency = $2 for update", userID, currency).
+		Scan(&usersBalance, &usersReserve)
+	return usersBalance, usersReserve, err
 }
 
-func (billDB *BillingDB) CheckBalance(userID int) (float64, error) {
-	var usersBalance float64
-	err := billDB.DB.QueryRow("select balance from Users where id = $1", userID).Scan(&usersBalance)
+func (billDB *BillingDB) CheckBalance(ctx context.Context, userID int, currency string) (float64, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	currency, err := billDB.Currency(currency)
 	if err != nil {
 		return 0, err
 	}
-	var usersReserve float64
-	err = billDB.DB.QueryRow("select reserved from Users where id = $1", userID).Scan(&usersReserve)
+	var usersBalance, usersReserve float64
+	err = billDB.DB.QueryRowContext(ctx, "select balance, reserved from Users where id = $1 and currency = $2", userID, currency).
+		Scan(&usersBalance, &usersReserve)
 	if err != nil {
 		return 0, err
 	}
@@ -203,57 +457,88 @@ func (billDB *BillingDB) CheckBalance(userID int) (float64, error) {
 	return usersBalance - usersReserve, nil
 }
 
-func (billDB *BillingDB) CheckMonthlyReport(date string) error {
-	var lastYear, lastMonth string
-	firstDate := strings.Split(date, "-")
-	if len(firstDate) != 2 {
-		return fmt.Errorf("wrong date input")
-	}
-	if firstDate[1] != "12" {
-		num, _ := strconv.Atoi(firstDate[1])
-		lastMonth = strconv.Itoa(num + 1)
-		lastYear = firstDate[0]
-	} else {
-		num, _ := strconv.Atoi(firstDate[0])
-		lastYear = strconv.Itoa(num + 1)
-		lastMonth = "01"
-	}
-	rows, err := billDB.DB.Query(fmt.Sprintf(`
-		select service_id, sum(cost)
-		from transactions
-		where order_status='done' and date>='%s-%s-01' and date<'%s-%s-01'
-		group by service_id;`,
-		firstDate[0], firstDate[1], lastYear, lastMonth))
-	if err != nil {
-		return err
+// ParseMonth strictly parses a YYYY-MM string into the first instant of that month in UTC.
+func ParseMonth(date string) (time.Time, error) {
+	if len(date) != len("2006-01") {
+		return time.Time{}, fmt.Errorf("wrong date input %q, expected YYYY-MM", date)
 	}
-	resTable := make([][]string, 0)
-	resTable = append(resTable, []string{"service_id", "price"})
-	for rows.Next() {
-		var line [2]string
-		err = rows.Scan(&line[0], &line[1])
-		if err != nil {
-			return err
-		}
-		resTable = append(resTable, line[:])
+	month, err := time.Parse("2006-01", date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("wrong date input %q, expected YYYY-MM: %w", date, err)
 	}
-	f, err := os.Create(fmt.Sprintf("bill_%s.csv", date))
+	return month, nil
+}
+
+// CheckMonthlyReport builds the revenue report for the given month grouped by service.
+// The rows are streamed from the database while the table is encoded, the caller must close the table.
+func (billDB *BillingDB) CheckMonthlyReport(ctx context.Context, date string) (*report.Table, error) {
+	from, err := ParseMonth(date)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	csvWriter := csv.NewWriter(f)
-	err = csvWriter.WriteAll(resTable)
-	if err != nil && err != io.EOF {
-		return err
+	// the timeout covers streaming the rows too, it's cancelled when the table is closed
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	rows, err := billDB.DB.QueryContext(ctx, `
+		select service_id, currency, sum(cost), sum(bonus)
+		from transactions
+		where order_status='done' and date>=$1 and date<$2
+		group by service_id, currency
+		order by service_id, currency;`,
+		from, from.AddDate(0, 1, 0))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	table := &report.Table{
+		Name: fmt.Sprintf("bill_%s", date),
+		Columns: []report.Column{
+			{Name: "service_id", Type: report.Int},
+			{Name: "currency", Type: report.String},
+			{Name: "price", Type: report.Float},
+			{Name: "real", Type: report.Float},
+			{Name: "bonus", Type: report.Float},
+		},
+		Stream: &rowStream{rows: rows, cancel: cancel, scan: func(rows *sql.Rows) ([]interface{}, error) {
+			var serviceID int
+			var currency string
+			var price, bonus float64
+			if err := rows.Scan(&serviceID, &currency, &price, &bonus); err != nil {
+				return nil, err
+			}
+			return []interface{}{serviceID, currency, price, money(price - bonus), bonus}, nil
+		}},
+	}
+	return table, nil
+}
+
+// rowStream turns query rows into report rows as the report is encoded.
+type rowStream struct {
+	rows   *sql.Rows
+	cancel context.CancelFunc
+	scan   func(rows *sql.Rows) ([]interface{}, error)
+}
+
+func (s *rowStream) Next() ([]interface{}, error) {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
 	}
-	log.Print("END")
-	return nil
+	return s.scan(s.rows)
+}
+
+func (s *rowStream) Close() error {
+	defer s.cancel()
+	return s.rows.Close()
 }
 
-func (billDB *BillingDB) CheckClientTransactions(user_id int, limit int, offset int) (ClientReports, error) {
-	rows, err := billDB.DB.Query(`
-		select order_id, service_id, cost, order_status, date from transactions
+func (billDB *BillingDB) CheckClientTransactions(ctx context.Context, user_id int, limit int, offset int) (ClientReports, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `
+		select order_id, service_id, currency, cost, order_status, date from transactions
 		where user_id=$1
 		order by date desc, cost desc
 		limit $2 offset $3;
@@ -264,7 +549,7 @@ func (billDB *BillingDB) CheckClientTransactions(user_id int, limit int, offset
 	var cliReports ClientReports
 	for rows.Next() {
 		var cliRep ClientReport
-		err = rows.Scan(&cliRep.OrderID, &cliRep.ServiceID, &cliRep.Cost, &cliRep.OrderStatus, &cliRep.Date)
+		err = rows.Scan(&cliRep.OrderID, &cliRep.ServiceID, &cliRep.Currency, &cliRep.Cost, &cliRep.OrderStatus, &cliRep.Date)
 		if err != nil {
 			return ClientReports{}, err
 		}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+)
+
+func TestParseMonth(t *testing.T) {
+	cases := []struct {
+		date    string
+		want    time.Time
+		wantErr bool
+	}{
+		{date: "2022-03", want: time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{date: "2022-12", want: time.Date(2022, time.December, 1, 0, 0, 0, 0, time.UTC)},
+		{date: "2022-3", wantErr: true},
+		{date: "2022-13", wantErr: true},
+		{date: "2022-00", wantErr: true},
+		{date: "22-03", wantErr: true},
+		{date: "2022-03-01", wantErr: true},
+		{date: "2022-03'; drop table users; --", wantErr: true},
+		{date: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := ParseMonth(tc.date)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", tc.date, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.date, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%q: expected %v, got %v", tc.date, tc.want, got)
+		}
+	}
+}
+
+func FuzzParseMonth(f *testing.F) {
+	for _, seed := range []string{"2022-03", "2022-12", "2022-3", "1999-01", "abcd-ef", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, date string) {
+		month, err := ParseMonth(date)
+		if err != nil {
+			return
+		}
+		if got := month.Format("2006-01"); got != date {
+			t.Fatalf("%q parsed into %v which formats back as %q", date, month, got)
+		}
+		if month.Day() != 1 || month.Hour() != 0 || month.Location() != time.UTC {
+			t.Fatalf("%q parsed into %v, expected start of month in UTC", date, month)
+		}
+	})
+}
+
+func TestCheckMonthlyReportStreams(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.results = map[string][][]driver.Value{
+		"from transactions": {
+			{int64(1), "RUB", 150.5, 0.0},
+			{int64(30), "RUB", 1000.0, 200.0},
+		},
+	}
+	billDB := BillingDB{DB: db}
+	table, err := billDB.CheckMonthlyReport(context.Background(), "2022-11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if len(table.Rows) != 0 || table.Stream == nil {
+		t.Fatalf("monthly report was buffered: %v", table.Rows)
+	}
+
+	var w strings.Builder
+	if err = (report.CSV{}).Encode(&w, table); err != nil {
+		t.Fatal(err)
+	}
+	want := "service_id,currency,price,real,bonus\n1,RUB,150.5,150.5,0\n30,RUB,1000,800,200\n"
+	if got := w.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	if _, err = table.Stream.Next(); err == nil {
+		t.Error("rows were left after the report was written")
+	}
+
+	if _, err = billDB.CheckMonthlyReport(context.Background(), "2022-13"); err == nil {
+		t.Error("expected a wrong month to be refused before the query")
+	}
+	if got := len(fake.statements()); got != 1 {
+		t.Errorf("expected one query, got %d", got)
+	}
+}
+
+// orderDB answers the queries of a cancel or refund of order 3 of user 1 for 40 RUB from service 2,
+// the wallet holds 100 with 40 of them reserved.
+func orderDB() (*fakeDB, BillingDB) {
+	fake, db := newFakeDB("")
+	fake.rows = map[string][]driver.Value{
+		"select currency, coalesce(order_status": {"RUB", "reserved"},
+		"select balance, reserved from Users":    {100.0, 40.0},
+		"select cost - bonus":                    {40.0, 0.0, 0.0},
+	}
+	return fake, BillingDB{DB: db}
+}
+
+// Cancel used to add the price to the balance too, although the reserve never took it from there:
+// every cancelled order left the user the price richer.
+func TestCancellationReleasesReserve(t *testing.T) {
+	fake, billDB := orderDB()
+	defer billDB.Close()
+
+	if err := billDB.Cancellation(context.Background(), 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	// another service's order 3 of the same user stays reserved
+	if args := fake.argsOf("set order_status = 'cancelled'"); len(args) != 4 || args[2] != int64(2) {
+		t.Errorf("expected only the order of service 2 to be cancelled, got %v", args)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "update Users set balance") {
+			t.Errorf("cancel changed the balance: %q", statement)
+		}
+	}
+	if args := fake.argsOf("update Users set reserved"); len(args) != 3 || args[2] != 0.0 {
+		t.Errorf("expected the 40 reserved to be released, got %v", args)
+	}
+	entry := fake.argsOf("insert into Ledger")
+	if len(entry) != 9 || entry[2] != OpCancel || entry[5] != 40.0 || entry[6] != 100.0 || entry[7] != 0.0 {
+		t.Errorf("unexpected ledger entry %v", entry)
+	}
+}
+
+// Capture and cancel used to accept orders in any status, so a captured order could be cancelled and
+// its price credited again. Now only reserved orders are captured or cancelled, captured ones are refunded.
+func TestOrderStatusChecked(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  string
+		run     func(BillingDB) error
+		wantErr error
+	}{
+		{name: "cancel a captured order", status: "done", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Cancellation(context.Background(), 1, 2, 3) }},
+		{name: "cancel a cancelled order", status: "cancelled", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Cancellation(context.Background(), 1, 2, 3) }},
+		{name: "cancel a missing order", wantErr: sql.ErrNoRows,
+			run: func(db BillingDB) error { return db.Cancellation(context.Background(), 1, 2, 3) }},
+		{name: "cancel without a service", status: "reserved", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Cancellation(context.Background(), 1, 0, 3) }},
+		{name: "refund without a service", status: "done", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Refund(context.Background(), 1, 0, 3) }},
+		{name: "refund a reserved order", status: "reserved", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Refund(context.Background(), 1, 2, 3) }},
+		{name: "capture an order that isn't reserved", wantErr: ErrWrongOperation,
+			run: func(db BillingDB) error { return db.Confirmation(context.Background(), 1, 2, 3, "", 40) }},
+	}
+	for _, tc := range cases {
+		fake, billDB := orderDB()
+		fake.results = map[string][][]driver.Value{"returning bonus": {}}
+		if tc.status == "" {
+			delete(fake.rows, "select currency, coalesce(order_status")
+		} else {
+			fake.rows["select currency, coalesce(order_status"] = []driver.Value{"RUB", tc.status}
+		}
+		if err := tc.run(billDB); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.wantErr, err)
+		}
+		for _, statement := range fake.statements() {
+			if strings.Contains(statement, "update Users") || statement == "commit" {
+				t.Errorf("%s: unexpected %q", tc.name, statement)
+			}
+		}
+		billDB.Close()
+	}
+}
+
+func TestRefund(t *testing.T) {
+	fake, billDB := orderDB()
+	defer billDB.Close()
+	// 10 of the 40 were paid by a bonus grant, they go back to the grant
+	fake.rows["select currency, coalesce(order_status"] = []driver.Value{"RUB", "done"}
+	fake.rows["select cost - bonus"] = []driver.Value{30.0, 10.0, 0.0}
+
+	if err := billDB.Refund(context.Background(), 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if args := fake.argsOf("update Users set balance"); len(args) != 3 || args[2] != 130.0 {
+		t.Errorf("expected the 30 paid from the wallet back on the balance, got %v", args)
+	}
+	if !strings.Contains(strings.Join(fake.statements(), "\n"), "set order_status = 'refunded'") {
+		t.Error("order wasn't marked refunded")
+	}
+	if args := fake.argsOf("update Bonuses"); len(args) != 3 || args[1] != int64(2) || args[2] != int64(3) {
+		t.Errorf("bonus of the order wasn't returned: %v", args)
+	}
+	entry := fake.argsOf("insert into Ledger")
+	if len(entry) != 9 || entry[2] != OpRefund || entry[5] != 30.0 || entry[6] != 130.0 || entry[7] != 40.0 {
+		t.Errorf("unexpected ledger entry %v", entry)
+	}
+	if statements := fake.statements(); statements[len(statements)-1] != "commit" {
+		t.Errorf("refund wasn't committed: %q", statements)
+	}
+}
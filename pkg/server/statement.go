@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+)
+
+const statementTimeLayout = "2006-01-02 15:04:05"
+
+// Statement lists every operation of a user over [From, To) with the balances before and after the period.
+type Statement struct {
+	UserID          int           `json:"user_id"`
+	Currency        string        `json:"currency"`
+	From            time.Time     `json:"from"`
+	To              time.Time     `json:"to"`
+	OpeningBalance  float64       `json:"opening_balance"`
+	OpeningReserved float64       `json:"opening_reserved"`
+	Entries         []LedgerEntry `json:"entries"`
+	ClosingBalance  float64       `json:"closing_balance"`
+	ClosingReserved float64       `json:"closing_reserved"`
+}
+
+// UserStatement reads the statement from the Ledger rather than the orders CheckClientTransactions lists,
+// they keep no balances and no credits. For wallets older than the Ledger the migration backfills it from
+// their orders, behind an opening entry.
+func (billDB *BillingDB) UserStatement(ctx context.Context, userID int, currency string, from, to time.Time) (Statement, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return Statement{}, err
+	}
+	var id int
+	err = billDB.DB.QueryRowContext(ctx, "select id from Users where id = $1 and currency = $2", userID, currency).Scan(&id)
+	if err != nil {
+		return Statement{}, err
+	}
+	statement := Statement{UserID: userID, Currency: currency, From: from, To: to, Entries: []LedgerEntry{}}
+	err = billDB.DB.QueryRowContext(ctx, `
+		select balance, reserved from Ledger
+		where user_id = $1 and currency = $2 and created_at < $3
+		order by created_at desc, id desc
+		limit 1;`, userID, currency, from.UTC()).Scan(&statement.OpeningBalance, &statement.OpeningReserved)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Statement{}, err
+	}
+
+	rows, err := billDB.DB.QueryContext(ctx, `
+		select id, operation, coalesce(order_id, 0), coalesce(service_id, 0), amount, balance, reserved, created_at
+		from Ledger
+		where user_id = $1 and currency = $2 and created_at >= $3 and created_at < $4
+		order by created_at, id;`, userID, currency, from.UTC(), to.UTC())
+	if err != nil {
+		return Statement{}, err
+	}
+	defer rows.Close()
+	statement.ClosingBalance, statement.ClosingReserved = statement.OpeningBalance, statement.OpeningReserved
+	for rows.Next() {
+		entry := LedgerEntry{UserID: userID, Currency: currency}
+		err = rows.Scan(&entry.ID, &entry.Operation, &entry.OrderID, &entry.ServiceID,
+			&entry.Amount, &entry.Balance, &entry.Reserved, &entry.CreatedAt)
+		if err != nil {
+			return Statement{}, err
+		}
+		statement.Entries = append(statement.Entries, entry)
+		statement.ClosingBalance, statement.ClosingReserved = entry.Balance, entry.Reserved
+	}
+	return statement, rows.Err()
+}
+
+// Table lays the statement out with the opening balance first and the closing balance last,
+// dates are shown in loc.
+func (s Statement) Table(loc *time.Location) *report.Table {
+	lastDay := s.To.AddDate(0, 0, -1)
+	table := &report.Table{
+		Name: fmt.Sprintf("statement_%d_%s_%s_%s", s.UserID, s.Currency, s.From.Format(dateLayout), lastDay.Format(dateLayout)),
+		Title: fmt.Sprintf("Statement of user %d in %s from %s to %s (%s)",
+			s.UserID, s.Currency, s.From.Format(dateLayout), lastDay.Format(dateLayout), loc),
+		Date: s.To,
+		Columns: []report.Column{
+			{Name: "date", Type: report.String},
+			{Name: "operation", Type: report.String},
+			{Name: "order_id", Type: report.String},
+			{Name: "service_id", Type: report.String},
+			{Name: "amount", Type: report.Float},
+			{Name: "balance", Type: report.Float},
+			{Name: "reserved", Type: report.Float},
+			{Name: "available", Type: report.Float},
+		},
+		Rows: make([][]interface{}, 0, len(s.Entries)+2),
+	}
+	table.Rows = append(table.Rows, statementRow(s.From.In(loc), "opening balance", 0, 0, 0,
+		s.OpeningBalance, s.OpeningReserved))
+	for _, entry := range s.Entries {
+		table.Rows = append(table.Rows, statementRow(entry.CreatedAt.In(loc), entry.Operation, entry.OrderID, entry.ServiceID,
+			entry.Amount, entry.Balance, entry.Reserved))
+	}
+	table.Rows = append(table.Rows, statementRow(s.To.In(loc), "closing balance", 0, 0, 0,
+		s.ClosingBalance, s.ClosingReserved))
+	return table
+}
+
+func statementRow(date time.Time, operation string, orderID, serviceID int, amount, balance, reserved float64) []interface{} {
+	return []interface{}{
+		date.Format(statementTimeLayout), operation, optionalID(orderID), optionalID(serviceID),
+		money(amount), money(balance), money(reserved), money(balance - reserved),
+	}
+}
+
+func optionalID(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(id)
+}
+
+// money rounds to kopecks, so sums of the NUMERIC values read as float64 print the same everywhere.
+func money(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+var moscow = time.FixedZone("MSK", 3*60*60)
+
+func testStatement() Statement {
+	at := func(day, hour int) time.Time {
+		return time.Date(2022, time.November, day, hour, 0, 0, 0, time.UTC)
+	}
+	return Statement{
+		UserID:          2,
+		Currency:        DefaultCurrency,
+		From:            time.Date(2022, time.November, 1, 0, 0, 0, 0, moscow),
+		To:              time.Date(2022, time.November, 4, 0, 0, 0, 0, moscow),
+		OpeningBalance:  500,
+		OpeningReserved: 0,
+		Entries: []LedgerEntry{
+			{ID: 1, UserID: 2, Operation: OpCredit, Amount: 20000, Balance: 20500, CreatedAt: at(1, 9)},
+			{ID: 2, UserID: 2, Operation: OpReserve, OrderID: 123, ServiceID: 30,
+				Amount: 10000, Balance: 20500, Reserved: 10000, CreatedAt: at(1, 10)},
+			{ID: 3, UserID: 2, Operation: OpReserve, OrderID: 125, ServiceID: 1,
+				Amount: 10.5, Balance: 20500, Reserved: 10010.5, CreatedAt: at(2, 11)},
+			{ID: 4, UserID: 2, Operation: OpCapture, OrderID: 123, ServiceID: 30,
+				Amount: 10000, Balance: 10500, Reserved: 10.5, CreatedAt: at(2, 12)},
+			{ID: 5, UserID: 2, Operation: OpCancel, OrderID: 125, ServiceID: 1,
+				Amount: 10.5, Balance: 10500, Reserved: 0, CreatedAt: at(3, 13)},
+			{ID: 6, UserID: 2, Operation: OpRefund, OrderID: 123, ServiceID: 30,
+				Amount: 10000, Balance: 20500, Reserved: 0, CreatedAt: at(3, 20)},
+		},
+		ClosingBalance:  20500,
+		ClosingReserved: 0,
+	}
+}
+
+func TestStatementGolden(t *testing.T) {
+	table := testStatement().Table(moscow)
+	for _, format := range []report.Format{report.CSV{}, report.PDF{}} {
+		var buf bytes.Buffer
+		if err := format.Encode(&buf, table); err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", "statement."+format.Extension())
+		if *update {
+			if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s differs from the golden file, rerun with -update if the change is intended", golden)
+		}
+	}
+}
+
+// Wallets older than the Ledger have it backfilled from their orders: an opening entry without an order
+// and the reserve and capture of each order at the order's date.
+func TestStatementOfBackfilledWallet(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	at := func(day int) time.Time {
+		return time.Date(2022, time.October, day, 12, 0, 0, 0, time.UTC)
+	}
+	fake.rows = map[string][]driver.Value{"from Users": {int64(2)}}
+	fake.results = map[string][][]driver.Value{"created_at >= $3": {
+		{int64(1), OpOpening, int64(0), int64(0), 500.0, 500.0, 0.0, at(3)},
+		{int64(2), OpReserve, int64(123), int64(30), 100.0, 500.0, 100.0, at(3)},
+		{int64(3), OpCapture, int64(123), int64(30), 100.0, 400.0, 0.0, at(3)},
+		{int64(4), OpReserve, int64(124), int64(30), 50.0, 400.0, 50.0, at(5)},
+	}}
+	billDB := BillingDB{DB: db}
+	from, to := time.Date(2022, time.October, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.November, 1, 0, 0, 0, 0, time.UTC)
+	statement, err := billDB.UserStatement(context.Background(), 2, "", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.OpeningBalance != 0 || statement.ClosingBalance != 400 || statement.ClosingReserved != 50 {
+		t.Errorf("unexpected balances %+v", statement)
+	}
+	rows := statement.Table(time.UTC).Rows
+	if len(rows) != 6 || rows[1][1] != OpOpening || rows[1][2] != "" || rows[1][5] != 500.0 || rows[3][4] != 100.0 {
+		t.Errorf("backfilled entries aren't listed as they are: %v", rows)
+	}
+
+	// a later period opens with the balance after the backfilled entries
+	fake.rows["created_at < $3"] = []driver.Value{400.0, 50.0}
+	fake.results["created_at >= $3"] = nil
+	statement, err = billDB.UserStatement(context.Background(), 2, "", to, to.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.OpeningBalance != 400 || statement.OpeningReserved != 50 || statement.ClosingBalance != 400 || len(statement.Entries) != 0 {
+		t.Errorf("unexpected statement after the backfill %+v", statement)
+	}
+}
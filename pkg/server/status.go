@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Account statuses. A user without a status row is active.
+const (
+	// AccountActive allows every operation.
+	AccountActive = "active"
+	// AccountFrozen allows money to come in but not to leave: no reserves, captures, debits or conversions.
+	AccountFrozen = "frozen"
+	// AccountBlocked allows nothing.
+	AccountBlocked = "blocked"
+	// AccountClosed allows nothing and is final, only an empty account can be closed.
+	AccountClosed = "closed"
+)
+
+// statusTransitions lists the statuses an account may move to from each status.
+var statusTransitions = map[string][]string{
+	AccountActive:  {AccountFrozen, AccountBlocked, AccountClosed},
+	AccountFrozen:  {AccountActive, AccountBlocked, AccountClosed},
+	AccountBlocked: {AccountActive, AccountFrozen, AccountClosed},
+	AccountClosed:  {},
+}
+
+// AccountStatus is the current status of a user's account with the reason of the last change.
+type AccountStatus struct {
+	UserID    int        `json:"user_id"`
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// StatusChange is one transition in the status history of an account.
+type StatusChange struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkStatus refuses the operation when the user's status doesn't allow it; debit tells whether it takes
+// money from the user. The status row stays share-locked until tx ends, so a transition waits for
+// operations in flight and the ones after it see the new status. Callers check before locking wallets.
+func checkStatus(ctx context.Context, tx *sql.Tx, userID int, operation string, debit bool) error {
+	_, err := tx.ExecContext(ctx, `insert into Accounts (user_id, status, updated_at) values ($1, $2, $3)
+		on conflict (user_id) do nothing;`, userID, AccountActive, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	var status string
+	err = tx.QueryRowContext(ctx, `select status from Accounts where user_id = $1 for share;`, userID).Scan(&status)
+	if err != nil {
+		return err
+	}
+	if status == AccountActive || status == AccountFrozen && !debit {
+		return nil
+	}
+	return fmt.Errorf("%w. Account of user %d is %s, %s isn't allowed", ErrAccountStatus, userID, status, operation)
+}
+
+// AccountStatus returns the status of the user's account.
+func (billDB *BillingDB) AccountStatus(ctx context.Context, userID int) (AccountStatus, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	status := AccountStatus{UserID: userID, Status: AccountActive}
+	var reason, updatedBy sql.NullString
+	var updatedAt time.Time
+	err := billDB.DB.QueryRowContext(ctx, `select status, reason, updated_by, updated_at from Accounts where user_id = $1;`, userID).
+		Scan(&status.Status, &reason, &updatedBy, &updatedAt)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return AccountStatus{}, err
+	}
+	status.Reason, status.UpdatedBy = reason.String, updatedBy.String
+	if updatedBy.Valid {
+		status.UpdatedAt = &updatedAt
+	}
+	return status, nil
+}
+
+// SetAccountStatus moves the user's account to status on behalf of the caller of ctx and records the change.
+// Closing needs every wallet of the user to be empty, with no holds or pending credits left.
+func (billDB *BillingDB) SetAccountStatus(ctx context.Context, userID int, status, reason string) (StatusChange, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if _, ok := statusTransitions[status]; !ok {
+		return StatusChange{}, fmt.Errorf("%w. Unknown account status %q", ErrWrongOperation, status)
+	}
+	if strings.TrimSpace(reason) == "" {
+		return StatusChange{}, fmt.Errorf("%w. Status change needs a reason", ErrWrongOperation)
+	}
+	change := StatusChange{UserID: userID, To: status, Reason: reason, Actor: auditInfo(ctx).Actor, CreatedAt: time.Now().UTC()}
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return StatusChange{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `insert into Accounts (user_id, status, updated_at) values ($1, $2, $3)
+		on conflict (user_id) do nothing;`, userID, AccountActive, change.CreatedAt)
+	if err != nil {
+		return StatusChange{}, err
+	}
+	err = tx.QueryRowContext(ctx, `select status from Accounts where user_id = $1 for update;`, userID).Scan(&change.From)
+	if err != nil {
+		return StatusChange{}, err
+	}
+	if !allowedTransition(change.From, status) {
+		return StatusChange{}, fmt.Errorf("%w. Account of user %d can't go from %s to %s",
+			ErrWrongOperation, userID, change.From, status)
+	}
+	if status == AccountClosed {
+		if err = checkEmpty(ctx, tx, userID); err != nil {
+			return StatusChange{}, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `update Accounts set status = $2, reason = $3, updated_by = $4, updated_at = $5
+		where user_id = $1;`, userID, status, reason, change.Actor, change.CreatedAt)
+	if err != nil {
+		return StatusChange{}, err
+	}
+	err = tx.QueryRowContext(ctx, `insert into AccountStatusHistory (user_id, from_status, to_status, reason, actor, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id;`,
+		userID, change.From, status, reason, change.Actor, change.CreatedAt).Scan(&change.ID)
+	if err != nil {
+		return StatusChange{}, err
+	}
+	return change, tx.Commit()
+}
+
+func allowedTransition(from, to string) bool {
+	for _, status := range statusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEmpty refuses to close an account that still holds, owes or awaits money;
+// the remaining balance has to be paid out with a debit adjustment first.
+func checkEmpty(ctx context.Context, tx *sql.Tx, userID int) error {
+	var balance, reserved float64
+	var pending int
+	err := tx.QueryRowContext(ctx, `select
+		coalesce((select sum(abs(balance)) from Users where id = $1), 0),
+		coalesce((select sum(reserved) from Users where id = $1), 0),
+		(select count(*) from Credits where user_id = $1 and status = 'pending');`, userID).Scan(&balance, &reserved, &pending)
+	if err != nil {
+		return err
+	}
+	if balance != 0 || reserved != 0 || pending != 0 {
+		return fmt.Errorf("%w. Account of user %d isn't empty: balance %f, reserved %f, pending credits %d to settle or reject",
+			ErrWrongOperation, userID, balance, reserved, pending)
+	}
+	return nil
+}
+
+// StatusHistory lists the status changes of the user's account, newest first.
+func (billDB *BillingDB) StatusHistory(ctx context.Context, userID, limit, offset int) ([]StatusChange, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, user_id, from_status, to_status, reason, actor, created_at
+		from AccountStatusHistory where user_id = $1 order by id desc limit $2 offset $3;`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []StatusChange{}
+	for rows.Next() {
+		var change StatusChange
+		err = rows.Scan(&change.ID, &change.UserID, &change.From, &change.To, &change.Reason, &change.Actor, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// withStatus makes the fake database report status for every account and the given wallet totals.
+func withStatus(t *testing.T, status string, balance float64) (*fakeDB, BillingDB) {
+	fake, db := newFakeDB("")
+	t.Cleanup(func() { db.Close() })
+	fake.rows = map[string][]driver.Value{
+		"from Accounts":     {status},
+		"sum(abs(balance))": {balance, 0.0, int64(0)},
+	}
+	return fake, BillingDB{DB: db}
+}
+
+func TestCheckStatus(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		status         string
+		credit, debits bool
+	}{
+		{AccountActive, true, true},
+		{AccountFrozen, true, false},
+		{AccountBlocked, false, false},
+		{AccountClosed, false, false},
+	}
+	for _, tc := range cases {
+		_, billDB := withStatus(t, tc.status, 0)
+		if err := billDB.CreditUser(ctx, 1, "", 10); (err == nil) != tc.credit || err != nil && !errors.Is(err, ErrAccountStatus) {
+			t.Errorf("%s: credit returned %v", tc.status, err)
+		}
+		fake, billDB := withStatus(t, tc.status, 0)
+		err := billDB.ReserveMoney(ctx, 1, 2, 3, "", 10)
+		if (err == nil) != tc.debits || err != nil && !errors.Is(err, ErrAccountStatus) {
+			t.Errorf("%s: reserve returned %v", tc.status, err)
+		}
+		for _, statement := range fake.statements() {
+			if !tc.debits && strings.Contains(statement, "insert into Transactions") {
+				t.Errorf("%s: refused reserve still wrote %q", tc.status, statement)
+			}
+		}
+	}
+}
+
+func TestSetAccountStatus(t *testing.T) {
+	ctx := WithAudit(context.Background(), AuditInfo{Actor: "key:1"})
+	cases := []struct {
+		from, to, reason string
+		balance          float64
+		ok               bool
+	}{
+		{AccountActive, AccountFrozen, "fraud check", 0, true},
+		{AccountFrozen, AccountActive, "cleared", 0, true},
+		{AccountActive, AccountFrozen, " ", 0, false},
+		{AccountActive, AccountActive, "again", 0, false},
+		{AccountActive, "deleted", "user request", 0, false},
+		{AccountActive, AccountClosed, "user request", 0, true},
+		{AccountBlocked, AccountClosed, "user request", 15, false},
+		{AccountClosed, AccountActive, "reopen", 0, false},
+	}
+	for _, tc := range cases {
+		fake, billDB := withStatus(t, tc.from, tc.balance)
+		change, err := billDB.SetAccountStatus(ctx, 1, tc.to, tc.reason)
+		if !tc.ok {
+			if !errors.Is(err, ErrWrongOperation) {
+				t.Errorf("%s -> %s: expected ErrWrongOperation, got %v", tc.from, tc.to, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s -> %s: %v", tc.from, tc.to, err)
+			continue
+		}
+		if change.From != tc.from || change.To != tc.to || change.Actor != "key:1" {
+			t.Errorf("%s -> %s: unexpected change %+v", tc.from, tc.to, change)
+		}
+		var history bool
+		for _, statement := range fake.statements() {
+			history = history || strings.Contains(statement, "insert into AccountStatusHistory")
+		}
+		if !history {
+			t.Errorf("%s -> %s: change isn't in the history", tc.from, tc.to)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+)
+
+// Timeout keys besides the ledger operations OpCredit, OpReserve, OpCapture, OpCancel, OpRefund, OpExpire, OpTransfer
+// and OpAdjustment.
+const (
+	opConvert = "convert"
+	opCommand = "command"
+	// opRead covers balance, account and listing queries.
+	opRead = "read"
+	// opReport covers reports, statements and balance history.
+	opReport = "report"
+	// opWrite covers report jobs, webhooks and the outbox.
+	opWrite = "write"
+)
+
+// withTimeout bounds ctx by the timeout configured for the operation, or by DefaultTimeout.
+// Without either the caller's deadline, if any, is the only limit.
+func (billDB *BillingDB) withTimeout(ctx context.Context, operation string) (context.Context, context.CancelFunc) {
+	timeout, ok := billDB.Timeouts[operation]
+	if !ok {
+		timeout = billDB.DefaultTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
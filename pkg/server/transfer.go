@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+)
+
+// Transfer is money moved from one user's wallet to the wallet of another user in the same currency.
+type Transfer struct {
+	ID         int64     `json:"id"`
+	FromUserID int       `json:"from_user_id"`
+	ToUserID   int       `json:"to_user_id"`
+	Currency   string    `json:"currency"`
+	Amount     float64   `json:"amount"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Transfer moves the amount from the sender's available money to the receiver, creating the receiver's wallet
+// on the first transfer. The sender's spending limits apply, credit limits don't: only money the sender has
+// can be given away.
+func (billDB *BillingDB) Transfer(ctx context.Context, transfer Transfer) (Transfer, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpTransfer)
+	defer cancel()
+
+	if err := checkPrice(transfer.Amount); err != nil {
+		return Transfer{}, err
+	}
+	currency, err := billDB.Currency(transfer.Currency)
+	if err != nil {
+		return Transfer{}, err
+	}
+	transfer.Currency = currency
+	if transfer.FromUserID == transfer.ToUserID {
+		return Transfer{}, fmt.Errorf("%w. User %d can't transfer to themselves", ErrWrongOperation, transfer.FromUserID)
+	}
+	err = billDB.assess(ctx, risk.Operation{
+		Type: risk.OpTransfer, UserID: transfer.FromUserID, ToUserID: transfer.ToUserID, Currency: currency, Amount: transfer.Amount,
+	})
+	if err != nil {
+		return Transfer{}, err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Transfer{}, err
+	}
+	defer tx.Rollback()
+
+	if transfer, err = transferMoney(ctx, tx, transfer); err != nil {
+		return Transfer{}, err
+	}
+	return transfer, tx.Commit()
+}
+
+func transferMoney(ctx context.Context, tx *sql.Tx, transfer Transfer) (Transfer, error) {
+	// both users are always locked in the order of their ids, so two opposite transfers can't deadlock
+	users := []int{transfer.FromUserID, transfer.ToUserID}
+	if users[0] > users[1] {
+		users[0], users[1] = users[1], users[0]
+	}
+	for _, userID := range users {
+		if err := checkStatus(ctx, tx, userID, OpTransfer, userID == transfer.FromUserID); err != nil {
+			return Transfer{}, err
+		}
+	}
+	_, err := tx.ExecContext(ctx, `insert into Users (id, currency, balance, reserved) values ($1, $2, 0, 0)
+		on conflict (id, currency) do nothing;`, transfer.ToUserID, transfer.Currency)
+	if err != nil {
+		return Transfer{}, err
+	}
+	balances := map[int][2]float64{}
+	for _, userID := range users {
+		balance, reserved, err := lockUser(ctx, tx, userID, transfer.Currency)
+		if err != nil {
+			return Transfer{}, err
+		}
+		balances[userID] = [2]float64{balance, reserved}
+	}
+	from, to := balances[transfer.FromUserID], balances[transfer.ToUserID]
+	log.Printf("User's ID: %d, balance: %f %s, reserve: %f", transfer.FromUserID, from[0], transfer.Currency, from[1])
+
+	if err = checkLimits(ctx, tx, transfer.FromUserID, 0, transfer.Currency, transfer.Amount); err != nil {
+		return Transfer{}, err
+	}
+	if from[0]-from[1]-transfer.Amount < 0 {
+		return Transfer{}, fmt.Errorf("%w for transfer. Your current balance: %f %s, reserved: %f",
+			ErrNotEnoughMoney, from[0], transfer.Currency, from[1])
+	}
+	log.Print("Transfer is possible")
+
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`,
+		transfer.FromUserID, transfer.Currency, from[0]-transfer.Amount)
+	if err != nil {
+		return Transfer{}, err
+	}
+	_, err = tx.ExecContext(ctx, `update Users set balance = $3 where id = $1 and currency = $2;`,
+		transfer.ToUserID, transfer.Currency, to[0]+transfer.Amount)
+	if err != nil {
+		return Transfer{}, err
+	}
+	transfer.CreatedAt = time.Now().UTC()
+	err = tx.QueryRowContext(ctx, `insert into Transfers (from_user_id, to_user_id, currency, amount, created_at)
+		values ($1, $2, $3, $4, $5) returning id;`,
+		transfer.FromUserID, transfer.ToUserID, transfer.Currency, transfer.Amount, transfer.CreatedAt).Scan(&transfer.ID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: transfer.FromUserID, Currency: transfer.Currency, Operation: OpTransfer,
+		Amount: transfer.Amount, Balance: from[0] - transfer.Amount, Reserved: from[1], CreatedAt: transfer.CreatedAt,
+	})
+	if err != nil {
+		return Transfer{}, err
+	}
+	err = addLedgerEntry(ctx, tx, LedgerEntry{
+		UserID: transfer.ToUserID, Currency: transfer.Currency, Operation: OpTransferIn,
+		Amount: transfer.Amount, Balance: to[0] + transfer.Amount, Reserved: to[1], CreatedAt: transfer.CreatedAt,
+	})
+	if err != nil {
+		return Transfer{}, err
+	}
+	return transfer, nil
+}
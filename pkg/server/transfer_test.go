@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	billDB := BillingDB{DB: db}
+	transfer, err := billDB.Transfer(context.Background(), Transfer{FromUserID: 5, ToUserID: 2, Currency: "RUB", Amount: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.ID != 1 || transfer.Currency != "RUB" || transfer.CreatedAt.IsZero() {
+		t.Errorf("unexpected transfer %+v", transfer)
+	}
+
+	// the lower id is locked first whichever way the money goes
+	var locked []string
+	for _, args := range fake.callsOf("for update") {
+		locked = append(locked, fmt.Sprint(args[0]))
+	}
+	if strings.Join(locked, " ") != "2 5" {
+		t.Errorf("expected users 2 and 5 locked in this order, got %v", locked)
+	}
+	var balances []string
+	for _, args := range fake.callsOf("update Users set balance") {
+		balances = append(balances, fmt.Sprint(args[0], " ", args[2]))
+	}
+	if strings.Join(balances, ", ") != "5 70, 2 130" {
+		t.Errorf("expected 70 left to user 5 and 130 to user 2, got %v", balances)
+	}
+	var entries []string
+	for _, args := range fake.callsOf("insert into Ledger") {
+		entries = append(entries, fmt.Sprint(args[0], " ", args[2], " ", args[5], " ", args[6]))
+	}
+	if strings.Join(entries, ", ") != "5 transfer 30 70, 2 transfer_in 30 130" {
+		t.Errorf("unexpected ledger entries %v", entries)
+	}
+	if statements := fake.statements(); statements[len(statements)-1] != "commit" {
+		t.Errorf("transfer wasn't committed: %v", statements)
+	}
+}
+
+func TestTransferRefused(t *testing.T) {
+	cases := []struct {
+		name     string
+		transfer Transfer
+		rows     map[string][]driver.Value
+		want     error
+	}{
+		{"to themselves", Transfer{FromUserID: 5, ToUserID: 5, Amount: 30}, nil, ErrWrongOperation},
+		{"negative", Transfer{FromUserID: 5, ToUserID: 2, Amount: -30}, nil, ErrInvalidAmount},
+		// a credit limit doesn't let the sender give away money they don't have
+		{"reserved money", Transfer{FromUserID: 5, ToUserID: 2, Amount: 30}, map[string][]driver.Value{
+			"for update":          {100.0, 80.0},
+			"select credit_limit": {1000.0},
+		}, ErrNotEnoughMoney},
+		{"frozen sender", Transfer{FromUserID: 5, ToUserID: 2, Amount: 30}, map[string][]driver.Value{
+			"from Accounts": {AccountFrozen},
+		}, ErrAccountStatus},
+		{"over the limit", Transfer{FromUserID: 5, ToUserID: 2, Amount: 30}, map[string][]driver.Value{
+			"from SpendingLimits": {int64(5), "RUB", int64(0), 0.0, 100.0, 0.0, "admin", time.Now()},
+			"select timezone":     {"UTC"},
+			"from Ledger l":       {80.0, 80.0},
+		}, ErrLimitExceeded},
+	}
+	for _, tc := range cases {
+		fake, db := newFakeDB("")
+		fake.rows = tc.rows
+		billDB := BillingDB{DB: db}
+		_, err := billDB.Transfer(context.Background(), tc.transfer)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		for _, statement := range fake.statements() {
+			if strings.Contains(statement, "update Users") || strings.Contains(statement, "insert into Ledger") {
+				t.Errorf("%s: refused transfer still wrote %q", tc.name, statement)
+			}
+		}
+		db.Close()
+	}
+}
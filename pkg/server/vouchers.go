@@ -0,0 +1,578 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/report"
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+	"github.com/lib/pq"
+)
+
+// Voucher kinds: a credit voucher puts money on the balance, a discount voucher lowers the price of a reserve.
+const (
+	VoucherCredit   = "credit"
+	VoucherDiscount = "discount"
+)
+
+// Voucher values, a percentage only makes sense for discounts.
+const (
+	VoucherFixed   = "fixed"
+	VoucherPercent = "percent"
+)
+
+// Redemption statuses. A discount is released when its reserve is cancelled, expires or is refunded.
+const (
+	RedemptionRedeemed = "redeemed"
+	RedemptionReleased = "released"
+)
+
+// MaxVoucherBatch caps how many codes one batch generates.
+const MaxVoucherBatch = 10000
+
+// codeAlphabet leaves out the characters that are easy to mix up when typed, 32 of them keep rand bytes unbiased.
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const codeLength = 10
+
+// VoucherBatch is a campaign of codes sharing their value and rules. MaxRedemptions caps the uses of the whole batch,
+// PerCode the uses of each code and PerUser the uses of the batch by one user, 0 means no cap. Discounts can be limited to ServiceIDs.
+// A batch either generates Count random codes starting with Prefix or has the single Code given.
+type VoucherBatch struct {
+	ID             int64     `json:"id"`
+	Name           string    `json:"name"`
+	Kind           string    `json:"kind"`
+	ValueType      string    `json:"value_type"`
+	Value          float64   `json:"value"`
+	Currency       string    `json:"currency"`
+	ServiceIDs     []int64   `json:"service_ids"`
+	MaxRedemptions int       `json:"max_redemptions"`
+	PerCode        int       `json:"per_code"`
+	PerUser        int       `json:"per_user"`
+	ValidFrom      time.Time `json:"valid_from"`
+	ValidUntil     time.Time `json:"valid_until"`
+	Count          int       `json:"count"`
+	Prefix         string    `json:"prefix,omitempty"`
+	Code           string    `json:"code,omitempty"`
+	Codes          []string  `json:"codes,omitempty"`
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (batch VoucherBatch) Validate() error {
+	if strings.TrimSpace(batch.Name) == "" {
+		return fmt.Errorf("%w. Voucher batch needs a name", ErrWrongOperation)
+	}
+	if batch.Kind != VoucherCredit && batch.Kind != VoucherDiscount {
+		return fmt.Errorf("%w. Voucher kind must be %s or %s", ErrWrongOperation, VoucherCredit, VoucherDiscount)
+	}
+	if batch.ValueType != VoucherFixed && batch.ValueType != VoucherPercent {
+		return fmt.Errorf("%w. Voucher value must be %s or %s", ErrWrongOperation, VoucherFixed, VoucherPercent)
+	}
+	if batch.Kind == VoucherCredit && batch.ValueType != VoucherFixed {
+		return fmt.Errorf("%w. Credit vouchers need a fixed value", ErrWrongOperation)
+	}
+	if batch.Kind == VoucherCredit && len(batch.ServiceIDs) > 0 {
+		return fmt.Errorf("%w. Only discounts can be limited to services", ErrWrongOperation)
+	}
+	if batch.Value <= 0 || math.IsNaN(batch.Value) || math.IsInf(batch.Value, 0) ||
+		batch.ValueType == VoucherPercent && batch.Value > 100 {
+		return fmt.Errorf("%w. Voucher value must be positive, a percentage at most 100", ErrInvalidAmount)
+	}
+	if batch.MaxRedemptions < 0 || batch.PerCode < 0 || batch.PerUser < 0 {
+		return fmt.Errorf("%w. Redemption caps can't be negative", ErrWrongOperation)
+	}
+	if batch.Code != "" && batch.Count > 1 {
+		return fmt.Errorf("%w. A batch with its own code has only that code", ErrWrongOperation)
+	}
+	if batch.Code == "" && (batch.Count < 1 || batch.Count > MaxVoucherBatch) {
+		return fmt.Errorf("%w. A batch generates from 1 to %d codes", ErrWrongOperation, MaxVoucherBatch)
+	}
+	if batch.ValidUntil.IsZero() || !batch.ValidFrom.IsZero() && !batch.ValidUntil.After(batch.ValidFrom) {
+		return fmt.Errorf("%w. Voucher batch needs valid_until after valid_from", ErrWrongOperation)
+	}
+	for _, serviceID := range batch.ServiceIDs {
+		if serviceID <= 0 {
+			return fmt.Errorf("%w. Service ids must be positive", ErrWrongOperation)
+		}
+	}
+	return nil
+}
+
+// discount is how much of price the voucher takes off, never more than the price itself.
+func (batch VoucherBatch) discount(price float64) float64 {
+	if batch.ValueType == VoucherPercent {
+		return money(price * batch.Value / 100)
+	}
+	return math.Min(batch.Value, price)
+}
+
+// Redemption is one use of a code: the money credited, or the discount given on a reserve of Price.
+type Redemption struct {
+	ID        int64     `json:"id"`
+	Code      string    `json:"code"`
+	BatchID   int64     `json:"batch_id"`
+	Kind      string    `json:"kind"`
+	UserID    int       `json:"user_id"`
+	ServiceID int       `json:"service_id,omitempty"`
+	OrderID   int       `json:"order_id,omitempty"`
+	Currency  string    `json:"currency"`
+	Amount    float64   `json:"amount"`
+	Price     float64   `json:"price,omitempty"`
+	Charged   float64   `json:"charged,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalizeCode makes codes case-insensitive and tolerant to the spaces around them.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func generateCode(prefix string) (string, error) {
+	b := make([]byte, codeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return normalizeCode(prefix) + string(b), nil
+}
+
+const voucherBatchColumns = `id, name, kind, value_type, value, currency, service_ids, max_redemptions, per_code, per_user,
+	valid_from, valid_until, created_by, created_at`
+
+func scanVoucherBatch(row interface{ Scan(...interface{}) error }, extra ...interface{}) (VoucherBatch, error) {
+	var batch VoucherBatch
+	err := row.Scan(append([]interface{}{&batch.ID, &batch.Name, &batch.Kind, &batch.ValueType, &batch.Value, &batch.Currency,
+		pq.Array(&batch.ServiceIDs), &batch.MaxRedemptions, &batch.PerCode, &batch.PerUser, &batch.ValidFrom, &batch.ValidUntil,
+		&batch.CreatedBy, &batch.CreatedAt}, extra...)...)
+	return batch, err
+}
+
+// CreateVoucherBatch stores the batch and generates its codes, the codes are only returned here and by VoucherBatch.
+func (billDB *BillingDB) CreateVoucherBatch(ctx context.Context, batch VoucherBatch) (VoucherBatch, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if err := batch.Validate(); err != nil {
+		return VoucherBatch{}, err
+	}
+	currency, err := billDB.Currency(batch.Currency)
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	now := time.Now().UTC()
+	batch.Currency = currency
+	if batch.ValueType == VoucherFixed {
+		batch.Value = money(batch.Value)
+	}
+	if batch.ValidFrom.IsZero() {
+		batch.ValidFrom = now
+	}
+	batch.ValidFrom, batch.ValidUntil = batch.ValidFrom.UTC(), batch.ValidUntil.UTC()
+	if batch.ServiceIDs == nil {
+		batch.ServiceIDs = []int64{}
+	}
+	if batch.Code != "" {
+		batch.Count = 1
+	}
+	batch.CreatedBy = auditInfo(ctx).Actor
+	batch.CreatedAt = now
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `insert into VoucherBatches
+		(name, kind, value_type, value, currency, service_ids, max_redemptions, per_code, per_user, valid_from, valid_until,
+		created_by, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning id;`,
+		batch.Name, batch.Kind, batch.ValueType, batch.Value, batch.Currency, pq.Array(batch.ServiceIDs),
+		batch.MaxRedemptions, batch.PerCode, batch.PerUser, batch.ValidFrom, batch.ValidUntil, batch.CreatedBy, batch.CreatedAt).Scan(&batch.ID)
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	batch.Codes = make([]string, 0, batch.Count)
+	for len(batch.Codes) < batch.Count {
+		code := normalizeCode(batch.Code)
+		if code == "" {
+			if code, err = generateCode(batch.Prefix); err != nil {
+				return VoucherBatch{}, err
+			}
+		}
+		res, err := tx.ExecContext(ctx, `insert into Vouchers (code, batch_id) values ($1, $2) on conflict (code) do nothing;`,
+			code, batch.ID)
+		if err != nil {
+			return VoucherBatch{}, err
+		}
+		added, err := res.RowsAffected()
+		if err != nil {
+			return VoucherBatch{}, err
+		}
+		if added == 0 {
+			if batch.Code != "" {
+				return VoucherBatch{}, fmt.Errorf("%w. Code %s already exists", ErrWrongOperation, code)
+			}
+			// a generated code collided, draw another one
+			continue
+		}
+		batch.Codes = append(batch.Codes, code)
+	}
+	batch.Code = ""
+	return batch, tx.Commit()
+}
+
+// VoucherBatches lists the batches newest first, without their codes.
+func (billDB *BillingDB) VoucherBatches(ctx context.Context, limit, offset int) ([]VoucherBatch, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+voucherBatchColumns+`,
+		(select count(*) from Vouchers v where v.batch_id = b.id) from VoucherBatches b
+		order by id desc limit $1 offset $2;`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	batches := []VoucherBatch{}
+	for rows.Next() {
+		var count int
+		batch, err := scanVoucherBatch(rows, &count)
+		if err != nil {
+			return nil, err
+		}
+		batch.Count = count
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+// VoucherBatch returns the batch with all its codes.
+func (billDB *BillingDB) VoucherBatch(ctx context.Context, id int64) (VoucherBatch, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	batch, err := scanVoucherBatch(billDB.DB.QueryRowContext(ctx, `select `+voucherBatchColumns+` from VoucherBatches
+		where id = $1;`, id))
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	rows, err := billDB.DB.QueryContext(ctx, `select code from Vouchers where batch_id = $1 order by code;`, id)
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	defer rows.Close()
+	batch.Codes = []string{}
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			return VoucherBatch{}, err
+		}
+		batch.Codes = append(batch.Codes, code)
+	}
+	batch.Count = len(batch.Codes)
+	return batch, rows.Err()
+}
+
+// voucherUse is a locked code with how many times it, its batch and the user were using them.
+type voucherUse struct {
+	batch       VoucherBatch
+	code        string
+	redemptions int
+	total       int
+	byUser      int
+}
+
+// lockVoucher locks the code and its batch until tx ends, so concurrent redemptions can't pass the caps together.
+func lockVoucher(ctx context.Context, tx *sql.Tx, code string, userID int) (voucherUse, error) {
+	use := voucherUse{code: normalizeCode(code)}
+	var err error
+	use.batch, err = scanVoucherBatch(tx.QueryRowContext(ctx, `select `+voucherBatchColumns+`,
+		v.redemptions, b.redemptions from Vouchers v join VoucherBatches b on b.id = v.batch_id
+		where v.code = $1 for update;`, use.code), &use.redemptions, &use.total)
+	if errors.Is(err, sql.ErrNoRows) {
+		return voucherUse{}, fmt.Errorf("%w. Code %s doesn't exist", ErrInvalidVoucher, use.code)
+	}
+	if err != nil {
+		return voucherUse{}, err
+	}
+	err = tx.QueryRowContext(ctx, `select count(*) from VoucherRedemptions
+		where batch_id = $1 and user_id = $2 and status = 'redeemed';`, use.batch.ID, userID).Scan(&use.byUser)
+	return use, err
+}
+
+// check tells why the code can't be used as kind on a serviceID order in currency at now.
+func (use voucherUse) check(kind string, serviceID int, currency string, now time.Time) error {
+	batch := use.batch
+	switch {
+	case batch.Kind != kind && kind == VoucherCredit:
+		return fmt.Errorf("%w. Code %s gives a discount, use it on a reserve", ErrInvalidVoucher, use.code)
+	case batch.Kind != kind:
+		return fmt.Errorf("%w. Code %s puts money on the balance, it isn't a discount", ErrInvalidVoucher, use.code)
+	case now.Before(batch.ValidFrom):
+		return fmt.Errorf("%w. Code %s is valid from %s", ErrInvalidVoucher, use.code, batch.ValidFrom.Format(time.RFC3339))
+	case !now.Before(batch.ValidUntil):
+		return fmt.Errorf("%w. Code %s expired at %s", ErrInvalidVoucher, use.code, batch.ValidUntil.Format(time.RFC3339))
+	case batch.MaxRedemptions > 0 && use.total >= batch.MaxRedemptions:
+		return fmt.Errorf("%w. Codes of %s are used up", ErrInvalidVoucher, batch.Name)
+	case batch.PerCode > 0 && use.redemptions >= batch.PerCode:
+		return fmt.Errorf("%w. Code %s is used up", ErrInvalidVoucher, use.code)
+	case batch.PerUser > 0 && use.byUser >= batch.PerUser:
+		return fmt.Errorf("%w. Codes of %s can be used %d times per user", ErrInvalidVoucher, batch.Name, batch.PerUser)
+	case batch.Currency != currency:
+		return fmt.Errorf("%w. Code %s is for %s", ErrInvalidVoucher, use.code, batch.Currency)
+	}
+	if kind == VoucherDiscount && len(batch.ServiceIDs) > 0 {
+		for _, id := range batch.ServiceIDs {
+			if id == int64(serviceID) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w. Code %s isn't valid for service %d", ErrInvalidVoucher, use.code, serviceID)
+	}
+	return nil
+}
+
+// redeem records the use of the code.
+func (use voucherUse) redeem(ctx context.Context, tx *sql.Tx, redemption Redemption) (Redemption, error) {
+	redemption.Code, redemption.BatchID, redemption.Kind = use.code, use.batch.ID, use.batch.Kind
+	redemption.Status = RedemptionRedeemed
+	err := tx.QueryRowContext(ctx, `insert into VoucherRedemptions
+		(code, batch_id, user_id, service_id, order_id, currency, amount, status, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id;`,
+		redemption.Code, redemption.BatchID, redemption.UserID, redemption.ServiceID, redemption.OrderID,
+		redemption.Currency, redemption.Amount, redemption.Status, redemption.CreatedAt).Scan(&redemption.ID)
+	if err != nil {
+		return Redemption{}, err
+	}
+	_, err = tx.ExecContext(ctx, `update Vouchers set redemptions = redemptions + 1 where code = $1;`, use.code)
+	if err != nil {
+		return Redemption{}, err
+	}
+	_, err = tx.ExecContext(ctx, `update VoucherBatches set redemptions = redemptions + 1 where id = $1;`, use.batch.ID)
+	return redemption, err
+}
+
+// releaseVoucher gives the discount of a cancelled, expired or refunded order back, the code can be used again.
+func releaseVoucher(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int) error {
+	var code string
+	var batchID int64
+	err := tx.QueryRowContext(ctx, `update VoucherRedemptions set status = 'released'
+		where user_id = $1 and service_id = $2 and order_id = $3 and status = 'redeemed' returning code, batch_id;`,
+		userID, serviceID, orderID).Scan(&code, &batchID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update Vouchers set redemptions = redemptions - 1 where code = $1;`, code)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update VoucherBatches set redemptions = redemptions - 1 where id = $1;`, batchID)
+	return err
+}
+
+// RedeemVoucher credits the user with the value of a credit code in the same transaction that uses the code up.
+// The credit goes through the risk rules like any other; a held one keeps the code until the review is decided.
+func (billDB *BillingDB) RedeemVoucher(ctx context.Context, userID int, code string) (Redemption, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpCredit)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Redemption{}, err
+	}
+	defer tx.Rollback()
+
+	redemption, err := billDB.redeemVoucher(ctx, tx, userID, code, true)
+	if err != nil {
+		return Redemption{}, err
+	}
+	return redemption, tx.Commit()
+}
+
+// redeemVoucher credits the value of the code and uses it up. An approved review passes assess false,
+// the rules already had their say.
+func (billDB *BillingDB) redeemVoucher(ctx context.Context, tx *sql.Tx, userID int, code string, assess bool) (Redemption, error) {
+	now := time.Now().UTC()
+	use, err := lockVoucher(ctx, tx, code, userID)
+	if err != nil {
+		return Redemption{}, err
+	}
+	if err = use.check(VoucherCredit, 0, use.batch.Currency, now); err != nil {
+		return Redemption{}, err
+	}
+	if assess {
+		err = billDB.assess(ctx, risk.Operation{
+			Type: risk.OpCredit, UserID: userID, Currency: use.batch.Currency, Amount: use.batch.Value, Voucher: use.code,
+		})
+		if err != nil {
+			return Redemption{}, err
+		}
+	}
+	if err = creditUser(ctx, tx, userID, use.batch.Currency, use.batch.Value); err != nil {
+		return Redemption{}, err
+	}
+	redemption, err := use.redeem(ctx, tx, Redemption{
+		UserID: userID, Currency: use.batch.Currency, Amount: use.batch.Value, CreatedAt: now,
+	})
+	if err != nil {
+		return Redemption{}, err
+	}
+	log.Printf("Code %s credited %f %s to user %d", use.code, redemption.Amount, redemption.Currency, userID)
+	return redemption, nil
+}
+
+// ReserveWithVoucher reserves price less the discount of the code; the order is then captured at Charged.
+// Risk rules see the full price, a held reserve keeps the code and gets the discount once approved.
+func (billDB *BillingDB) ReserveWithVoucher(ctx context.Context, userID, serviceID, orderID int, currency string, price float64,
+	code string) (Redemption, error) {
+	ctx, cancel := billDB.withTimeout(ctx, OpReserve)
+	defer cancel()
+
+	if err := checkPrice(price); err != nil {
+		return Redemption{}, err
+	}
+	currency, err := billDB.Currency(currency)
+	if err != nil {
+		return Redemption{}, err
+	}
+	err = billDB.assess(ctx, risk.Operation{
+		Type: risk.OpReserve, UserID: userID, ServiceID: serviceID, OrderID: orderID, Currency: currency, Amount: price,
+		Voucher: normalizeCode(code),
+	})
+	if err != nil {
+		return Redemption{}, err
+	}
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Redemption{}, err
+	}
+	defer tx.Rollback()
+
+	redemption, err := billDB.reserveWithVoucher(ctx, tx, userID, serviceID, orderID, currency, price, code)
+	if err != nil {
+		return Redemption{}, err
+	}
+	return redemption, tx.Commit()
+}
+
+func (billDB *BillingDB) reserveWithVoucher(ctx context.Context, tx *sql.Tx, userID, serviceID, orderID int, currency string,
+	price float64, code string) (Redemption, error) {
+	now := time.Now().UTC()
+	use, err := lockVoucher(ctx, tx, code, userID)
+	if err != nil {
+		return Redemption{}, err
+	}
+	if err = use.check(VoucherDiscount, serviceID, currency, now); err != nil {
+		return Redemption{}, err
+	}
+	discount := use.batch.discount(price)
+	charged := money(price - discount)
+	if err = billDB.reserveMoney(ctx, tx, userID, serviceID, orderID, currency, charged); err != nil {
+		return Redemption{}, err
+	}
+	_, err = tx.ExecContext(ctx, `update Transactions set discount = $4
+		where order_id = $1 and user_id = $2 and service_id = $3 and order_status = 'reserved';`,
+		orderID, userID, serviceID, discount)
+	if err != nil {
+		return Redemption{}, err
+	}
+	redemption, err := use.redeem(ctx, tx, Redemption{
+		UserID: userID, ServiceID: serviceID, OrderID: orderID, Currency: currency, Amount: discount, CreatedAt: now,
+	})
+	if err != nil {
+		return Redemption{}, err
+	}
+	redemption.Price, redemption.Charged = price, charged
+	return redemption, nil
+}
+
+// VoucherUsage is how a batch has been used so far. Amount is the money credited or the discounts given.
+type VoucherUsage struct {
+	BatchID     int64     `json:"batch_id"`
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"`
+	Currency    string    `json:"currency"`
+	ValidUntil  time.Time `json:"valid_until"`
+	Codes       int       `json:"codes"`
+	Redemptions int       `json:"redemptions"`
+	Users       int       `json:"users"`
+	Amount      float64   `json:"amount"`
+	Released    int       `json:"released"`
+}
+
+type VoucherReport struct {
+	Date    time.Time      `json:"date"`
+	Batches []VoucherUsage `json:"batches"`
+}
+
+// VoucherReport sums up the redemptions of every batch, released discounts are counted apart.
+func (billDB *BillingDB) VoucherReport(ctx context.Context, now time.Time) (VoucherReport, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opReport)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select b.id, b.name, b.kind, b.currency, b.valid_until,
+			(select count(*) from Vouchers v where v.batch_id = b.id),
+			count(r.id) filter (where r.status = 'redeemed'),
+			count(distinct r.user_id) filter (where r.status = 'redeemed'),
+			coalesce(sum(r.amount) filter (where r.status = 'redeemed'), 0),
+			count(r.id) filter (where r.status = 'released')
+		from VoucherBatches b left join VoucherRedemptions r on r.batch_id = b.id
+		group by b.id order by b.id;`)
+	if err != nil {
+		return VoucherReport{}, err
+	}
+	defer rows.Close()
+	usage := VoucherReport{Date: now.UTC(), Batches: []VoucherUsage{}}
+	for rows.Next() {
+		var batch VoucherUsage
+		err = rows.Scan(&batch.BatchID, &batch.Name, &batch.Kind, &batch.Currency, &batch.ValidUntil, &batch.Codes,
+			&batch.Redemptions, &batch.Users, &batch.Amount, &batch.Released)
+		if err != nil {
+			return VoucherReport{}, err
+		}
+		usage.Batches = append(usage.Batches, batch)
+	}
+	return usage, rows.Err()
+}
+
+// Table converts the report into the shared tabular model.
+func (r VoucherReport) Table() *report.Table {
+	table := &report.Table{
+		Name: fmt.Sprintf("vouchers_%s", r.Date.Format(dateLayout)),
+		Columns: []report.Column{
+			{Name: "batch_id", Type: report.Int},
+			{Name: "name", Type: report.String},
+			{Name: "kind", Type: report.String},
+			{Name: "currency", Type: report.String},
+			{Name: "valid_until", Type: report.Time},
+			{Name: "codes", Type: report.Int},
+			{Name: "redemptions", Type: report.Int},
+			{Name: "users", Type: report.Int},
+			{Name: "amount", Type: report.Float},
+			{Name: "released", Type: report.Int},
+		},
+		Rows: make([][]interface{}, 0, len(r.Batches)),
+	}
+	for _, batch := range r.Batches {
+		table.Rows = append(table.Rows, []interface{}{
+			batch.BatchID, batch.Name, batch.Kind, batch.Currency, batch.ValidUntil,
+			batch.Codes, batch.Redemptions, batch.Users, batch.Amount, batch.Released,
+		})
+	}
+	return table
+}
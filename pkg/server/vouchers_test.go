@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/risk"
+)
+
+func TestVoucherBatchValidate(t *testing.T) {
+	until := time.Now().Add(24 * time.Hour)
+	valid := VoucherBatch{Name: "november", Kind: VoucherDiscount, ValueType: VoucherPercent, Value: 15, Count: 100, ValidUntil: until}
+	cases := []struct {
+		name   string
+		change func(*VoucherBatch)
+		err    error
+	}{
+		{"valid", func(b *VoucherBatch) {}, nil},
+		{"own code", func(b *VoucherBatch) { b.Code, b.Count = "PROMO", 0 }, nil},
+		{"no name", func(b *VoucherBatch) { b.Name = " " }, ErrWrongOperation},
+		{"unknown kind", func(b *VoucherBatch) { b.Kind = "gift" }, ErrWrongOperation},
+		{"percent credit", func(b *VoucherBatch) { b.Kind = VoucherCredit }, ErrWrongOperation},
+		{"credit for a service", func(b *VoucherBatch) {
+			b.Kind, b.ValueType, b.ServiceIDs = VoucherCredit, VoucherFixed, []int64{1}
+		}, ErrWrongOperation},
+		{"over 100 percent", func(b *VoucherBatch) { b.Value = 101 }, ErrInvalidAmount},
+		{"zero value", func(b *VoucherBatch) { b.Value = 0 }, ErrInvalidAmount},
+		{"too many codes", func(b *VoucherBatch) { b.Count = MaxVoucherBatch + 1 }, ErrWrongOperation},
+		{"own code with count", func(b *VoucherBatch) { b.Code = "PROMO" }, ErrWrongOperation},
+		{"negative cap", func(b *VoucherBatch) { b.PerUser = -1 }, ErrWrongOperation},
+		{"negative code cap", func(b *VoucherBatch) { b.PerCode = -1 }, ErrWrongOperation},
+		{"no end", func(b *VoucherBatch) { b.ValidUntil = time.Time{} }, ErrWrongOperation},
+		{"ends before start", func(b *VoucherBatch) { b.ValidFrom = until.Add(time.Hour) }, ErrWrongOperation},
+	}
+	for _, tc := range cases {
+		batch := valid
+		tc.change(&batch)
+		if err := batch.Validate(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestVoucherDiscount(t *testing.T) {
+	cases := []struct {
+		valueType    string
+		value, price float64
+		want         float64
+	}{
+		{VoucherFixed, 100, 250, 100},
+		{VoucherFixed, 100, 60, 60},
+		{VoucherPercent, 15, 99.99, 15},
+		{VoucherPercent, 100, 40, 40},
+	}
+	for _, tc := range cases {
+		batch := VoucherBatch{ValueType: tc.valueType, Value: tc.value}
+		if got := batch.discount(tc.price); got != tc.want {
+			t.Errorf("%s %f of %f: expected %f, got %f", tc.valueType, tc.value, tc.price, tc.want, got)
+		}
+	}
+}
+
+func TestVoucherCheck(t *testing.T) {
+	now := time.Date(2022, 11, 15, 12, 0, 0, 0, time.UTC)
+	batch := VoucherBatch{
+		Name: "november", Kind: VoucherDiscount, Currency: "RUB", ServiceIDs: []int64{30},
+		MaxRedemptions: 10, PerCode: 3, PerUser: 2, ValidFrom: now.AddDate(0, 0, -1), ValidUntil: now.AddDate(0, 0, 1),
+	}
+	cases := []struct {
+		name      string
+		use       voucherUse
+		kind      string
+		serviceID int
+		currency  string
+		now       time.Time
+		ok        bool
+	}{
+		{name: "valid", use: voucherUse{batch: batch}, kind: VoucherDiscount, serviceID: 30, currency: "RUB", now: now, ok: true},
+		{name: "wrong kind", use: voucherUse{batch: batch}, kind: VoucherCredit, serviceID: 30, currency: "RUB", now: now},
+		{name: "other service", use: voucherUse{batch: batch}, kind: VoucherDiscount, serviceID: 1, currency: "RUB", now: now},
+		{name: "other currency", use: voucherUse{batch: batch}, kind: VoucherDiscount, serviceID: 30, currency: "KZT", now: now},
+		{name: "not yet", use: voucherUse{batch: batch}, kind: VoucherDiscount, serviceID: 30, currency: "RUB",
+			now: batch.ValidFrom.Add(-time.Second)},
+		{name: "expired", use: voucherUse{batch: batch}, kind: VoucherDiscount, serviceID: 30, currency: "RUB",
+			now: batch.ValidUntil},
+		{name: "batch used up", use: voucherUse{batch: batch, redemptions: 1, total: 10}, kind: VoucherDiscount, serviceID: 30,
+			currency: "RUB", now: now},
+		{name: "code used up", use: voucherUse{batch: batch, redemptions: 3, total: 3}, kind: VoucherDiscount, serviceID: 30,
+			currency: "RUB", now: now},
+		{name: "per user", use: voucherUse{batch: batch, byUser: 2}, kind: VoucherDiscount, serviceID: 30, currency: "RUB", now: now},
+	}
+	for _, tc := range cases {
+		err := tc.use.check(tc.kind, tc.serviceID, tc.currency, tc.now)
+		if tc.ok && err != nil || !tc.ok && !errors.Is(err, ErrInvalidVoucher) {
+			t.Errorf("%s: unexpected %v", tc.name, err)
+		}
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := generateCode("nov-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(code, "NOV-") || len(code) != len("NOV-")+codeLength {
+			t.Fatalf("unexpected code %q", code)
+		}
+		for _, r := range strings.TrimPrefix(code, "NOV-") {
+			if !strings.ContainsRune(codeAlphabet, r) {
+				t.Fatalf("code %q has %q outside the alphabet", code, r)
+			}
+		}
+		if seen[code] {
+			t.Fatalf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestReserveWithVoucher(t *testing.T) {
+	now := time.Now().UTC()
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Vouchers v": {int64(4), "november", VoucherDiscount, VoucherPercent, 30.0, "RUB", []byte("{2}"), int64(100), int64(0),
+			int64(1), now.Add(-time.Hour), now.Add(time.Hour), "admin", now, int64(5), int64(40)},
+		"select count(*) from VoucherRedemptions": {int64(0)},
+	}
+	billDB := BillingDB{DB: db}
+	redemption, err := billDB.ReserveWithVoucher(context.Background(), 1, 2, 3, "", 100, " promo ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redemption.Code != "PROMO" || redemption.Amount != 30 || redemption.Charged != 70 || redemption.Status != RedemptionRedeemed {
+		t.Errorf("unexpected redemption %+v", redemption)
+	}
+	var discounted, redeemed, counted bool
+	for _, statement := range fake.statements() {
+		discounted = discounted || strings.Contains(statement, "update Transactions set discount") &&
+			strings.Contains(statement, "service_id = $3")
+		redeemed = redeemed || strings.Contains(statement, "update Vouchers set redemptions = redemptions + 1")
+		counted = counted || strings.Contains(statement, "update VoucherBatches set redemptions = redemptions + 1")
+	}
+	if !discounted || !redeemed || !counted {
+		t.Errorf("discount or redemption wasn't recorded: %q", fake.statements())
+	}
+
+	_, err = billDB.ReserveWithVoucher(context.Background(), 1, 7, 3, "", 100, "PROMO")
+	if !errors.Is(err, ErrInvalidVoucher) {
+		t.Errorf("expected the service restriction to refuse service 7, got %v", err)
+	}
+}
+
+func TestReleaseVoucher(t *testing.T) {
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"returning code, batch_id": {"PROMO", int64(4)},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = releaseVoucher(context.Background(), tx, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	var keyed, code, batch bool
+	for _, statement := range fake.statements() {
+		keyed = keyed || strings.Contains(statement, "user_id = $1 and service_id = $2 and order_id = $3")
+		code = code || strings.Contains(statement, "update Vouchers set redemptions = redemptions - 1")
+		batch = batch || strings.Contains(statement, "update VoucherBatches set redemptions = redemptions - 1")
+	}
+	if !keyed || !code || !batch {
+		t.Errorf("redemption wasn't released by service: %q", fake.statements())
+	}
+}
+
+func TestVoucherOperationsReviewed(t *testing.T) {
+	now := time.Now().UTC()
+	engine, err := risk.New([]risk.Rule{
+		{Name: "large", Type: risk.Threshold, Amount: 100, Action: risk.Review},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fake, db := newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Vouchers v": {int64(4), "gift", VoucherCredit, VoucherFixed, 500.0, "RUB", []byte("{}"), int64(100), int64(0),
+			int64(1), now.Add(-time.Hour), now.Add(time.Hour), "admin", now, int64(0), int64(0)},
+		"select count(*) from VoucherRedemptions": {int64(0)},
+	}
+	billDB := BillingDB{DB: db, Risk: engine}
+	// a credit code is a credit for the rules too
+	_, err = billDB.RedeemVoucher(ctx, 1, "gift")
+	var reviewErr *ReviewError
+	if !errors.As(err, &reviewErr) || reviewErr.Review.Operation.Voucher != "GIFT" || reviewErr.Review.Operation.Amount != 500 {
+		t.Fatalf("expected the credit code to be held with the code, got %v", err)
+	}
+	if args := fake.argsOf("insert into Reviews"); len(args) < 8 || args[7] != "GIFT" {
+		t.Errorf("code wasn't stored on the review: %v", args)
+	}
+	for _, statement := range fake.statements() {
+		if strings.Contains(statement, "insert into Users") {
+			t.Errorf("held credit code still credited %q", statement)
+		}
+	}
+
+	// approving a held discount reserve gives the discount and uses the code
+	fake, db = newFakeDB("")
+	defer db.Close()
+	fake.rows = map[string][]driver.Value{
+		"from Reviews": {int64(6), risk.OpReserve, int64(1), int64(0), int64(2), int64(3), "RUB", 100.0, "PROMO", false, "large",
+			"reserve of 100.00 is at least 100.00", ReviewPending, "key:1", "", now, nil},
+		"from Vouchers v": {int64(4), "november", VoucherDiscount, VoucherPercent, 30.0, "RUB", []byte("{2}"), int64(100), int64(0),
+			int64(1), now.Add(-time.Hour), now.Add(time.Hour), "admin", now, int64(5), int64(40)},
+		"select count(*) from VoucherRedemptions": {int64(0)},
+	}
+	billDB = BillingDB{DB: db, Risk: engine}
+	if _, err = billDB.ApproveReview(ctx, 6); err != nil {
+		t.Fatal(err)
+	}
+	if args := fake.argsOf("insert into Transactions"); len(args) < 5 || args[4] != 70.0 {
+		t.Errorf("expected 70 to be reserved after the discount, got %v", args)
+	}
+	if args := fake.argsOf("update Vouchers set redemptions = redemptions + 1"); len(args) == 0 || args[0] != "PROMO" {
+		t.Errorf("code wasn't used up: %v", args)
+	}
+}
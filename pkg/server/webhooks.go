@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Subscription sends the events of a service's orders to URL. Empty Events means every event.
+// Secret signs the payloads, it is only returned when the subscription is created.
+type Subscription struct {
+	ID        int64     `json:"id"`
+	ServiceID int       `json:"service_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Delivery is one event on its way to one subscription.
+type Delivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int64           `json:"subscription_id"`
+	EventID        int64           `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+
+	// URL and Secret are filled by ClaimDelivery.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// DeliveryAttempt logs a single request, StatusCode is 0 when no answer was received.
+type DeliveryAttempt struct {
+	ID          int64     `json:"id"`
+	DeliveryID  int64     `json:"delivery_id"`
+	StatusCode  int       `json:"status_code"`
+	Error       string    `json:"error,omitempty"`
+	Duration    int64     `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+const subscriptionColumns = `id, service_id, url, events, active, created_at, updated_at`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (Subscription, error) {
+	var sub Subscription
+	err := row.Scan(&sub.ID, &sub.ServiceID, &sub.URL, pq.Array(&sub.Events), &sub.Active, &sub.CreatedAt, &sub.UpdatedAt)
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+	return sub, err
+}
+
+// CreateSubscription stores an active subscription with a freshly generated secret.
+func (billDB *BillingDB) CreateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Subscription{}, err
+	}
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+	sub.Secret = hex.EncodeToString(secret)
+	sub.Active = true
+	sub.CreatedAt = time.Now().UTC()
+	sub.UpdatedAt = sub.CreatedAt
+	err := billDB.DB.QueryRowContext(ctx, `insert into WebhookSubscriptions (service_id, url, secret, events, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id;`,
+		sub.ServiceID, sub.URL, sub.Secret, pq.Array(sub.Events), sub.Active, sub.CreatedAt, sub.UpdatedAt).Scan(&sub.ID)
+	if err != nil {
+		return Subscription{}, err
+	}
+	return sub, nil
+}
+
+// Subscriptions lists the subscriptions of a service, or of all services when serviceID is 0.
+func (billDB *BillingDB) Subscriptions(ctx context.Context, serviceID int) ([]Subscription, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+subscriptionColumns+` from WebhookSubscriptions
+		where $1 = 0 or service_id = $1 order by id;`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (billDB *BillingDB) Subscription(ctx context.Context, id int64) (Subscription, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return scanSubscription(billDB.DB.QueryRowContext(ctx, `select `+subscriptionColumns+` from WebhookSubscriptions where id = $1;`, id))
+}
+
+// UpdateSubscription changes the URL, event filter and active flag, sql.ErrNoRows means there is no such subscription.
+func (billDB *BillingDB) UpdateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+	return scanSubscription(billDB.DB.QueryRowContext(ctx, `update WebhookSubscriptions
+		set url = $2, events = $3, active = $4, updated_at = $5
+		where id = $1 returning `+subscriptionColumns+`;`,
+		sub.ID, sub.URL, pq.Array(sub.Events), sub.Active, time.Now().UTC()))
+}
+
+// DeleteSubscription removes the subscription together with its delivery logs.
+func (billDB *BillingDB) DeleteSubscription(ctx context.Context, id int64) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	res, err := billDB.DB.ExecContext(ctx, `delete from WebhookSubscriptions where id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnqueueDeliveries creates a delivery of the event for every active subscription of the service
+// that accepts it. Enqueueing the same event twice does nothing.
+func (billDB *BillingDB) EnqueueDeliveries(ctx context.Context, serviceID int, event Event) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = billDB.DB.ExecContext(ctx, `insert into WebhookDeliveries
+		(subscription_id, event_id, event_type, payload, status, next_attempt_at, created_at)
+		select id, $2, $3, $4, $5, $6, $6 from WebhookSubscriptions
+		where service_id = $1 and active and (cardinality(events) = 0 or $3 = any(events))
+		on conflict (subscription_id, event_id) do nothing;`,
+		serviceID, event.ID, event.Type, payload, DeliveryPending, now)
+	return err
+}
+
+// ClaimDelivery takes the most overdue pending delivery and counts an attempt for it.
+// The delivery is hidden from other workers for lease, after that a crashed attempt is retried.
+// sql.ErrNoRows is returned when nothing is due.
+func (billDB *BillingDB) ClaimDelivery(ctx context.Context, lease time.Duration) (Delivery, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := time.Now().UTC()
+	var d Delivery
+	err := billDB.DB.QueryRowContext(ctx, `
+		update WebhookDeliveries d set attempts = d.attempts + 1, next_attempt_at = $2
+		from WebhookSubscriptions s
+		where s.id = d.subscription_id and d.id = (
+			select d.id from WebhookDeliveries d join WebhookSubscriptions s on s.id = d.subscription_id
+			where d.status = $3 and d.next_attempt_at <= $1 and s.active
+			order by d.next_attempt_at
+			limit 1
+			for update of d skip locked
+		)
+		returning d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+			d.next_attempt_at, d.last_error, d.created_at, s.url, s.secret;`,
+		now, now.Add(lease), DeliveryPending).
+		Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.URL, &d.Secret)
+	return d, err
+}
+
+// RecordAttempt logs the attempt and moves the delivery on: delivered when the attempt succeeded,
+// dead when dead is set, otherwise pending until next.
+func (billDB *BillingDB) RecordAttempt(ctx context.Context, attempt DeliveryAttempt, next time.Time, dead bool) error {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := billDB.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `insert into WebhookAttempts (delivery_id, status_code, error, duration_ms, attempted_at)
+		values ($1, $2, $3, $4, $5);`,
+		attempt.DeliveryID, attempt.StatusCode, attempt.Error, attempt.Duration, attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+	switch {
+	case attempt.Error == "":
+		_, err = tx.ExecContext(ctx, `update WebhookDeliveries set status = $2, last_error = '', delivered_at = $3 where id = $1;`,
+			attempt.DeliveryID, DeliveryDelivered, attempt.AttemptedAt)
+	case dead:
+		_, err = tx.ExecContext(ctx, `update WebhookDeliveries set status = $2, last_error = $3 where id = $1;`,
+			attempt.DeliveryID, DeliveryDead, attempt.Error)
+	default:
+		_, err = tx.ExecContext(ctx, `update WebhookDeliveries set last_error = $2, next_attempt_at = $3 where id = $1;`,
+			attempt.DeliveryID, attempt.Error, next.UTC())
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const deliveryColumns = `id, subscription_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_error, created_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (Delivery, error) {
+	var d Delivery
+	var deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastError, &d.CreatedAt, &deliveredAt)
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, err
+}
+
+// Deliveries lists the deliveries of a subscription newest first, optionally only those in status.
+func (billDB *BillingDB) Deliveries(ctx context.Context, subscriptionID int64, status string, limit, offset int) ([]Delivery, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select `+deliveryColumns+` from WebhookDeliveries
+		where subscription_id = $1 and ($2 = '' or status = $2)
+		order by id desc limit $3 offset $4;`, subscriptionID, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (billDB *BillingDB) Delivery(ctx context.Context, id int64) (Delivery, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	return scanDelivery(billDB.DB.QueryRowContext(ctx, `select `+deliveryColumns+` from WebhookDeliveries where id = $1;`, id))
+}
+
+// DeliveryAttempts returns the log of every request made for the delivery.
+func (billDB *BillingDB) DeliveryAttempts(ctx context.Context, deliveryID int64) ([]DeliveryAttempt, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opRead)
+	defer cancel()
+
+	rows, err := billDB.DB.QueryContext(ctx, `select id, delivery_id, status_code, error, duration_ms, attempted_at
+		from WebhookAttempts where delivery_id = $1 order by id;`, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []DeliveryAttempt{}
+	for rows.Next() {
+		var a DeliveryAttempt
+		if err = rows.Scan(&a.ID, &a.DeliveryID, &a.StatusCode, &a.Error, &a.Duration, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// ReplayDelivery queues a delivery again from its first attempt, whatever its status.
+func (billDB *BillingDB) ReplayDelivery(ctx context.Context, id int64) (Delivery, error) {
+	ctx, cancel := billDB.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return scanDelivery(billDB.DB.QueryRowContext(ctx, `update WebhookDeliveries
+		set status = $2, attempts = 0, next_attempt_at = $3, last_error = '', delivered_at = null
+		where id = $1 returning `+deliveryColumns+`;`, id, DeliveryPending, time.Now().UTC()))
+}
@@ -0,0 +1,34 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+// Fanout is an outbox sink that turns every order event into deliveries
+// for the subscriptions of the order's service.
+type Fanout struct {
+	db *server.BillingDB
+}
+
+func NewFanout(db *server.BillingDB) *Fanout {
+	return &Fanout{db: db}
+}
+
+func (f *Fanout) Publish(ctx context.Context, event server.Event) error {
+	var entry server.LedgerEntry
+	if err := json.Unmarshal(event.Data, &entry); err != nil {
+		return err
+	}
+	if entry.ServiceID == 0 {
+		// credits belong to no service
+		return nil
+	}
+	return f.db.EnqueueDeliveries(ctx, entry.ServiceID, event)
+}
+
+func (f *Fanout) Close() error {
+	return nil
+}
@@ -0,0 +1,170 @@
+// Package webhooks delivers billing events to the URLs partner services subscribed with.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+const (
+	// pollInterval bounds how late a retry is sent after it became due.
+	pollInterval = time.Second
+	// lease is how long a claimed delivery is hidden from other workers.
+	lease = time.Minute
+)
+
+// Signature headers, the receiver recomputes the signature with Verify.
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderDelivery  = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+)
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" prefixed with "sha256=".
+// Including the timestamp lets receivers reject replayed requests.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign in constant time.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Backoff returns the delay before the attempt following the given one: base, 2*base, 4*base... up to max.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// Dispatcher sends due deliveries and retries failed ones with exponential backoff.
+// A delivery that failed MaxAttempts times is dead until it is replayed.
+type Dispatcher struct {
+	db          *server.BillingDB
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func NewDispatcher(db *server.BillingDB, timeout time.Duration, maxAttempts int, baseDelay, maxDelay time.Duration) *Dispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Dispatcher{
+		db:          db,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+	}
+}
+
+// Run sends deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		delivery, err := d.db.ClaimDelivery(ctx, lease)
+		switch {
+		case err == nil:
+			d.process(ctx, delivery)
+			continue
+		case !errors.Is(err, sql.ErrNoRows):
+			log.Print("ERROR: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) process(ctx context.Context, delivery server.Delivery) {
+	attempt := send(ctx, d.client, delivery)
+	dead := attempt.Error != "" && delivery.Attempts >= d.maxAttempts
+	next := attempt.AttemptedAt.Add(Backoff(delivery.Attempts, d.baseDelay, d.maxDelay))
+	if dead {
+		log.Printf("ERROR: webhook delivery %d is dead after %d attempts: %s", delivery.ID, delivery.Attempts, attempt.Error)
+	}
+	if err := d.db.RecordAttempt(ctx, attempt, next, dead); err != nil {
+		log.Print("ERROR: ", err)
+	}
+}
+
+// send posts the signed payload once, any 2xx answer means the delivery succeeded.
+func send(ctx context.Context, client *http.Client, delivery server.Delivery) server.DeliveryAttempt {
+	attempt := server.DeliveryAttempt{
+		DeliveryID:  delivery.ID,
+		AttemptedAt: time.Now().UTC(),
+	}
+	timestamp := attempt.AttemptedAt.Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := client.Do(req)
+	attempt.Duration = time.Since(attempt.AttemptedAt).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "receiver answered " + resp.Status
+	}
+	return attempt
+}
+
+// Validate checks a subscription before it is stored.
+func Validate(sub server.Subscription) error {
+	if sub.ServiceID <= 0 {
+		return fmt.Errorf("service_id must be positive")
+	}
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	for _, event := range sub.Events {
+		known := false
+		for _, eventType := range server.EventTypes {
+			known = known || event == eventType
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
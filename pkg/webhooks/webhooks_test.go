@@ -0,0 +1,102 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Placebo900/billing_service_test/pkg/server"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := Sign("secret", 1667470000, body)
+	if !Verify("secret", 1667470000, body, signature) {
+		t.Error("signature doesn't verify")
+	}
+	if Verify("other", 1667470000, body, signature) {
+		t.Error("signature verifies with a wrong secret")
+	}
+	if Verify("secret", 1667470001, body, signature) {
+		t.Error("signature verifies with a wrong timestamp")
+	}
+	if Verify("secret", 1667470000, []byte(`{"id":2}`), signature) {
+		t.Error("signature verifies for a different body")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 30*time.Second, 10*time.Minute
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{40, 10 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got := Backoff(tc.attempt, base, max); got != tc.want {
+			t.Errorf("attempt %d: expected %s, got %s", tc.attempt, tc.want, got)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	const secret = "s3cret"
+	payload := []byte(`{"id":15,"type":"ReserveCaptured","user_id":1,"data":{"order_id":3,"service_id":2}}`)
+	status := http.StatusOK
+	var verified bool
+	var event string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if err != nil {
+			t.Error(err)
+		}
+		verified = Verify(secret, timestamp, body, r.Header.Get(HeaderSignature))
+		event = r.Header.Get(HeaderEvent)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	delivery := server.Delivery{
+		ID:        7,
+		EventType: server.EventReserveCaptured,
+		Payload:   payload,
+		URL:       receiver.URL,
+		Secret:    secret,
+	}
+	attempt := send(context.Background(), receiver.Client(), delivery)
+	if attempt.Error != "" || attempt.StatusCode != http.StatusOK || attempt.DeliveryID != 7 {
+		t.Errorf("unexpected attempt %+v", attempt)
+	}
+	if !verified {
+		t.Error("receiver couldn't verify the signature")
+	}
+	if event != server.EventReserveCaptured {
+		t.Errorf("expected event header %s, got %q", server.EventReserveCaptured, event)
+	}
+
+	status = http.StatusInternalServerError
+	attempt = send(context.Background(), receiver.Client(), delivery)
+	if attempt.Error == "" || attempt.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a failed attempt, got %+v", attempt)
+	}
+
+	receiver.Close()
+	attempt = send(context.Background(), receiver.Client(), delivery)
+	if attempt.Error == "" || attempt.StatusCode != 0 {
+		t.Errorf("expected a connection error, got %+v", attempt)
+	}
+}